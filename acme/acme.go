@@ -0,0 +1,507 @@
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	nethttp "net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hamba/pkg/log"
+	"github.com/nrwiersma/proxy/internal/slices"
+	"golang.org/x/crypto/acme"
+)
+
+// LetsEncryptURL is the Let's Encrypt production directory URL.
+const LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+const (
+	accountKeyFile = "account.key"
+
+	challengeHTTP01    = "http-01"
+	challengeTLSALPN01 = "tls-alpn-01"
+
+	checkInterval = 12 * time.Hour
+	obtainTimeout = 5 * time.Minute
+)
+
+// Opts configures a certificate manager.
+type Opts struct {
+	// DirectoryURL is the ACME directory URL. If empty, the
+	// Let's Encrypt production directory is used.
+	DirectoryURL string
+
+	// Email is the optional contact email of the account.
+	Email string
+
+	// Storage is the directory in which the account key and
+	// certificates are stored.
+	Storage string
+
+	// Domains are the domains to obtain certificates for.
+	Domains []string
+
+	// RenewBefore is how long before expiry a certificate is renewed.
+	// If RenewBefore is zero, certificates are renewed 30 days before expiry.
+	RenewBefore time.Duration
+
+	// InsecureSkipVerify disables verification of the directory
+	// server certificate. This should only be used for testing.
+	InsecureSkipVerify bool
+
+	// Log is an optional logger.
+	Log log.Logger
+}
+
+// Manager obtains and renews certificates from an ACME CA.
+//
+// HTTP-01 challenges are answered by the handler returned from HTTPHandler,
+// TLS-ALPN-01 challenges by a TLS config set up with ConfigureTLS.
+type Manager struct {
+	client      *acme.Client
+	email       string
+	storage     string
+	domains     []string
+	renewBefore time.Duration
+	log         log.Logger
+
+	mu         sync.RWMutex
+	registered bool
+	tryHTTP01  bool
+	tryALPN01  bool
+	certs      map[string]*tls.Certificate
+	tokens     map[string]string
+	alpnCerts  map[string]*tls.Certificate
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New returns a certificate manager, loading any stored certificates.
+func New(opts Opts) (*Manager, error) {
+	if opts.Storage == "" {
+		return nil, errors.New("acme: storage directory is required")
+	}
+	if err := os.MkdirAll(opts.Storage, 0700); err != nil {
+		return nil, err
+	}
+
+	key, err := loadOrCreateKey(filepath.Join(opts.Storage, accountKeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	dirURL := opts.DirectoryURL
+	if dirURL == "" {
+		dirURL = LetsEncryptURL
+	}
+
+	client := &acme.Client{Key: key, DirectoryURL: dirURL}
+	if opts.InsecureSkipVerify {
+		client.HTTPClient = &nethttp.Client{
+			Transport: &nethttp.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		}
+	}
+
+	renewBefore := opts.RenewBefore
+	if renewBefore == 0 {
+		renewBefore = 30 * 24 * time.Hour
+	}
+
+	l := opts.Log
+	if l == nil {
+		l = log.Null
+	}
+
+	m := &Manager{
+		client:      client,
+		email:       opts.Email,
+		storage:     opts.Storage,
+		renewBefore: renewBefore,
+		log:         l,
+		certs:       map[string]*tls.Certificate{},
+		tokens:      map[string]string{},
+		alpnCerts:   map[string]*tls.Certificate{},
+		done:        make(chan struct{}),
+	}
+
+	for _, domain := range opts.Domains {
+		domain = normalizeName(domain)
+		m.domains = append(m.domains, domain)
+
+		cert, err := loadCert(m.certFile(domain), m.keyFile(domain))
+		if err != nil {
+			continue
+		}
+		m.certs[domain] = cert
+	}
+
+	return m, nil
+}
+
+// GetCertificate returns the certificate for the requested server name.
+//
+// If the manager has no certificate for the server name, nil is returned
+// so that the static certificates of the TLS config are used.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := normalizeName(hello.ServerName)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if isALPNChallenge(hello) {
+		cert, ok := m.alpnCerts[name]
+		if !ok {
+			return nil, fmt.Errorf("acme: no challenge certificate for %s", name)
+		}
+		return cert, nil
+	}
+
+	return m.certs[name], nil
+}
+
+// ConfigureTLS sets up the TLS config to serve the managed certificates
+// and answer TLS-ALPN-01 challenges.
+//
+// HTTP/1.1 is advertised alongside the challenge protocol, as handshakes
+// fail when the client and server protocols do not overlap.
+func (m *Manager) ConfigureTLS(config *tls.Config) {
+	m.mu.Lock()
+	m.tryALPN01 = true
+	m.mu.Unlock()
+
+	config.GetCertificate = m.GetCertificate
+	for _, proto := range []string{"http/1.1", acme.ALPNProto} {
+		if !slices.StringContains(proto, config.NextProtos) {
+			config.NextProtos = append(config.NextProtos, proto)
+		}
+	}
+}
+
+// Start starts obtaining and renewing certificates in the background.
+func (m *Manager) Start() {
+	go func() {
+		m.renew()
+
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.done:
+				return
+			case <-ticker.C:
+				m.renew()
+			}
+		}
+	}()
+}
+
+// Close stops the manager from renewing certificates.
+func (m *Manager) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.done)
+	})
+	return nil
+}
+
+func (m *Manager) renew() {
+	for _, domain := range m.domains {
+		m.mu.RLock()
+		cert := m.certs[domain]
+		m.mu.RUnlock()
+
+		if cert != nil && cert.Leaf != nil && time.Until(cert.Leaf.NotAfter) > m.renewBefore {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), obtainTimeout)
+		cert, err := m.obtain(ctx, domain)
+		cancel()
+		if err != nil {
+			m.log.Error("acme: could not obtain certificate", "domain", domain, "error", err)
+			continue
+		}
+
+		if err := m.saveCert(domain, cert); err != nil {
+			m.log.Error("acme: could not store certificate", "domain", domain, "error", err)
+		}
+
+		m.mu.Lock()
+		m.certs[domain] = cert
+		m.mu.Unlock()
+
+		m.log.Info(fmt.Sprintf("Obtained certificate for %s", domain))
+	}
+}
+
+func (m *Manager) obtain(ctx context.Context, domain string) (*tls.Certificate, error) {
+	if err := m.register(ctx); err != nil {
+		return nil, err
+	}
+
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range order.AuthzURLs {
+		if err := m.authorize(ctx, domain, u); err != nil {
+			return nil, err
+		}
+	}
+
+	order, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	der, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(der) == 0 {
+		return nil, errors.New("acme: no certificate returned")
+	}
+
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: der,
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func (m *Manager) register(ctx context.Context) error {
+	m.mu.RLock()
+	registered := m.registered
+	m.mu.RUnlock()
+	if registered {
+		return nil
+	}
+
+	acct := &acme.Account{}
+	if m.email != "" {
+		acct.Contact = []string{"mailto:" + m.email}
+	}
+
+	_, err := m.client.Register(ctx, acct, acme.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
+		return err
+	}
+
+	m.mu.Lock()
+	m.registered = true
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *Manager) authorize(ctx context.Context, domain, u string) error {
+	authz, err := m.client.GetAuthorization(ctx, u)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var errs []string
+	for _, typ := range m.challengeTypes() {
+		chal := findChallenge(authz, typ)
+		if chal == nil {
+			continue
+		}
+
+		err := m.fulfill(ctx, domain, authz.URI, chal)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", typ, err))
+	}
+
+	if len(errs) == 0 {
+		return fmt.Errorf("acme: no supported challenge for %s", domain)
+	}
+	return fmt.Errorf("acme: authorization for %s failed: %s", domain, strings.Join(errs, "; "))
+}
+
+func (m *Manager) fulfill(ctx context.Context, domain, authzURL string, chal *acme.Challenge) error {
+	switch chal.Type {
+	case challengeHTTP01:
+		path := m.client.HTTP01ChallengePath(chal.Token)
+		resp, err := m.client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+
+		m.mu.Lock()
+		m.tokens[path] = resp
+		m.mu.Unlock()
+		defer func() {
+			m.mu.Lock()
+			delete(m.tokens, path)
+			m.mu.Unlock()
+		}()
+
+	case challengeTLSALPN01:
+		cert, err := m.client.TLSALPN01ChallengeCert(chal.Token, domain)
+		if err != nil {
+			return err
+		}
+
+		m.mu.Lock()
+		m.alpnCerts[domain] = &cert
+		m.mu.Unlock()
+		defer func() {
+			m.mu.Lock()
+			delete(m.alpnCerts, domain)
+			m.mu.Unlock()
+		}()
+	}
+
+	if _, err := m.client.Accept(ctx, chal); err != nil {
+		return err
+	}
+
+	_, err := m.client.WaitAuthorization(ctx, authzURL)
+	return err
+}
+
+func (m *Manager) challengeTypes() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var types []string
+	if m.tryALPN01 {
+		types = append(types, challengeTLSALPN01)
+	}
+	if m.tryHTTP01 {
+		types = append(types, challengeHTTP01)
+	}
+	return types
+}
+
+func (m *Manager) certFile(domain string) string {
+	return filepath.Join(m.storage, domain+".crt")
+}
+
+func (m *Manager) keyFile(domain string) string {
+	return filepath.Join(m.storage, domain+".key")
+}
+
+func (m *Manager) saveCert(domain string, cert *tls.Certificate) error {
+	var certPEM []byte
+	for _, der := range cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	keyPEM, err := encodeKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(m.keyFile(domain), keyPEM, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(m.certFile(domain), certPEM, 0600)
+}
+
+func findChallenge(authz *acme.Authorization, typ string) *acme.Challenge {
+	for _, chal := range authz.Challenges {
+		if chal.Type == typ {
+			return chal
+		}
+	}
+	return nil
+}
+
+func isALPNChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+func loadCert(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+func loadOrCreateKey(path string) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, errors.New("acme: invalid account key")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err = encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), nil
+}
@@ -0,0 +1,106 @@
+package acme_test
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nrwiersma/proxy/acme"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStorage(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func copyFile(t *testing.T, src, dst string) {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dst, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNew_ErrorsOnNoStorage(t *testing.T) {
+	_, err := acme.New(acme.Opts{})
+
+	assert.Error(t, err)
+}
+
+func TestNew_CreatesAccountKey(t *testing.T) {
+	dir := newTestStorage(t)
+	defer os.RemoveAll(dir)
+
+	_, err := acme.New(acme.Opts{Storage: dir})
+
+	if assert.NoError(t, err) {
+		_, err = os.Stat(filepath.Join(dir, "account.key"))
+		assert.NoError(t, err)
+
+		_, err = acme.New(acme.Opts{Storage: dir})
+		assert.NoError(t, err)
+	}
+}
+
+func TestManager_GetCertificate(t *testing.T) {
+	dir := newTestStorage(t)
+	defer os.RemoveAll(dir)
+	copyFile(t, "../testdata/cert.pem", filepath.Join(dir, "localhost.crt"))
+	copyFile(t, "../testdata/key.pem", filepath.Join(dir, "localhost.key"))
+
+	m, err := acme.New(acme.Opts{Storage: dir, Domains: []string{"LocalHost"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "localhost"})
+	if assert.NoError(t, err) {
+		assert.NotNil(t, got)
+	}
+
+	got, err = m.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	if assert.NoError(t, err) {
+		assert.Nil(t, got)
+	}
+}
+
+func TestManager_GetCertificateErrorsOnUnknownChallenge(t *testing.T) {
+	dir := newTestStorage(t)
+	defer os.RemoveAll(dir)
+
+	m, err := acme.New(acme.Opts{Storage: dir, Domains: []string{"localhost"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:      "localhost",
+		SupportedProtos: []string{"acme-tls/1"},
+	})
+
+	assert.Error(t, err)
+}
+
+func TestManager_ConfigureTLS(t *testing.T) {
+	dir := newTestStorage(t)
+	defer os.RemoveAll(dir)
+
+	m, err := acme.New(acme.Opts{Storage: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{}
+
+	m.ConfigureTLS(config)
+
+	assert.NotNil(t, config.GetCertificate)
+	assert.Equal(t, []string{"http/1.1", "acme-tls/1"}, config.NextProtos)
+}
@@ -0,0 +1,43 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/nrwiersma/proxy/http"
+)
+
+const challengePathPrefix = "/.well-known/acme-challenge/"
+
+// HTTPHandler returns a handler that answers HTTP-01 challenges,
+// passing all other requests to the given handler.
+func (m *Manager) HTTPHandler(h http.Handler) http.Handler {
+	m.mu.Lock()
+	m.tryHTTP01 = true
+	m.mu.Unlock()
+
+	return http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		if !strings.HasPrefix(r.URL.Path, challengePathPrefix) {
+			return h.ServeHTTP(ctx, r)
+		}
+
+		m.mu.RLock()
+		resp, ok := m.tokens[r.URL.Path]
+		m.mu.RUnlock()
+		if !ok {
+			return &http.Response{StatusCode: 404, StatusText: "Not Found"}
+		}
+
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header: http.Header{
+				"Content-Type":   []string{"text/plain"},
+				"Content-Length": []string{strconv.Itoa(len(resp))},
+			},
+			Body: bytes.NewReader([]byte(resp)),
+		}
+	})
+}
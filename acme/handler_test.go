@@ -0,0 +1,57 @@
+package acme_test
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/nrwiersma/proxy/acme"
+	"github.com/nrwiersma/proxy/http"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManager_HTTPHandler(t *testing.T) {
+	dir := newTestStorage(t)
+	defer os.RemoveAll(dir)
+
+	m, err := acme.New(acme.Opts{Storage: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := m.HTTPHandler(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		return &http.Response{StatusCode: 200, StatusText: "OK"}
+	}))
+
+	tests := []struct {
+		name string
+		path string
+		want int
+	}{
+		{
+			name: "Passes Through Requests",
+			path: "/foo/bar",
+			want: 200,
+		},
+		{
+			name: "Unknown Token",
+			path: "/.well-known/acme-challenge/foobar",
+			want: 404,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: tt.path},
+				Header: http.Header{},
+			}
+
+			got := h.ServeHTTP(context.Background(), req)
+
+			assert.Equal(t, tt.want, got.StatusCode)
+		})
+	}
+}
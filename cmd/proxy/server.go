@@ -1,6 +1,9 @@
 package main
 
 import (
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/hamba/cmd"
@@ -26,7 +29,26 @@ func runServer(c *cli.Context) error {
 	}
 	defer svc.Close()
 
+	go func() {
+		for range time.Tick(10 * time.Second) {
+			svc.ReportStats(ctx.Statter())
+		}
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := svc.Reload(); err != nil {
+				log.Error(ctx, "proxy: error reloading proxy", "error", err)
+				continue
+			}
+			log.Info(ctx, "proxy: reloaded")
+		}
+	}()
+
 	<-cmd.WaitForSignals()
+	signal.Stop(hup)
 
 	if err := svc.Shutdown(time.Second); err != nil {
 		log.Error(ctx, "proxy: error shutting down proxy", "error", err)
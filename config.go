@@ -16,6 +16,7 @@ func ParseConfig(r io.Reader) (*Config, error) {
 // Config represents proxy configuration.
 type Config struct {
 	Server      ServiceOpts           `yaml:"server"`
+	ACME        *ACME                 `yaml:"acme"`
 	Entrypoints map[string]Entrypoint `yaml:"entrypoints"`
 	Backends    map[string]Backend    `yaml:"backends"`
 	Routes      map[string]Route      `yaml:"routes"`
@@ -26,15 +26,34 @@ func TestParseConfig(t *testing.T) {
 				IdleTimeout:  time.Second,
 				AccessLog:    true,
 			},
+			ACME: &proxy.ACME{
+				Directory:   "https://localhost:14000/dir",
+				Email:       "admin@proxy.test",
+				Storage:     "./testdata/acme",
+				Domains:     []string{"proxy.test"},
+				RenewBefore: 720 * time.Hour,
+				Insecure:    true,
+			},
 			Entrypoints: map[string]proxy.Entrypoint{
 				"http": {
 					Address: ":8080",
+					ProxyProtocol: &proxy.ProxyProtocol{
+						TrustedIPs: []string{"10.0.0.0/8"},
+					},
+					ForwardedHeaders: &proxy.ForwardedHeaders{
+						TrustedIPs: []string{"10.0.0.0/8"},
+						Pseudonym:  "edge",
+					},
+					RedirectTo: "https",
 				},
 				"https": {
 					Address: ":8443",
 					Certificate: &proxy.Certificate{
-						CertFile: "./testdata/cert.pem",
-						KeyFile:  "./testdata/key.pem",
+						CertFile:   "./testdata/cert.pem",
+						KeyFile:    "./testdata/key.pem",
+						ACME:       true,
+						ClientCA:   "./testdata/cert.pem",
+						ClientAuth: "verifyIfGiven",
 					},
 				},
 			},
@@ -42,6 +61,22 @@ func TestParseConfig(t *testing.T) {
 				"test-server": {
 					Servers: []string{"http://127.0.0.1:9080", "http://127.0.0.1:9081"},
 					Timeout: time.Second,
+					Concurrency: &proxy.Concurrency{
+						MaxInFlight: 100,
+						MaxQueue:    50,
+						MaxWait:     5 * time.Second,
+					},
+				},
+				"secure-server": {
+					Servers: []string{"https://127.0.0.1:9443"},
+					TLS: &proxy.BackendTLS{
+						CAFile:     "./testdata/cert.pem",
+						CertFile:   "./testdata/cert.pem",
+						KeyFile:    "./testdata/key.pem",
+						ServerName: "localhost",
+						MinVersion: "1.2",
+					},
+					ProxyProtocol: 2,
 				},
 			},
 			Routes: map[string]proxy.Route{
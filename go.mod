@@ -3,13 +3,15 @@ module github.com/nrwiersma/proxy
 go 1.12
 
 require (
+	github.com/andybalholm/brotli v1.0.2
 	github.com/hamba/cmd v1.3.0
 	github.com/hamba/pkg v1.2.0
 	github.com/hamba/timex v1.0.0
 	github.com/hashicorp/go-multierror v1.0.0
 	github.com/joho/godotenv v1.3.0
-	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/klauspost/compress v1.9.7
 	github.com/stretchr/testify v1.3.0
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	gopkg.in/urfave/cli.v2 v2.0.0-20190806201727-b62605953717
 	gopkg.in/yaml.v2 v2.2.2
 )
@@ -7,6 +7,11 @@ import (
 	"sort"
 )
 
+// CanonicalHeaderKey returns the canonical format of the header key.
+func CanonicalHeaderKey(s string) string {
+	return textproto.CanonicalMIMEHeaderKey(s)
+}
+
 // Header are HTTP headers.
 type Header map[string][]string
 
@@ -15,6 +20,11 @@ func (h Header) Get(key string) string {
 	return textproto.MIMEHeader(h).Get(key)
 }
 
+// Add adds the key value pair to the header.
+func (h Header) Add(key, value string) {
+	textproto.MIMEHeader(h).Add(key, value)
+}
+
 // Set sets the key value pair on the header.
 func (h Header) Set(key, value string) {
 	textproto.MIMEHeader(h).Set(key, value)
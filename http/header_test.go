@@ -50,6 +50,14 @@ func TestHeader_Get(t *testing.T) {
 	}
 }
 
+func TestHeader_Add(t *testing.T) {
+	h := http.Header{"Foo": []string{"bar"}}
+
+	h.Add("foo", "baz")
+
+	assert.Equal(t, http.Header{"Foo": []string{"bar", "baz"}}, h)
+}
+
 func TestHeader_Set(t *testing.T) {
 	h := http.Header{}
 
@@ -82,3 +90,9 @@ func TestHeader_Write(t *testing.T) {
 		assert.Equal(t, want, buf.String())
 	}
 }
+
+func TestCanonicalHeaderKey(t *testing.T) {
+	got := http.CanonicalHeaderKey("x-forwarded-for")
+
+	assert.Equal(t, "X-Forwarded-For", got)
+}
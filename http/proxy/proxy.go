@@ -5,7 +5,9 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
@@ -16,6 +18,7 @@ import (
 	"time"
 
 	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/http/proxyproto"
 )
 
 var hopByHopHeaders = []string{
@@ -81,10 +84,11 @@ func putTextprotoReader(r *textproto.Reader) {
 
 // ReverseProxy is a proxy handler.
 type ReverseProxy struct {
-	addr    string
-	dialer  func(ctx context.Context, network, addr string) (net.Conn, error)
-	tlsConf *tls.Config
-	timeout time.Duration
+	addr       string
+	dialer     func(ctx context.Context, network, addr string) (net.Conn, error)
+	tlsConf    *tls.Config
+	timeout    time.Duration
+	proxyProto int
 }
 
 // Opts are options to configure the proxy.
@@ -92,6 +96,10 @@ type Opts struct {
 	DialTimeout time.Duration
 
 	Timeout time.Duration
+
+	// ProxyProtocol is the PROXY protocol version sent to the
+	// upstream. If ProxyProtocol is zero, no header is sent.
+	ProxyProtocol int
 }
 
 func (o Opts) dialTimeout() time.Duration {
@@ -114,23 +122,76 @@ func New(addr string, opts Opts) (*ReverseProxy, error) {
 	}).DialContext
 
 	return &ReverseProxy{
-		addr:   tcpAddr.String(),
-		dialer: dialer,
+		addr:       tcpAddr.String(),
+		dialer:     dialer,
+		proxyProto: opts.ProxyProtocol,
 	}, nil
 }
 
-// NewTLS returns a new reverse proxy with TLS support.
-func NewTLS(addr, certFile, keyFile string, opts Opts) (*ReverseProxy, error) {
-	config := &tls.Config{}
-	if certFile != "" && keyFile != "" {
-		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+// TLSOpts are options to configure the TLS connection to the upstream.
+type TLSOpts struct {
+	// CAFile is an optional CA bundle used to verify the upstream.
+	CAFile string
+
+	// CertFile and KeyFile are an optional client certificate
+	// presented to the upstream. Both must be set, or neither.
+	CertFile string
+	KeyFile  string
+
+	// ServerName overrides the server name used for SNI and verification.
+	ServerName string
+
+	// MinVersion is the minimum TLS version.
+	MinVersion uint16
+
+	// InsecureSkipVerify disables verification of the upstream certificate.
+	InsecureSkipVerify bool
+}
+
+func (o TLSOpts) config(addr string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         o.ServerName,
+		MinVersion:         o.MinVersion,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return nil, errors.New("proxy: client certificate requires both a cert file and a key file")
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("proxy: could not load client certificate: %v", err)
 		}
 		config.Certificates = []tls.Certificate{cert}
 	}
-	if host, _, err := net.SplitHostPort(addr); err == nil {
-		config.ServerName = host
+
+	if o.CAFile != "" {
+		b, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: could not read ca file: %v", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.New("proxy: no certificates found in ca file")
+		}
+	}
+
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			config.ServerName = host
+		}
+	}
+
+	return config, nil
+}
+
+// NewTLS returns a new reverse proxy with TLS support.
+func NewTLS(addr string, tlsOpts TLSOpts, opts Opts) (*ReverseProxy, error) {
+	config, err := tlsOpts.config(addr)
+	if err != nil {
+		return nil, err
 	}
 
 	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
@@ -144,9 +205,10 @@ func NewTLS(addr, certFile, keyFile string, opts Opts) (*ReverseProxy, error) {
 	}).DialContext
 
 	return &ReverseProxy{
-		addr:    tcpAddr.String(),
-		dialer:  dialer,
-		tlsConf: config,
+		addr:       tcpAddr.String(),
+		dialer:     dialer,
+		tlsConf:    config,
+		proxyProto: opts.ProxyProtocol,
 	}, nil
 }
 
@@ -158,6 +220,22 @@ func (p *ReverseProxy) ServeHTTP(ctx context.Context, r *http.Request) *http.Res
 	}
 	defer conn.Close()
 
+	// PROXY protocol
+	if p.proxyProto != 0 {
+		// The destination is the address the client connected to,
+		// not the address of the upstream.
+		var src, dst net.Addr
+		if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+			src = addr
+		}
+		if addr, err := net.ResolveTCPAddr("tcp", r.LocalAddr); err == nil {
+			dst = addr
+		}
+		if err = proxyproto.WriteHeader(conn, p.proxyProto, src, dst); err != nil {
+			return &http.Response{StatusCode: 502, StatusText: "Bad Gateway", Error: err}
+		}
+	}
+
 	// TLS
 	if p.tlsConf != nil {
 		tlsConn := tls.Client(conn, p.tlsConf)
@@ -182,7 +260,6 @@ func (p *ReverseProxy) ServeHTTP(ctx context.Context, r *http.Request) *http.Res
 
 	p.removeConnectionHeaders(r.Header)
 	p.removeHopByHopHeaders(r.Header)
-	p.addForwardedHeader(r)
 
 	if reqUp != "" {
 		r.Header.Set("Connection", "Upgrade")
@@ -333,12 +410,3 @@ func (p *ReverseProxy) removeHopByHopHeaders(h http.Header) {
 		h.Del(name)
 	}
 }
-
-func (p *ReverseProxy) addForwardedHeader(r *http.Request) {
-	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-			ip = xff + ", " + ip
-		}
-		r.Header.Set("X-Forward-For", ip)
-	}
-}
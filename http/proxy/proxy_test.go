@@ -0,0 +1,218 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/http/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTLSUpstream(t *testing.T) net.Listener {
+	cert, err := tls.LoadX509KeyPair("../../testdata/cert.pem", "../../testdata/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				br := bufio.NewReader(conn)
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil || line == "\r\n" {
+						break
+					}
+				}
+				_, _ = io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			}(conn)
+		}
+	}()
+
+	return ln
+}
+
+func TestNewTLS_ErrorsOnInvalidCAFile(t *testing.T) {
+	_, err := proxy.NewTLS("127.0.0.1:443", proxy.TLSOpts{CAFile: "../../testdata/srv1.json"}, proxy.Opts{})
+
+	assert.Error(t, err)
+}
+
+func TestNewTLS_ErrorsOnPartialClientCertificate(t *testing.T) {
+	tests := []struct {
+		name string
+		opts proxy.TLSOpts
+	}{
+		{
+			name: "Cert File Only",
+			opts: proxy.TLSOpts{CertFile: "../../testdata/cert.pem"},
+		},
+		{
+			name: "Key File Only",
+			opts: proxy.TLSOpts{KeyFile: "../../testdata/key.pem"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := proxy.NewTLS("127.0.0.1:443", tt.opts, proxy.Opts{})
+
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNewTLS_ErrorsOnMissingFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		opts proxy.TLSOpts
+		want string
+	}{
+		{
+			name: "CA File",
+			opts: proxy.TLSOpts{CAFile: "../../testdata/missing.pem"},
+			want: "could not read ca file",
+		},
+		{
+			name: "Client Certificate",
+			opts: proxy.TLSOpts{CertFile: "../../testdata/missing.pem", KeyFile: "../../testdata/key.pem"},
+			want: "could not load client certificate",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := proxy.NewTLS("127.0.0.1:443", tt.opts, proxy.Opts{})
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.want)
+			assert.Contains(t, err.Error(), "missing.pem")
+		})
+	}
+}
+
+func TestReverseProxy_ServeHTTPTLS(t *testing.T) {
+	ln := newTestTLSUpstream(t)
+	defer ln.Close()
+
+	tests := []struct {
+		name string
+		host string
+		opts proxy.TLSOpts
+		want int
+	}{
+		{
+			name: "Unknown Authority",
+			opts: proxy.TLSOpts{},
+			want: 502,
+		},
+		{
+			name: "Custom CA",
+			opts: proxy.TLSOpts{CAFile: "../../testdata/cert.pem"},
+			want: 200,
+		},
+		{
+			name: "Server Name Mismatch",
+			opts: proxy.TLSOpts{CAFile: "../../testdata/cert.pem", ServerName: "example.com"},
+			want: 502,
+		},
+		{
+			name: "Server Name Override",
+			host: "localhost",
+			opts: proxy.TLSOpts{CAFile: "../../testdata/cert.pem", ServerName: "127.0.0.1"},
+			want: 200,
+		},
+		{
+			name: "Insecure",
+			opts: proxy.TLSOpts{InsecureSkipVerify: true},
+			want: 200,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := ln.Addr().String()
+			if tt.host != "" {
+				_, port, _ := net.SplitHostPort(addr)
+				addr = net.JoinHostPort(tt.host, port)
+			}
+
+			p, err := proxy.NewTLS(addr, tt.opts, proxy.Opts{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := &http.Request{
+				Method:     "GET",
+				URL:        &url.URL{Path: "/test"},
+				Proto:      "HTTP/1.1",
+				Header:     http.Header{},
+				RemoteAddr: "127.0.0.1:1234",
+			}
+
+			got := p.ServeHTTP(context.Background(), req)
+
+			assert.Equal(t, tt.want, got.StatusCode)
+		})
+	}
+}
+
+func TestReverseProxy_ServeHTTPWritesProxyProtocolHeader(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	header := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		br := bufio.NewReader(conn)
+		line, _ := br.ReadString('\n')
+		header <- line
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	}()
+
+	p, err := proxy.New(ln.Addr().String(), proxy.Opts{ProxyProtocol: 1})
+	require.NoError(t, err)
+
+	resp := p.ServeHTTP(context.Background(), &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: "/test"},
+		Proto:      "HTTP/1.1",
+		Header:     http.Header{},
+		RemoteAddr: "192.168.0.1:1234",
+		LocalAddr:  "10.0.0.1:443",
+	})
+
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "PROXY TCP4 192.168.0.1 10.0.0.1 1234 443\r\n", <-header)
+}
@@ -0,0 +1,338 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	sigV1 = []byte("PROXY ")
+	sigV2 = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+)
+
+const (
+	maxV1Len = 107
+
+	cmdLocal = 0x20
+	cmdProxy = 0x21
+
+	famUnspec = 0x00
+	famTCP4   = 0x11
+	famTCP6   = 0x21
+)
+
+// ErrInvalidHeader is returned when a PROXY protocol header is malformed.
+var ErrInvalidHeader = errors.New("proxyproto: invalid header")
+
+// Listener is a listener that parses PROXY protocol headers
+// on connections from trusted sources.
+type Listener struct {
+	net.Listener
+
+	trusted []*net.IPNet
+}
+
+// NewListener returns a PROXY protocol listener. Headers are only parsed
+// on connections from the trusted networks. If trusted is nil, all
+// sources are trusted.
+func NewListener(ln net.Listener, trusted []*net.IPNet) *Listener {
+	return &Listener{
+		Listener: ln,
+		trusted:  trusted,
+	}
+}
+
+// Accept waits for and returns the next connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	return &Conn{
+		Conn: conn,
+		bufr: bufio.NewReader(conn),
+	}, nil
+}
+
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	if l.trusted == nil {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, n := range l.trusted {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection that may start with a PROXY protocol header.
+//
+// The header is read lazily on the first Read or address lookup.
+type Conn struct {
+	net.Conn
+
+	bufr *bufio.Reader
+
+	once sync.Once
+	err  error
+	src  net.Addr
+	dst  net.Addr
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		c.src, c.dst, c.err = ReadHeader(c.bufr)
+	})
+}
+
+// Read reads data from the connection.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.bufr.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY header,
+// or the connection remote address if there is none.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.src != nil {
+		return c.src
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address from the PROXY header,
+// or the connection local address if there is none.
+func (c *Conn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.dst != nil {
+		return c.dst
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+// ReadHeader reads a PROXY protocol v1 or v2 header from the reader.
+//
+// If the reader does not start with a header, nothing is consumed
+// and nil addresses are returned. Nil addresses are also returned
+// for UNKNOWN and LOCAL headers.
+func ReadHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	switch b[0] {
+	case sigV1[0]:
+		b, err = r.Peek(len(sigV1))
+		if err != nil || !bytes.Equal(b, sigV1) {
+			return nil, nil, nil
+		}
+		return readV1(r)
+
+	case sigV2[0]:
+		b, err = r.Peek(len(sigV2))
+		if err != nil || !bytes.Equal(b, sigV2) {
+			return nil, nil, nil
+		}
+		return readV2(r)
+
+	default:
+		return nil, nil, nil
+	}
+}
+
+// readV1 reads a header like "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n".
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < maxV1Len {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	src, err := parseV1Addr(parts[2], parts[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseV1Addr(parts[3], parts[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return src, dst, nil
+}
+
+func parseV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, ErrInvalidHeader
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+	addr.Port = int(p)
+
+	return addr, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+
+	cmd := hdr[12]
+	fam := hdr[13]
+	n := binary.BigEndian.Uint16(hdr[14:16])
+
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	switch cmd {
+	case cmdLocal:
+		return nil, nil, nil
+
+	case cmdProxy:
+
+	default:
+		return nil, nil, ErrInvalidHeader
+	}
+
+	switch fam {
+	case famTCP4:
+		if len(body) < 12 {
+			return nil, nil, ErrInvalidHeader
+		}
+		src := &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+		dst := &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+		return src, dst, nil
+
+	case famTCP6:
+		if len(body) < 36 {
+			return nil, nil, ErrInvalidHeader
+		}
+		src := &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+		dst := &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+		return src, dst, nil
+
+	default:
+		// Unsupported families are treated as unknown.
+		return nil, nil, nil
+	}
+}
+
+// WriteHeader writes a PROXY protocol header of the given version.
+//
+// If either address is not a TCP address, an UNKNOWN (v1) or
+// LOCAL (v2) header is written.
+func WriteHeader(w io.Writer, version int, src, dst net.Addr) error {
+	srcAddr, srcOK := src.(*net.TCPAddr)
+	dstAddr, dstOK := dst.(*net.TCPAddr)
+	known := srcOK && dstOK
+
+	ipv4 := known && srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil
+
+	switch version {
+	case 1:
+		if !known {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+
+		proto := "TCP6"
+		srcIP, dstIP := formatIPv6(srcAddr.IP), formatIPv6(dstAddr.IP)
+		if ipv4 {
+			proto = "TCP4"
+			srcIP, dstIP = srcAddr.IP.To4().String(), dstAddr.IP.To4().String()
+		}
+
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, srcAddr.Port, dstAddr.Port)
+		return err
+
+	case 2:
+		buf := bytes.NewBuffer(make([]byte, 0, 52))
+		buf.Write(sigV2)
+
+		if !known {
+			buf.Write([]byte{cmdLocal, famUnspec, 0, 0})
+			_, err := w.Write(buf.Bytes())
+			return err
+		}
+
+		if ipv4 {
+			buf.Write([]byte{cmdProxy, famTCP4, 0, 12})
+			buf.Write(srcAddr.IP.To4())
+			buf.Write(dstAddr.IP.To4())
+		} else {
+			buf.Write([]byte{cmdProxy, famTCP6, 0, 36})
+			buf.Write(srcAddr.IP.To16())
+			buf.Write(dstAddr.IP.To16())
+		}
+		_ = binary.Write(buf, binary.BigEndian, uint16(srcAddr.Port))
+		_ = binary.Write(buf, binary.BigEndian, uint16(dstAddr.Port))
+
+		_, err := w.Write(buf.Bytes())
+		return err
+
+	default:
+		return fmt.Errorf("proxyproto: unknown version %d", version)
+	}
+}
+
+// formatIPv6 formats the ip in IPv6 notation, even for IPv4 addresses.
+func formatIPv6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
@@ -0,0 +1,253 @@
+package proxyproto_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/nrwiersma/proxy/http/proxyproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		wantSrc  string
+		wantDst  string
+		wantRest string
+		wantErr  bool
+	}{
+		{
+			name:     "No Header",
+			data:     "GET / HTTP/1.1\r\n",
+			wantRest: "GET / HTTP/1.1\r\n",
+		},
+		{
+			name:     "V1 TCP4",
+			data:     "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET / HTTP/1.1\r\n",
+			wantSrc:  "192.168.0.1:56324",
+			wantDst:  "192.168.0.11:443",
+			wantRest: "GET / HTTP/1.1\r\n",
+		},
+		{
+			name:     "V1 TCP6",
+			data:     "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nGET / HTTP/1.1\r\n",
+			wantSrc:  "[2001:db8::1]:56324",
+			wantDst:  "[2001:db8::2]:443",
+			wantRest: "GET / HTTP/1.1\r\n",
+		},
+		{
+			name:     "V1 Unknown",
+			data:     "PROXY UNKNOWN\r\nGET / HTTP/1.1\r\n",
+			wantRest: "GET / HTTP/1.1\r\n",
+		},
+		{
+			name:    "V1 Invalid",
+			data:    "PROXY TCP4 foo bar 1 2\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "V1 Too Long",
+			data:    "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n",
+			wantErr: true,
+		},
+		{
+			name:     "V2 TCP4",
+			data:     "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c\xc0\xa8\x00\x01\xc0\xa8\x00\x0b\xdc\x04\x01\xbbGET / HTTP/1.1\r\n",
+			wantSrc:  "192.168.0.1:56324",
+			wantDst:  "192.168.0.11:443",
+			wantRest: "GET / HTTP/1.1\r\n",
+		},
+		{
+			name:     "V2 Local",
+			data:     "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00GET / HTTP/1.1\r\n",
+			wantRest: "GET / HTTP/1.1\r\n",
+		},
+		{
+			name:    "V2 Invalid Command",
+			data:    "\r\n\r\n\x00\r\nQUIT\n\x2f\x11\x00\x00",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.data))
+
+			src, dst, err := proxyproto.ReadHeader(r)
+
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assertAddr(t, tt.wantSrc, src)
+				assertAddr(t, tt.wantDst, dst)
+
+				rest, _ := ioutil.ReadAll(r)
+				assert.Equal(t, tt.wantRest, string(rest))
+			}
+		})
+	}
+}
+
+func assertAddr(t *testing.T, want string, got net.Addr) {
+	if want == "" {
+		assert.Nil(t, got)
+		return
+	}
+	if assert.NotNil(t, got) {
+		assert.Equal(t, want, got.String())
+	}
+}
+
+func TestWriteHeader(t *testing.T) {
+	v4Src := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}
+	v4Dst := &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 443}
+	v6Src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+
+	tests := []struct {
+		name    string
+		version int
+		src     net.Addr
+		dst     net.Addr
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "V1 TCP4",
+			version: 1,
+			src:     v4Src,
+			dst:     v4Dst,
+			want:    "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n",
+		},
+		{
+			name:    "V1 Mixed Families",
+			version: 1,
+			src:     v6Src,
+			dst:     v4Dst,
+			want:    "PROXY TCP6 2001:db8::1 ::ffff:192.168.0.11 56324 443\r\n",
+		},
+		{
+			name:    "V1 Unknown",
+			version: 1,
+			src:     nil,
+			dst:     v4Dst,
+			want:    "PROXY UNKNOWN\r\n",
+		},
+		{
+			name:    "V2 TCP4",
+			version: 2,
+			src:     v4Src,
+			dst:     v4Dst,
+			want:    "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c\xc0\xa8\x00\x01\xc0\xa8\x00\x0b\xdc\x04\x01\xbb",
+		},
+		{
+			name:    "V2 Local",
+			version: 2,
+			src:     nil,
+			dst:     nil,
+			want:    "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00",
+		},
+		{
+			name:    "Unknown Version",
+			version: 3,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bytes.NewBuffer(nil)
+
+			err := proxyproto.WriteHeader(buf, tt.version, tt.src, tt.dst)
+
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, buf.String())
+			}
+		})
+	}
+}
+
+func TestWriteHeader_RoundTripsV2TCP6(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	buf := bytes.NewBuffer(nil)
+
+	err := proxyproto.WriteHeader(buf, 2, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotSrc, gotDst, err := proxyproto.ReadHeader(bufio.NewReader(buf))
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, src.String(), gotSrc.String())
+		assert.Equal(t, dst.String(), gotDst.String())
+	}
+}
+
+func TestListener(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, other, _ := net.ParseCIDR("10.0.0.0/8")
+
+	tests := []struct {
+		name    string
+		trusted []*net.IPNet
+		want    string
+	}{
+		{
+			name:    "Trusted",
+			trusted: []*net.IPNet{loopback},
+			want:    "192.168.0.1:56324",
+		},
+		{
+			name:    "Trust All",
+			trusted: nil,
+			want:    "192.168.0.1:56324",
+		},
+		{
+			name:    "Untrusted",
+			trusted: []*net.IPNet{other},
+			want:    "127.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			pln := proxyproto.NewListener(ln, tt.trusted)
+			defer pln.Close()
+
+			go func() {
+				conn, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				_, _ = io.WriteString(conn, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n")
+			}()
+
+			conn, err := pln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			assert.Contains(t, conn.RemoteAddr().String(), tt.want)
+		})
+	}
+}
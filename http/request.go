@@ -4,6 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -41,12 +45,35 @@ type Request struct {
 	// RemoteAddr is the remote address of the request.
 	RemoteAddr string
 
+	// LocalAddr is the local address the request was received on.
+	LocalAddr string
+
 	// Close indicates that the request wants to close the connection.
 	Close bool
 
+	// TLS is the TLS connection state of the request. This
+	// is nil if the request was not received over TLS.
+	TLS *tls.ConnectionState
+
 	ctx context.Context
 }
 
+// ClientCertificate returns the verified client certificate of
+// the request, or nil if there is none.
+func (r *Request) ClientCertificate() *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// Fingerprint returns the hex encoded SHA-256 fingerprint of the certificate.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
 // Write writes the request to a writer.
 func (r *Request) Write(w io.Writer) error {
 	uri := r.URL.RequestURI()
@@ -2,6 +2,10 @@ package http_test
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
 	"net/url"
 	"testing"
 
@@ -63,3 +67,55 @@ func TestRequest_WriteNoBody(t *testing.T) {
 		assert.Equal(t, want, buf.String())
 	}
 }
+
+func TestRequest_ClientCertificate(t *testing.T) {
+	b, err := ioutil.ReadFile("../testdata/cert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		state *tls.ConnectionState
+		want  *x509.Certificate
+	}{
+		{
+			name:  "No TLS",
+			state: nil,
+			want:  nil,
+		},
+		{
+			name:  "Unverified",
+			state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+			want:  nil,
+		},
+		{
+			name:  "Verified",
+			state: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			want:  cert,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{TLS: tt.state}
+
+			got := req.ClientCertificate()
+
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	cert := &x509.Certificate{Raw: []byte("test")}
+
+	got := http.Fingerprint(cert)
+
+	assert.Equal(t, "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", got)
+}
@@ -3,6 +3,7 @@ package http
 import (
 	"fmt"
 	"io"
+	"strings"
 )
 
 // Response is an HTTP response.
@@ -19,7 +20,8 @@ type Response struct {
 	// Header contains the response headers.
 	Header Header
 
-	// Body is the response body.
+	// Body is the response body. If the body is an io.Closer,
+	// it is closed once the response is written.
 	Body io.Reader
 
 	// Close indicates that the response want to close the connection.
@@ -36,16 +38,7 @@ func (r *Response) Write(w io.Writer) error {
 		r.Proto = "HTTP/1.1"
 	}
 
-	if len(r.Header) == 0 {
-		r.Header = Header{
-			"Content-Type": []string{"text/plain; charset=utf-8"},
-			"Connection":   []string{"close"},
-		}
-
-		if r.Body == nil {
-			r.Header.Set("Content-Length", "0")
-		}
-	}
+	r.EnsureHeader()
 
 	// Status Line
 	_, err := fmt.Fprintf(w, "%s %d %s\r\n", r.Proto, r.StatusCode, r.StatusText)
@@ -64,6 +57,18 @@ func (r *Response) Write(w io.Writer) error {
 
 	// Body
 	if r.Body != nil {
+		if c, ok := r.Body.(io.Closer); ok {
+			defer c.Close()
+		}
+
+		if r.isChunked() {
+			cw := &chunkedWriter{w: w}
+			if _, err := io.Copy(cw, r.Body); err != nil {
+				return err
+			}
+			return cw.Close()
+		}
+
 		if _, err := io.Copy(w, r.Body); err != nil {
 			return err
 		}
@@ -71,3 +76,52 @@ func (r *Response) Write(w io.Writer) error {
 
 	return nil
 }
+
+// EnsureHeader gives a response without headers the default headers
+// it is written with. Handlers adding headers to a response they did
+// not create should call this first, so the response stays framed.
+func (r *Response) EnsureHeader() {
+	if len(r.Header) > 0 {
+		return
+	}
+
+	r.Header = Header{
+		"Content-Type": []string{"text/plain; charset=utf-8"},
+		"Connection":   []string{"close"},
+	}
+	if r.Body == nil {
+		r.Header.Set("Content-Length", "0")
+	}
+}
+
+func (r *Response) isChunked() bool {
+	return strings.EqualFold(r.Header.Get("Transfer-Encoding"), "chunked")
+}
+
+// chunkedWriter writes data in the chunked transfer encoding.
+type chunkedWriter struct {
+	w io.Writer
+}
+
+// Write writes the data as a single chunk.
+func (cw *chunkedWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	if _, err := fmt.Fprintf(cw.w, "%x\r\n", len(b)); err != nil {
+		return 0, err
+	}
+	n, err := cw.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	_, err = io.WriteString(cw.w, "\r\n")
+	return n, err
+}
+
+// Close writes the last chunk.
+func (cw *chunkedWriter) Close() error {
+	_, err := io.WriteString(cw.w, "0\r\n\r\n")
+	return err
+}
@@ -2,6 +2,7 @@ package http_test
 
 import (
 	"bytes"
+	"io"
 	"testing"
 
 	"github.com/nrwiersma/proxy/http"
@@ -51,3 +52,90 @@ func TestResponse_WriteNoBody(t *testing.T) {
 		assert.Equal(t, want, buf.String())
 	}
 }
+
+func TestResponse_WriteChunked(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: 200,
+		StatusText: "OK",
+		Proto:      "HTTP/1.1",
+		Header: http.Header{
+			"Transfer-Encoding": []string{"chunked"},
+		},
+		Body: bytes.NewReader([]byte("test")),
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err := resp.Write(buf)
+
+	if assert.NoError(t, err) {
+		want := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n4\r\ntest\r\n0\r\n\r\n"
+		assert.Equal(t, want, buf.String())
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestResponse_WriteClosesBody(t *testing.T) {
+	body := &closeRecorder{Reader: bytes.NewReader([]byte("test"))}
+	resp := &http.Response{
+		StatusCode: 200,
+		StatusText: "OK",
+		Proto:      "HTTP/1.1",
+		Header: http.Header{
+			"Content-Length": []string{"4"},
+		},
+		Body: body,
+	}
+
+	err := resp.Write(bytes.NewBuffer(nil))
+
+	assert.NoError(t, err)
+	assert.True(t, body.closed)
+}
+
+func TestResponse_EnsureHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		resp *http.Response
+		want http.Header
+	}{
+		{
+			name: "No Header",
+			resp: &http.Response{StatusCode: 404, StatusText: "Not Found"},
+			want: http.Header{
+				"Content-Type":   []string{"text/plain; charset=utf-8"},
+				"Connection":     []string{"close"},
+				"Content-Length": []string{"0"},
+			},
+		},
+		{
+			name: "No Header With Body",
+			resp: &http.Response{StatusCode: 200, StatusText: "OK", Body: bytes.NewReader([]byte("test"))},
+			want: http.Header{
+				"Content-Type": []string{"text/plain; charset=utf-8"},
+				"Connection":   []string{"close"},
+			},
+		},
+		{
+			name: "Existing Header",
+			resp: &http.Response{StatusCode: 200, StatusText: "OK", Header: http.Header{"Content-Length": []string{"4"}}},
+			want: http.Header{"Content-Length": []string{"4"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.resp.EnsureHeader()
+
+			assert.Equal(t, tt.want, tt.resp.Header)
+		})
+	}
+}
@@ -149,13 +149,19 @@ func (c *conn) serve(ctx context.Context) {
 		}
 		c.tlsState = &tls.ConnectionState{}
 		*c.tlsState = tlsConn.ConnectionState()
+
+		// Connections negotiating a protocol other than HTTP/1.x, like
+		// ACME TLS-ALPN-01 challenges, are done after the handshake.
+		if proto := c.tlsState.NegotiatedProtocol; proto != "" && proto != "http/1.1" {
+			return
+		}
 	}
 
 	ctx, cancelCtx := context.WithCancel(ctx)
 	defer cancelCtx()
 
+	// The reader is returned to the pool when the connection is closed.
 	c.bufr = newBufioReader(c.rwc)
-	defer putBufioReader(c.bufr)
 	c.bufw = newBufioWriter(c.rwc)
 	defer putBufioWriter(c.bufw)
 
@@ -218,6 +224,8 @@ func (c *conn) readRequest(ctx context.Context) (*Request, error) {
 
 	req.ctx = ctx
 	req.RemoteAddr = c.rwc.RemoteAddr().String()
+	req.LocalAddr = c.rwc.LocalAddr().String()
+	req.TLS = c.tlsState
 
 	return req, nil
 }
@@ -242,6 +250,9 @@ type Opts struct {
 	// If IdleTimeout is zero, the value of ReadTimeout is used.
 	IdleTimeout time.Duration
 
+	// TLSConfig is an optional TLS configuration used by ListenAndServeTLS.
+	TLSConfig *tls.Config
+
 	// Log is an optional logger.
 	Log log.Logger
 }
@@ -252,6 +263,7 @@ type Server struct {
 	readTimeout  time.Duration
 	writeTimeout time.Duration
 	idleTimeout  time.Duration
+	tlsConfig    *tls.Config
 	log          log.Logger
 
 	inShutdown atomicBool
@@ -277,6 +289,7 @@ func NewServer(h Handler, opts Opts) (*Server, error) {
 		readTimeout:  opts.ReadTimeout,
 		writeTimeout: opts.WriteTimeout,
 		idleTimeout:  idleTimeout,
+		tlsConfig:    opts.TLSConfig,
 		log:          opts.Log,
 		listeners:    map[*net.Listener]struct{}{},
 		activeConn:   map[*conn]struct{}{},
@@ -425,23 +438,43 @@ func (s *Server) ListenAndServe(addr string) error {
 }
 
 // ListenAndServeTLS listens to the given address with TLS and calls Serve.
+//
+// The certificate and key files may be omitted if the configured
+// TLS config already provides certificates.
 func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
 	if s.inShutdown.isSet() {
 		return ErrServerClosed
 	}
 
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
-	config := &tls.Config{Certificates: []tls.Certificate{cert}}
 
-	ln, err := tls.Listen("tcp", addr, config)
-	if err != nil {
-		return err
+	return s.ServeTLS(ln, certFile, keyFile)
+}
+
+// ServeTLS serves TLS connections on the given listener.
+//
+// The certificate and key files may be omitted if the configured
+// TLS config already provides certificates.
+func (s *Server) ServeTLS(ln net.Listener, certFile, keyFile string) error {
+	config := &tls.Config{}
+	if s.tlsConfig != nil {
+		config = s.tlsConfig.Clone()
 	}
 
-	return s.Serve(ln)
+	hasCert := len(config.Certificates) > 0 || config.GetCertificate != nil
+	if !hasCert || certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			_ = ln.Close()
+			return err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+
+	return s.Serve(tls.NewListener(ln, config))
 }
 
 var shutdownPollInterval = 100 * time.Millisecond
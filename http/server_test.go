@@ -162,6 +162,62 @@ func TestServer_ServesTLS(t *testing.T) {
 	}
 }
 
+func TestServer_ServesHTTP11Protocol(t *testing.T) {
+	addr, tlsConfig, srv := newTestTLSServer(t, pingHandler{}, http.Opts{
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+		IdleTimeout:  time.Second,
+	})
+	defer srv.Close()
+
+	tlsConfig.NextProtos = []string{"http/1.1", "acme-tls/1"}
+	clientConfig := tlsConfig.Clone()
+	clientConfig.NextProtos = []string{"h2", "http/1.1"}
+	conn, err := tls.Dial("tcp", addr.String(), clientConfig)
+	if err != nil {
+		t.Fatal("dial error", err)
+	}
+	defer conn.Close()
+
+	assert.Equal(t, "http/1.1", conn.ConnectionState().NegotiatedProtocol)
+
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n"); err != nil {
+		t.Fatal("write error", err)
+	}
+
+	pong := make([]byte, 1024)
+	n, err := conn.Read(pong)
+	if err != nil {
+		t.Fatal("read error", err)
+	}
+
+	want := []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	assert.Equal(t, want, pong[:n])
+}
+
+func TestServer_ClosesNonHTTPProtocols(t *testing.T) {
+	addr, tlsConfig, srv := newTestTLSServer(t, pingHandler{}, http.Opts{
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+		IdleTimeout:  time.Second,
+	})
+	defer srv.Close()
+
+	tlsConfig.NextProtos = []string{"acme-tls/1"}
+	conn, err := tls.Dial("tcp", addr.String(), tlsConfig)
+	if err != nil {
+		t.Fatal("dial error", err)
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n"); err != nil {
+		t.Fatal("write error", err)
+	}
+
+	b, _ := ioutil.ReadAll(conn)
+	assert.Len(t, b, 0)
+}
+
 func TestServer_Shutdown(t *testing.T) {
 	addr, srv := newTestServer(t, pingHandler{}, http.Opts{
 		ReadTimeout:  time.Second,
@@ -177,7 +233,7 @@ func TestServer_Shutdown(t *testing.T) {
 
 	go func() {
 		if err := srv.Shutdown(context.Background()); err != nil {
-			t.Fatal("shutdown error", err)
+			t.Error("shutdown error", err)
 		}
 	}()
 
@@ -0,0 +1,215 @@
+package crypt
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+const (
+	roundsDefault = 5000
+	roundsMin     = 1000
+	roundsMax     = 999999999
+	saltMaxLen    = 16
+
+	itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+var (
+	sha256Perm = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	sha512Perm = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+)
+
+// ErrInvalidHash is returned when a hash cannot be parsed.
+var ErrInvalidHash = errors.New("crypt: invalid hash")
+
+// IsSHA determines if the hash is a SHA-256 ("$5$") or SHA-512 ("$6$") crypt hash.
+func IsSHA(hash string) bool {
+	return strings.HasPrefix(hash, "$5$") || strings.HasPrefix(hash, "$6$")
+}
+
+// CompareSHA compares a SHA-256 or SHA-512 crypt hash with a password.
+func CompareSHA(hashed, password string) error {
+	got, err := SHA(password, hashed)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(got), []byte(hashed)) != 1 {
+		return errors.New("crypt: hash does not match password")
+	}
+	return nil
+}
+
+// SHA returns the SHA-256 or SHA-512 crypt hash of the password, using
+// the algorithm, rounds and salt of the given setting, ie "$5$rounds=10000$salt".
+func SHA(password, setting string) (string, error) {
+	var newHash func() hash.Hash
+	var perm [][3]int
+	var prefix string
+	switch {
+	case strings.HasPrefix(setting, "$5$"):
+		newHash, perm, prefix = sha256.New, sha256Perm, "$5$"
+	case strings.HasPrefix(setting, "$6$"):
+		newHash, perm, prefix = sha512.New, sha512Perm, "$6$"
+	default:
+		return "", ErrInvalidHash
+	}
+
+	rest := setting[len(prefix):]
+	rounds := roundsDefault
+	customRounds := false
+	if strings.HasPrefix(rest, "rounds=") {
+		i := strings.IndexByte(rest, '$')
+		if i == -1 {
+			return "", ErrInvalidHash
+		}
+		r, err := strconv.Atoi(rest[len("rounds="):i])
+		if err != nil {
+			return "", ErrInvalidHash
+		}
+		rounds, customRounds = clampRounds(r), true
+		rest = rest[i+1:]
+	}
+
+	salt := rest
+	if i := strings.IndexByte(salt, '$'); i != -1 {
+		salt = salt[:i]
+	}
+	if len(salt) > saltMaxLen {
+		salt = salt[:saltMaxLen]
+	}
+
+	sum := shaCrypt(newHash, []byte(password), []byte(salt), rounds)
+
+	var b strings.Builder
+	b.WriteString(prefix)
+	if customRounds {
+		b.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	b.WriteString(salt)
+	b.WriteByte('$')
+	for _, p := range perm {
+		encode24(&b, sum[p[0]], sum[p[1]], sum[p[2]], 4)
+	}
+	if len(sum) == sha256.Size {
+		encode24(&b, 0, sum[31], sum[30], 3)
+	} else {
+		encode24(&b, 0, 0, sum[63], 2)
+	}
+
+	return b.String(), nil
+}
+
+func clampRounds(r int) int {
+	if r < roundsMin {
+		return roundsMin
+	}
+	if r > roundsMax {
+		return roundsMax
+	}
+	return r
+}
+
+func shaCrypt(newHash func() hash.Hash, password, salt []byte, rounds int) []byte {
+	h := newHash()
+	size := h.Size()
+
+	// Digest B
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	digestB := h.Sum(nil)
+
+	// Digest A
+	h.Reset()
+	h.Write(password)
+	h.Write(salt)
+	writeRepeated(h, digestB, len(password))
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write(digestB)
+		} else {
+			h.Write(password)
+		}
+	}
+	digestA := h.Sum(nil)
+
+	// Sequence P
+	h.Reset()
+	for i := 0; i < len(password); i++ {
+		h.Write(password)
+	}
+	p := repeat(h.Sum(nil), len(password))
+
+	// Sequence S
+	h.Reset()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		h.Write(salt)
+	}
+	s := repeat(h.Sum(nil), len(salt))
+
+	sum := digestA
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(sum[:size])
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(sum[:size])
+		} else {
+			h.Write(p)
+		}
+		sum = h.Sum(sum[:0])
+	}
+
+	return sum
+}
+
+func writeRepeated(h hash.Hash, b []byte, n int) {
+	for ; n > len(b); n -= len(b) {
+		h.Write(b)
+	}
+	h.Write(b[:n])
+}
+
+func repeat(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		rem := n - len(out)
+		if rem > len(b) {
+			rem = len(b)
+		}
+		out = append(out, b[:rem]...)
+	}
+	return out
+}
+
+func encode24(b *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for i := 0; i < n; i++ {
+		b.WriteByte(itoa64[w&0x3f])
+		w >>= 6
+	}
+}
@@ -0,0 +1,65 @@
+package crypt_test
+
+import (
+	"testing"
+
+	"github.com/nrwiersma/proxy/internal/crypt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSHA(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		setting  string
+		want     string
+	}{
+		{
+			name:     "SHA-256",
+			password: "Hello world!",
+			setting:  "$5$saltstring",
+			want:     "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+		},
+		{
+			name:     "SHA-512",
+			password: "Hello world!",
+			setting:  "$6$saltstring",
+			want:     "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		},
+		{
+			name:     "SHA-512 With Rounds",
+			password: "Hello world!",
+			setting:  "$6$rounds=10000$saltstringsaltstring",
+			want:     "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := crypt.SHA(tt.password, tt.setting)
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSHA_ErrorsOnInvalidSetting(t *testing.T) {
+	_, err := crypt.SHA("test", "$1$salt")
+
+	assert.Equal(t, crypt.ErrInvalidHash, err)
+}
+
+func TestCompareSHA(t *testing.T) {
+	hash := "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"
+
+	assert.NoError(t, crypt.CompareSHA(hash, "Hello world!"))
+	assert.Error(t, crypt.CompareSHA(hash, "Hello world"))
+}
+
+func TestIsSHA(t *testing.T) {
+	assert.True(t, crypt.IsSHA("$5$salt$hash"))
+	assert.True(t, crypt.IsSHA("$6$salt$hash"))
+	assert.False(t, crypt.IsSHA("$2y$10$hash"))
+}
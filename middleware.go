@@ -2,23 +2,33 @@ package proxy
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/nrwiersma/proxy/http"
 	"github.com/nrwiersma/proxy/middleware"
 )
 
-func createMiddleware(cfg []map[string]interface{}, h http.Handler) (http.Handler, error) {
+func (s *Service) createMiddleware(route string, cfg []map[string]interface{}, h http.Handler) (http.Handler, error) {
 	var err error
 
 	for _, c := range cfg {
 		typ := c["type"]
 		switch typ {
 		case "cache":
-			h, err = createCacheMiddleware(c, h)
+			var cache *middleware.Cache
+			cache, err = createCacheMiddleware(c, h)
 			if err != nil {
 				return nil, err
 			}
+			s.mu.Lock()
+			s.caches[route] = append(s.caches[route], cache)
+			s.mu.Unlock()
+			h = cache
 
 		case "location":
 			h, err = createLocationMiddleware(c, h)
@@ -26,6 +36,95 @@ func createMiddleware(cfg []map[string]interface{}, h http.Handler) (http.Handle
 				return nil, err
 			}
 
+		case "clientCert":
+			h, err = createClientCertMiddleware(c, h)
+			if err != nil {
+				return nil, err
+			}
+
+		case "rewrite":
+			h, err = createRewriteMiddleware(c, h)
+			if err != nil {
+				return nil, err
+			}
+
+		case "redirect":
+			h, err = createRedirectMiddleware(c, h)
+			if err != nil {
+				return nil, err
+			}
+
+		case "basicAuth":
+			h, err = createBasicAuthMiddleware(c, h)
+			if err != nil {
+				return nil, err
+			}
+
+		case "apiKey":
+			h, err = createAPIKeyMiddleware(c, h)
+			if err != nil {
+				return nil, err
+			}
+
+		case "jwt":
+			h, err = createJWTMiddleware(c, h)
+			if err != nil {
+				return nil, err
+			}
+
+		case "oidc":
+			h, err = createOIDCMiddleware(c, h)
+			if err != nil {
+				return nil, err
+			}
+
+		case "forwardAuth":
+			h, err = createForwardAuthMiddleware(c, h, s.bkends)
+			if err != nil {
+				return nil, err
+			}
+
+		case "rateLimit":
+			h, err = createRateLimitMiddleware(route, c, h)
+			if err != nil {
+				return nil, err
+			}
+
+		case "concurrencyLimit":
+			h, err = createConcurrencyLimitMiddleware(c, h)
+			if err != nil {
+				return nil, err
+			}
+
+		case "ipFilter":
+			var f *middleware.IPFilter
+			f, err = createIPFilterMiddleware(c, h)
+			if err != nil {
+				return nil, err
+			}
+			s.mu.Lock()
+			s.rlds = append(s.rlds, f)
+			s.mu.Unlock()
+			h = f
+
+		case "cors":
+			h, err = createCORSMiddleware(c, h)
+			if err != nil {
+				return nil, err
+			}
+
+		case "compress":
+			h, err = createCompressMiddleware(c, h)
+			if err != nil {
+				return nil, err
+			}
+
+		case "headers":
+			h, err = createHeadersMiddleware(route, c, h)
+			if err != nil {
+				return nil, err
+			}
+
 		default:
 			return nil, fmt.Errorf("proxy: unknown middleware %s", typ)
 		}
@@ -35,7 +134,7 @@ func createMiddleware(cfg []map[string]interface{}, h http.Handler) (http.Handle
 	return h, nil
 }
 
-func createCacheMiddleware(cfg map[string]interface{}, h http.Handler) (http.Handler, error) {
+func createCacheMiddleware(cfg map[string]interface{}, h http.Handler) (*middleware.Cache, error) {
 	expiry, err := parseDuration(cfg, "expiry")
 	if err != nil {
 		return nil, err
@@ -44,18 +143,144 @@ func createCacheMiddleware(cfg map[string]interface{}, h http.Handler) (http.Han
 	if err != nil {
 		return nil, err
 	}
+	staleTTL, err := parseDuration(cfg, "staleTTL")
+	if err != nil {
+		return nil, err
+	}
+	coalesceTimeout, err := parseDuration(cfg, "coalesceTimeout")
+	if err != nil {
+		return nil, err
+	}
+	maxBytes, err := parseSize(cfg, "maxSize")
+	if err != nil {
+		return nil, err
+	}
+	maxObjectSize, err := parseSize(cfg, "maxObjectSize")
+	if err != nil {
+		return nil, err
+	}
+	policy, err := parseString(cfg, "eviction")
+	if err != nil {
+		return nil, err
+	}
+	switch policy {
+	case "", middleware.EvictLRU, middleware.EvictLFU:
+	default:
+		return nil, fmt.Errorf("proxy: invalid cache eviction policy %q", policy)
+	}
 	ignore, err := parseBool(cfg, "ignoreHeaders")
 	if err != nil {
 		return nil, err
 	}
 
+	storeType, err := parseString(cfg, "store")
+	if err != nil {
+		return nil, err
+	}
+
+	var store middleware.CacheStore
+	switch storeType {
+	case "", "memory":
+		store = middleware.NewMemoryStore(middleware.MemoryStoreOpts{
+			MaxBytes: maxBytes,
+			Policy:   policy,
+			Purge:    purge,
+		})
+
+	case "disk":
+		dir, err := parseString(cfg, "dir")
+		if err != nil {
+			return nil, err
+		}
+		if dir == "" {
+			return nil, fmt.Errorf("proxy: disk cache requires a dir")
+		}
+
+		store, err = middleware.NewDiskStore(middleware.DiskStoreOpts{
+			Dir:      dir,
+			MaxBytes: maxBytes,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("proxy: invalid cache store %q", storeType)
+	}
+
+	purgeIPs, err := parseStringSlice(cfg, "purgeAllow")
+	if err != nil {
+		return nil, err
+	}
+	purgeAllow, err := middleware.ParseCIDRs(purgeIPs)
+	if err != nil {
+		return nil, err
+	}
+	purgeToken, err := parseString(cfg, "purgeToken")
+	if err != nil {
+		return nil, err
+	}
+	trusted, err := parseStringSlice(cfg, "trustedIPs")
+	if err != nil {
+		return nil, err
+	}
+	trustedProxies, err := middleware.ParseCIDRs(trusted)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: invalid cache trustedIPs: %v", err)
+	}
+
+	keyCfg, err := parseMap(cfg, "key")
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseCacheKeyOpts(keyCfg)
+	if err != nil {
+		return nil, err
+	}
+
 	return middleware.NewCache(h, middleware.CacheOpts{
-		Expiry:        expiry,
-		Purge:         purge,
-		IgnoreHeaders: ignore,
+		Expiry:          expiry,
+		StaleTTL:        staleTTL,
+		CoalesceTimeout: coalesceTimeout,
+		Store:           store,
+		Key:             key,
+		MaxObjectSize:   maxObjectSize,
+		IgnoreHeaders:   ignore,
+		PurgeAllow:      purgeAllow,
+		TrustedProxies:  trustedProxies,
+		PurgeToken:      purgeToken,
 	}), nil
 }
 
+func parseCacheKeyOpts(cfg map[string]interface{}) (middleware.CacheKeyOpts, error) {
+	var (
+		opts middleware.CacheKeyOpts
+		err  error
+	)
+	if opts.IncludeQuery, err = parseStringSlice(cfg, "includeQuery"); err != nil {
+		return opts, err
+	}
+	if opts.ExcludeQuery, err = parseStringSlice(cfg, "excludeQuery"); err != nil {
+		return opts, err
+	}
+	if opts.SortQuery, err = parseBool(cfg, "sortQuery"); err != nil {
+		return opts, err
+	}
+	if opts.Headers, err = parseStringSlice(cfg, "headers"); err != nil {
+		return opts, err
+	}
+	if opts.Cookies, err = parseStringSlice(cfg, "cookies"); err != nil {
+		return opts, err
+	}
+	if opts.Method, err = parseBool(cfg, "method"); err != nil {
+		return opts, err
+	}
+	if opts.DeviceClass, err = parseBool(cfg, "deviceClass"); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
 func createLocationMiddleware(cfg map[string]interface{}, h http.Handler) (http.Handler, error) {
 	path, ok := cfg["path"].(string)
 	if !ok {
@@ -65,6 +290,726 @@ func createLocationMiddleware(cfg map[string]interface{}, h http.Handler) (http.
 	return middleware.NewLocation(h, path), nil
 }
 
+func createClientCertMiddleware(cfg map[string]interface{}, h http.Handler) (http.Handler, error) {
+	subjects, err := parseStringSlice(cfg, "subjects")
+	if err != nil {
+		return nil, err
+	}
+	fingerprints, err := parseStringSlice(cfg, "fingerprints")
+	if err != nil {
+		return nil, err
+	}
+	subjectHeader, err := parseString(cfg, "subjectHeader")
+	if err != nil {
+		return nil, err
+	}
+	fingerprintHeader, err := parseString(cfg, "fingerprintHeader")
+	if err != nil {
+		return nil, err
+	}
+
+	return middleware.NewClientCert(h, middleware.ClientCertOpts{
+		Subjects:          subjects,
+		Fingerprints:      fingerprints,
+		SubjectHeader:     subjectHeader,
+		FingerprintHeader: fingerprintHeader,
+	}), nil
+}
+
+func createRewriteMiddleware(cfg map[string]interface{}, h http.Handler) (http.Handler, error) {
+	opts := middleware.RewriteOpts{}
+
+	var err error
+	if opts.StripPrefix, err = parseString(cfg, "stripPrefix"); err != nil {
+		return nil, err
+	}
+	if opts.AddPrefix, err = parseString(cfg, "addPrefix"); err != nil {
+		return nil, err
+	}
+	if opts.Regex, err = parseRegexp(cfg, "regex"); err != nil {
+		return nil, err
+	}
+	if opts.Replacement, err = parseString(cfg, "replacement"); err != nil {
+		return nil, err
+	}
+	if opts.Host, err = parseString(cfg, "host"); err != nil {
+		return nil, err
+	}
+
+	query, err := parseMap(cfg, "query")
+	if err != nil {
+		return nil, err
+	}
+	if query != nil {
+		if opts.QuerySet, err = parseStringMap(query, "set"); err != nil {
+			return nil, err
+		}
+		if opts.QueryRemove, err = parseStringSlice(query, "remove"); err != nil {
+			return nil, err
+		}
+	}
+
+	return middleware.NewRewrite(h, opts), nil
+}
+
+func createRedirectMiddleware(cfg map[string]interface{}, h http.Handler) (http.Handler, error) {
+	re, err := parseRegexp(cfg, "regex")
+	if err != nil {
+		return nil, err
+	}
+	replacement, err := parseString(cfg, "replacement")
+	if err != nil {
+		return nil, err
+	}
+	code, err := parseInt(cfg, "statusCode")
+	if err != nil {
+		return nil, err
+	}
+
+	switch code {
+	case 0, 301, 302, 303, 307, 308:
+	default:
+		return nil, fmt.Errorf("proxy: invalid redirect status code %d", code)
+	}
+
+	return middleware.NewRedirect(h, middleware.RedirectOpts{
+		Regex:       re,
+		Replacement: replacement,
+		StatusCode:  code,
+	}), nil
+}
+
+func createBasicAuthMiddleware(cfg map[string]interface{}, h http.Handler) (http.Handler, error) {
+	users, err := parseLines(cfg, "usersFile", "users", middleware.ParseHtpasswd)
+	if err != nil {
+		return nil, err
+	}
+	realm, err := parseString(cfg, "realm")
+	if err != nil {
+		return nil, err
+	}
+	field, err := parseString(cfg, "headerField")
+	if err != nil {
+		return nil, err
+	}
+
+	return middleware.NewBasicAuth(h, middleware.BasicAuthOpts{
+		Realm:       realm,
+		Users:       users,
+		HeaderField: field,
+	}), nil
+}
+
+func createAPIKeyMiddleware(cfg map[string]interface{}, h http.Handler) (http.Handler, error) {
+	keys, err := parseLines(cfg, "keysFile", "keys", middleware.ParseAPIKeys)
+	if err != nil {
+		return nil, err
+	}
+	header, err := parseString(cfg, "header")
+	if err != nil {
+		return nil, err
+	}
+	query, err := parseString(cfg, "query")
+	if err != nil {
+		return nil, err
+	}
+	field, err := parseString(cfg, "headerField")
+	if err != nil {
+		return nil, err
+	}
+
+	return middleware.NewAPIKey(h, middleware.APIKeyOpts{
+		Keys:        keys,
+		Header:      header,
+		Query:       query,
+		HeaderField: field,
+	}), nil
+}
+
+func createJWTMiddleware(cfg map[string]interface{}, h http.Handler) (http.Handler, error) {
+	opts := middleware.JWTOpts{}
+
+	jwksURL, err := parseString(cfg, "jwksUrl")
+	if err != nil {
+		return nil, err
+	}
+	if jwksURL != "" {
+		ttl, err := parseDuration(cfg, "jwksCacheTTL")
+		if err != nil {
+			return nil, err
+		}
+		opts.JWKS = middleware.NewJWKS(jwksURL, middleware.JWKSOpts{CacheTTL: ttl})
+	}
+
+	secret, err := parseString(cfg, "secret")
+	if err != nil {
+		return nil, err
+	}
+	if secret != "" {
+		opts.Secret = []byte(secret)
+	}
+
+	if opts.JWKS == nil && opts.Secret == nil {
+		return nil, fmt.Errorf("proxy: jwt requires a jwksUrl or secret")
+	}
+
+	if opts.Algorithms, err = parseStringSlice(cfg, "algorithms"); err != nil {
+		return nil, err
+	}
+	if opts.Issuer, err = parseString(cfg, "issuer"); err != nil {
+		return nil, err
+	}
+	if opts.Audience, err = parseStringSlice(cfg, "audience"); err != nil {
+		return nil, err
+	}
+	if opts.RequiredClaims, err = parseStringSlice(cfg, "requiredClaims"); err != nil {
+		return nil, err
+	}
+	if opts.ClaimHeaders, err = parseStringMap(cfg, "claimHeaders"); err != nil {
+		return nil, err
+	}
+	if opts.Leeway, err = parseDuration(cfg, "leeway"); err != nil {
+		return nil, err
+	}
+	if opts.OptionalExpiry, err = parseBool(cfg, "optionalExpiry"); err != nil {
+		return nil, err
+	}
+
+	return middleware.NewJWT(h, opts), nil
+}
+
+func createForwardAuthMiddleware(cfg map[string]interface{}, h http.Handler, bkends map[string]http.Handler) (http.Handler, error) {
+	name, err := parseString(cfg, "backend")
+	if err != nil {
+		return nil, err
+	}
+	auth, ok := bkends[name]
+	if !ok {
+		return nil, fmt.Errorf("proxy: unknown forward auth backend %s", name)
+	}
+
+	opts := middleware.ForwardAuthOpts{Auth: auth}
+	if opts.Path, err = parseString(cfg, "path"); err != nil {
+		return nil, err
+	}
+	if opts.RequestHeaders, err = parseStringSlice(cfg, "requestHeaders"); err != nil {
+		return nil, err
+	}
+	if opts.ResponseHeaders, err = parseStringSlice(cfg, "responseHeaders"); err != nil {
+		return nil, err
+	}
+
+	return middleware.NewForwardAuth(h, opts), nil
+}
+
+func createOIDCMiddleware(cfg map[string]interface{}, h http.Handler) (http.Handler, error) {
+	opts := middleware.OIDCOpts{}
+
+	var err error
+	if opts.Issuer, err = parseString(cfg, "issuer"); err != nil {
+		return nil, err
+	}
+	if opts.ClientID, err = parseString(cfg, "clientId"); err != nil {
+		return nil, err
+	}
+	if opts.ClientSecret, err = parseString(cfg, "clientSecret"); err != nil {
+		return nil, err
+	}
+	if opts.RedirectURL, err = parseString(cfg, "redirectUrl"); err != nil {
+		return nil, err
+	}
+	if opts.Scopes, err = parseStringSlice(cfg, "scopes"); err != nil {
+		return nil, err
+	}
+	if opts.CookieName, err = parseString(cfg, "cookieName"); err != nil {
+		return nil, err
+	}
+	if opts.CookieSecret, err = parseString(cfg, "cookieSecret"); err != nil {
+		return nil, err
+	}
+	if opts.RefreshBefore, err = parseDuration(cfg, "refreshBefore"); err != nil {
+		return nil, err
+	}
+	if opts.SessionMaxAge, err = parseDuration(cfg, "sessionMaxAge"); err != nil {
+		return nil, err
+	}
+	if opts.ClaimHeaders, err = parseStringMap(cfg, "claimHeaders"); err != nil {
+		return nil, err
+	}
+
+	h, err = middleware.NewOIDC(h, opts)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: invalid oidc: %v", err)
+	}
+	return h, nil
+}
+
+func createRateLimitMiddleware(route string, cfg map[string]interface{}, h http.Handler) (http.Handler, error) {
+	opts := middleware.RateLimitOpts{}
+
+	var err error
+	if opts.Key, err = parseKeyFunc(route, cfg, "key"); err != nil {
+		return nil, err
+	}
+	if opts.Average, err = parseInt(cfg, "average"); err != nil {
+		return nil, err
+	}
+	if opts.Average <= 0 {
+		return nil, fmt.Errorf("proxy: rate limit average must be greater than 0")
+	}
+	if opts.Period, err = parseDuration(cfg, "period"); err != nil {
+		return nil, err
+	}
+	if opts.Burst, err = parseInt(cfg, "burst"); err != nil {
+		return nil, err
+	}
+	if opts.MaxKeys, err = parseInt(cfg, "maxKeys"); err != nil {
+		return nil, err
+	}
+
+	return middleware.NewRateLimit(h, opts), nil
+}
+
+func createConcurrencyLimitMiddleware(cfg map[string]interface{}, h http.Handler) (http.Handler, error) {
+	opts := middleware.ConcurrencyLimitOpts{}
+
+	var err error
+	if opts.MaxInFlight, err = parseInt(cfg, "maxInFlight"); err != nil {
+		return nil, err
+	}
+	if opts.MaxInFlight <= 0 {
+		return nil, fmt.Errorf("proxy: concurrency limit maxInFlight must be greater than 0")
+	}
+	if opts.MaxQueue, err = parseInt(cfg, "maxQueue"); err != nil {
+		return nil, err
+	}
+	if opts.MaxWait, err = parseDuration(cfg, "maxWait"); err != nil {
+		return nil, err
+	}
+	if opts.RetryAfter, err = parseDuration(cfg, "retryAfter"); err != nil {
+		return nil, err
+	}
+
+	return middleware.NewConcurrencyLimit(h, opts), nil
+}
+
+func createIPFilterMiddleware(cfg map[string]interface{}, h http.Handler) (*middleware.IPFilter, error) {
+	opts := middleware.IPFilterOpts{}
+
+	var err error
+	if opts.Allow, err = parseStringSlice(cfg, "allow"); err != nil {
+		return nil, err
+	}
+	if opts.AllowFile, err = parseString(cfg, "allowFile"); err != nil {
+		return nil, err
+	}
+	if opts.Deny, err = parseStringSlice(cfg, "deny"); err != nil {
+		return nil, err
+	}
+	if opts.DenyFile, err = parseString(cfg, "denyFile"); err != nil {
+		return nil, err
+	}
+
+	trusted, err := parseStringSlice(cfg, "trustedIPs")
+	if err != nil {
+		return nil, err
+	}
+	if opts.TrustedProxies, err = middleware.ParseCIDRs(trusted); err != nil {
+		return nil, fmt.Errorf("proxy: invalid ip filter trustedIPs: %v", err)
+	}
+
+	f, err := middleware.NewIPFilter(h, opts)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: invalid ip filter: %v", err)
+	}
+	return f, nil
+}
+
+func createCORSMiddleware(cfg map[string]interface{}, h http.Handler) (http.Handler, error) {
+	opts := middleware.CORSOpts{}
+
+	var err error
+	if opts.AllowedOrigins, err = parseStringSlice(cfg, "allowedOrigins"); err != nil {
+		return nil, err
+	}
+	regexes, err := parseStringSlice(cfg, "allowedOriginRegexes")
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range regexes {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: invalid regex allowedOriginRegexes: %v", err)
+		}
+		opts.AllowedOriginRegexes = append(opts.AllowedOriginRegexes, re)
+	}
+	if opts.AllowedMethods, err = parseStringSlice(cfg, "allowedMethods"); err != nil {
+		return nil, err
+	}
+	if opts.AllowedHeaders, err = parseStringSlice(cfg, "allowedHeaders"); err != nil {
+		return nil, err
+	}
+	if opts.ExposedHeaders, err = parseStringSlice(cfg, "exposedHeaders"); err != nil {
+		return nil, err
+	}
+	if opts.AllowCredentials, err = parseBool(cfg, "allowCredentials"); err != nil {
+		return nil, err
+	}
+	if opts.MaxAge, err = parseDuration(cfg, "maxAge"); err != nil {
+		return nil, err
+	}
+
+	return middleware.NewCORS(h, opts)
+}
+
+func createCompressMiddleware(cfg map[string]interface{}, h http.Handler) (http.Handler, error) {
+	opts := middleware.CompressOpts{}
+
+	var err error
+	if opts.Encodings, err = parseStringSlice(cfg, "encodings"); err != nil {
+		return nil, err
+	}
+	for _, enc := range opts.Encodings {
+		switch enc {
+		case "br", "zstd", "gzip":
+		default:
+			return nil, fmt.Errorf("proxy: unknown compress encoding %s", enc)
+		}
+	}
+	if opts.ContentTypes, err = parseStringSlice(cfg, "contentTypes"); err != nil {
+		return nil, err
+	}
+	if opts.MinSize, err = parseInt(cfg, "minSize"); err != nil {
+		return nil, err
+	}
+
+	return middleware.NewCompress(h, opts), nil
+}
+
+// parseKeyFunc parses a request key like "ip", "route",
+// "header:X-Api-Key" or "claim:sub". Claims are read from the
+// token verified by a preceding jwt middleware.
+func parseKeyFunc(route string, cfg map[string]interface{}, k string) (middleware.KeyFunc, error) {
+	s, err := parseString(cfg, k)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(s, ":", 2)
+	switch {
+	case s == "" || s == "ip":
+		return middleware.IPKey, nil
+
+	case s == "route":
+		return middleware.StaticKey(route), nil
+
+	case len(parts) == 2 && parts[0] == "header" && parts[1] != "":
+		return middleware.HeaderKey(parts[1]), nil
+
+	case len(parts) == 2 && parts[0] == "claim" && parts[1] != "":
+		return middleware.ClaimKey(parts[1]), nil
+
+	default:
+		return nil, fmt.Errorf("proxy: invalid %s '%s'", k, s)
+	}
+}
+
+// parseLines parses the lines of the file and the inline list with the parse function.
+func parseLines(cfg map[string]interface{}, fileKey, listKey string, parse func(io.Reader) (map[string]string, error)) (map[string]string, error) {
+	m := map[string]string{}
+
+	file, err := parseString(cfg, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: could not open %s: %v", fileKey, err)
+		}
+		defer f.Close()
+
+		fm, err := parse(f)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range fm {
+			m[k] = v
+		}
+	}
+
+	list, err := parseStringSlice(cfg, listKey)
+	if err != nil {
+		return nil, err
+	}
+	lm, err := parse(strings.NewReader(strings.Join(list, "\n")))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range lm {
+		m[k] = v
+	}
+
+	return m, nil
+}
+
+func createHeadersMiddleware(route string, cfg map[string]interface{}, h http.Handler) (http.Handler, error) {
+	req, err := parseHeaderRules(cfg, "request")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := parseHeaderRules(cfg, "response")
+	if err != nil {
+		return nil, err
+	}
+	reqID, err := parseBool(cfg, "requestId")
+	if err != nil {
+		return nil, err
+	}
+
+	h, err = middleware.NewHeaders(h, middleware.HeadersOpts{
+		Route:     route,
+		Request:   req,
+		Response:  resp,
+		RequestID: reqID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("proxy: invalid headers: %v", err)
+	}
+	return h, nil
+}
+
+func parseHeaderRules(cfg map[string]interface{}, k string) (middleware.HeaderRules, error) {
+	m, err := parseMap(cfg, k)
+	if err != nil || m == nil {
+		return middleware.HeaderRules{}, err
+	}
+
+	var rules middleware.HeaderRules
+	if rules.Rename, err = parseStringMap(m, "rename"); err != nil {
+		return rules, err
+	}
+	if rules.Remove, err = parseStringSlice(m, "remove"); err != nil {
+		return rules, err
+	}
+	if rules.Set, err = parseStringMap(m, "set"); err != nil {
+		return rules, err
+	}
+	if rules.Add, err = parseStringMap(m, "add"); err != nil {
+		return rules, err
+	}
+	if rules.StatusCodes, err = parseStatusCodes(m, "statusCodes"); err != nil {
+		return rules, err
+	}
+	return rules, nil
+}
+
+// parseStatusCodes parses status codes like 200, "2xx" or "200-299".
+func parseStatusCodes(cfg map[string]interface{}, k string) ([]middleware.StatusRange, error) {
+	v, ok := cfg[k]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("proxy: invalid status codes %s", k)
+	}
+
+	ranges := make([]middleware.StatusRange, 0, len(list))
+	for _, item := range list {
+		var s string
+		switch val := item.(type) {
+		case int:
+			s = strconv.Itoa(val)
+		case string:
+			s = strings.ToLower(val)
+		default:
+			return nil, fmt.Errorf("proxy: invalid status codes %s", k)
+		}
+
+		var rng middleware.StatusRange
+		var err error
+		switch {
+		case len(s) == 3 && strings.HasSuffix(s, "xx"):
+			rng.From, err = strconv.Atoi(s[:1])
+			rng.From *= 100
+			rng.To = rng.From + 99
+
+		case strings.Contains(s, "-"):
+			parts := strings.SplitN(s, "-", 2)
+			if rng.From, err = strconv.Atoi(parts[0]); err == nil {
+				rng.To, err = strconv.Atoi(parts[1])
+			}
+
+		default:
+			rng.From, err = strconv.Atoi(s)
+			rng.To = rng.From
+		}
+		if err != nil {
+			return nil, fmt.Errorf("proxy: invalid status code '%s' in %s", s, k)
+		}
+		ranges = append(ranges, rng)
+	}
+	return ranges, nil
+}
+
+func parseMap(cfg map[string]interface{}, k string) (map[string]interface{}, error) {
+	v, ok := cfg[k]
+	if !ok {
+		return nil, nil
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return val, nil
+
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for mk, mv := range val {
+			str, ok := mk.(string)
+			if !ok {
+				return nil, fmt.Errorf("proxy: invalid map %s", k)
+			}
+			m[str] = mv
+		}
+		return m, nil
+
+	default:
+		return nil, fmt.Errorf("proxy: invalid map %s", k)
+	}
+}
+
+func parseStringMap(cfg map[string]interface{}, k string) (map[string]string, error) {
+	m, err := parseMap(cfg, k)
+	if err != nil || m == nil {
+		return nil, err
+	}
+
+	sm := make(map[string]string, len(m))
+	for mk, mv := range m {
+		str, ok := mv.(string)
+		if !ok {
+			return nil, fmt.Errorf("proxy: invalid string map %s", k)
+		}
+		sm[mk] = str
+	}
+	return sm, nil
+}
+
+func parseRegexp(cfg map[string]interface{}, k string) (*regexp.Regexp, error) {
+	s, err := parseString(cfg, k)
+	if err != nil || s == "" {
+		return nil, err
+	}
+
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: invalid regex %s: %v", k, err)
+	}
+	return re, nil
+}
+
+func parseString(cfg map[string]interface{}, k string) (string, error) {
+	v, ok := cfg[k]
+	if !ok {
+		return "", nil
+	}
+
+	val, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("proxy: invalid string %s", k)
+	}
+	return val, nil
+}
+
+func parseStringSlice(cfg map[string]interface{}, k string) ([]string, error) {
+	v, ok := cfg[k]
+	if !ok {
+		return nil, nil
+	}
+
+	switch val := v.(type) {
+	case string:
+		return []string{val}, nil
+
+	case []string:
+		return val, nil
+
+	case []interface{}:
+		s := make([]string, len(val))
+		for i, item := range val {
+			str, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("proxy: invalid string list %s", k)
+			}
+			s[i] = str
+		}
+		return s, nil
+
+	default:
+		return nil, fmt.Errorf("proxy: invalid string list %s", k)
+	}
+}
+
+func parseInt(cfg map[string]interface{}, k string) (int, error) {
+	v, ok := cfg[k]
+	if !ok {
+		return 0, nil
+	}
+
+	switch val := v.(type) {
+	case string:
+		return strconv.Atoi(val)
+
+	case int:
+		return val, nil
+
+	default:
+		return 0, fmt.Errorf("proxy: invalid integer %s", k)
+	}
+}
+
+var sizeUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"GB", 1 << 30},
+	{"B", 1},
+}
+
+func parseSize(cfg map[string]interface{}, k string) (int64, error) {
+	v, ok := cfg[k]
+	if !ok {
+		return 0, nil
+	}
+
+	switch val := v.(type) {
+	case string:
+		s := strings.ToUpper(strings.TrimSpace(val))
+		mult := int64(1)
+		for _, unit := range sizeUnits {
+			if strings.HasSuffix(s, unit.suffix) {
+				s, mult = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix)), unit.mult
+				break
+			}
+		}
+
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("proxy: invalid size %s", k)
+		}
+		return n * mult, nil
+
+	case int:
+		return int64(val), nil
+
+	default:
+		return 0, fmt.Errorf("proxy: invalid size %s", k)
+	}
+}
+
 func parseBool(cfg map[string]interface{}, k string) (bool, error) {
 	v, ok := cfg[k]
 	if !ok {
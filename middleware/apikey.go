@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/nrwiersma/proxy/http"
+)
+
+// ParseAPIKeys parses API keys in "identity:key" lines, returning
+// a map of keys to identities.
+func ParseAPIKeys(r io.Reader) (map[string]string, error) {
+	keys := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Lines contain secrets, so errors only report the line number.
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("middleware: invalid api key on line %d", n)
+		}
+		keys[parts[1]] = parts[0]
+	}
+
+	return keys, scanner.Err()
+}
+
+// APIKeyOpts configures an API key middleware.
+type APIKeyOpts struct {
+	// Keys is a map of API keys to identities.
+	Keys map[string]string
+
+	// Header is the header the key is read from. If both Header
+	// and Query are empty, "X-Api-Key" is used.
+	Header string
+
+	// Query is the query parameter the key is read from.
+	Query string
+
+	// HeaderField is the header the identity is forwarded in.
+	HeaderField string
+}
+
+// APIKey authenticates requests with API keys.
+type APIKey struct {
+	h    http.Handler
+	opts APIKeyOpts
+
+	keys map[[sha256.Size]byte]string
+}
+
+// NewAPIKey returns an API key middleware.
+func NewAPIKey(h http.Handler, opts APIKeyOpts) *APIKey {
+	if opts.Header == "" && opts.Query == "" {
+		opts.Header = "X-Api-Key"
+	}
+
+	// Keys are looked up by hash so the lookup does not
+	// leak the key contents through timing.
+	keys := make(map[[sha256.Size]byte]string, len(opts.Keys))
+	for k, id := range opts.Keys {
+		keys[sha256.Sum256([]byte(k))] = id
+	}
+
+	return &APIKey{
+		h:    h,
+		opts: opts,
+		keys: keys,
+	}
+}
+
+// ServeHTTP serves an HTTP request.
+func (m *APIKey) ServeHTTP(ctx context.Context, r *http.Request) *http.Response {
+	if m.opts.HeaderField != "" {
+		r.Header.Del(m.opts.HeaderField)
+	}
+
+	var key string
+	if m.opts.Header != "" {
+		key = r.Header.Get(m.opts.Header)
+	}
+
+	var q url.Values
+	if key == "" && m.opts.Query != "" {
+		// Repeated key parameters are ambiguous and are rejected.
+		q = r.URL.Query()
+		if vals := q[m.opts.Query]; len(vals) == 1 {
+			key = vals[0]
+		}
+	}
+
+	id, ok := m.keys[sha256.Sum256([]byte(key))]
+	if key == "" || !ok {
+		return &http.Response{
+			StatusCode: 401,
+			StatusText: "Unauthorized",
+			Header: http.Header{
+				"Content-Length": []string{"0"},
+			},
+		}
+	}
+
+	if m.opts.Header != "" {
+		r.Header.Del(m.opts.Header)
+	}
+	if m.opts.Query != "" {
+		if q == nil {
+			q = r.URL.Query()
+		}
+		if _, ok := q[m.opts.Query]; ok {
+			q.Del(m.opts.Query)
+			r.URL.RawQuery = q.Encode()
+		}
+	}
+	if m.opts.HeaderField != "" {
+		r.Header.Set(m.opts.HeaderField, id)
+	}
+
+	return m.h.ServeHTTP(ctx, r)
+}
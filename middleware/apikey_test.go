@@ -0,0 +1,111 @@
+package middleware_test
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	got, err := middleware.ParseAPIKeys(strings.NewReader("# keys\nalice:key-1\n\nbob:key-2\n"))
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]string{"key-1": "alice", "key-2": "bob"}, got)
+	}
+}
+
+func TestParseAPIKeys_ErrorsOnInvalidLine(t *testing.T) {
+	_, err := middleware.ParseAPIKeys(strings.NewReader("alice:key-1\nsecret-key"))
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "line 2")
+		assert.NotContains(t, err.Error(), "secret-key")
+	}
+}
+
+func TestAPIKey_ServeHTTP(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      middleware.APIKeyOpts
+		header    http.Header
+		query     string
+		want      int
+		wantID    string
+		wantQuery string
+	}{
+		{
+			name:   "Default Header",
+			opts:   middleware.APIKeyOpts{},
+			header: http.Header{"X-Api-Key": []string{"key-1"}},
+			want:   200,
+			wantID: "alice",
+		},
+		{
+			name:   "Custom Header",
+			opts:   middleware.APIKeyOpts{Header: "Authorization"},
+			header: http.Header{"Authorization": []string{"key-2"}},
+			want:   200,
+			wantID: "bob",
+		},
+		{
+			name:      "Query",
+			opts:      middleware.APIKeyOpts{Query: "api_key"},
+			header:    http.Header{},
+			query:     "api_key=key-1&foo=bar",
+			want:      200,
+			wantID:    "alice",
+			wantQuery: "foo=bar",
+		},
+		{
+			name:   "Repeated Query",
+			opts:   middleware.APIKeyOpts{Query: "api_key"},
+			header: http.Header{},
+			query:  "api_key=key-&api_key=1",
+			want:   401,
+		},
+		{
+			name:   "Unknown Key",
+			opts:   middleware.APIKeyOpts{},
+			header: http.Header{"X-Api-Key": []string{"key-3"}},
+			want:   401,
+		},
+		{
+			name:   "No Key",
+			opts:   middleware.APIKeyOpts{},
+			header: http.Header{},
+			want:   401,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/test", RawQuery: tt.query},
+				Header: tt.header,
+			}
+			req.Header.Set("X-Identity", "spoofed")
+
+			opts := tt.opts
+			opts.Keys = map[string]string{"key-1": "alice", "key-2": "bob"}
+			opts.HeaderField = "X-Identity"
+			m := middleware.NewAPIKey(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+				assert.Equal(t, tt.wantID, r.Header.Get("X-Identity"))
+				assert.Equal(t, "", r.Header.Get("X-Api-Key"))
+				assert.Equal(t, "", r.Header.Get("Authorization"))
+				assert.Equal(t, tt.wantQuery, r.URL.RawQuery)
+
+				return &http.Response{StatusCode: 200, StatusText: "OK"}
+			}), opts)
+
+			got := m.ServeHTTP(context.Background(), req)
+
+			assert.Equal(t, tt.want, got.StatusCode)
+		})
+	}
+}
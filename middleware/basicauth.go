@@ -0,0 +1,160 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/internal/crypt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ParseHtpasswd parses htpasswd formatted users, returning
+// a map of user names to password hashes.
+//
+// Supported hashes are bcrypt, SHA-256 and SHA-512 crypt and {SHA}.
+func ParseHtpasswd(r io.Reader) (map[string]string, error) {
+	users := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("middleware: invalid htpasswd entry on line %d", n)
+		}
+		if !isSupportedHash(parts[1]) {
+			return nil, fmt.Errorf("middleware: unsupported hash for user %s", parts[0])
+		}
+		users[parts[0]] = parts[1]
+	}
+
+	return users, scanner.Err()
+}
+
+func isSupportedHash(hash string) bool {
+	return isBcrypt(hash) || crypt.IsSHA(hash) || strings.HasPrefix(hash, "{SHA}")
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") ||
+		strings.HasPrefix(hash, "$2b$") ||
+		strings.HasPrefix(hash, "$2y$")
+}
+
+func compareHash(hash, password string) bool {
+	switch {
+	case isBcrypt(hash):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+
+	case crypt.IsSHA(hash):
+		return crypt.CompareSHA(hash, password) == nil
+
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		want := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(want)) == 1
+
+	default:
+		return false
+	}
+}
+
+// BasicAuthOpts configures a basic auth middleware.
+type BasicAuthOpts struct {
+	// Realm is the authentication realm. If Realm is empty, "proxy" is used.
+	Realm string
+
+	// Users is a map of user names to password hashes.
+	Users map[string]string
+
+	// HeaderField is the header the authenticated user is forwarded in.
+	HeaderField string
+}
+
+// BasicAuth authenticates requests with basic auth.
+type BasicAuth struct {
+	h    http.Handler
+	opts BasicAuthOpts
+}
+
+// NewBasicAuth returns a basic auth middleware.
+func NewBasicAuth(h http.Handler, opts BasicAuthOpts) *BasicAuth {
+	if opts.Realm == "" {
+		opts.Realm = "proxy"
+	}
+
+	return &BasicAuth{
+		h:    h,
+		opts: opts,
+	}
+}
+
+// ServeHTTP serves an HTTP request.
+func (m *BasicAuth) ServeHTTP(ctx context.Context, r *http.Request) *http.Response {
+	if m.opts.HeaderField != "" {
+		r.Header.Del(m.opts.HeaderField)
+	}
+
+	user, pass, ok := basicAuth(r.Header.Get("Authorization"))
+	if !ok || !m.authenticate(user, pass) {
+		return &http.Response{
+			StatusCode: 401,
+			StatusText: "Unauthorized",
+			Header: http.Header{
+				"Www-Authenticate": []string{`Basic realm="` + m.opts.Realm + `"`},
+				"Content-Length":   []string{"0"},
+			},
+		}
+	}
+
+	r.Header.Del("Authorization")
+	if m.opts.HeaderField != "" {
+		r.Header.Set(m.opts.HeaderField, user)
+	}
+
+	return m.h.ServeHTTP(ctx, r)
+}
+
+// dummyHash is compared against for unknown users, so they take
+// as long to reject as known users.
+const dummyHash = "$2a$10$6SWLFjvu7OHFVfmX5Ihim.p2QzgLNXLfBzIpj9oiiCqepgjmj9/Ma"
+
+func (m *BasicAuth) authenticate(user, pass string) bool {
+	hash, ok := m.opts.Users[user]
+	if !ok {
+		compareHash(dummyHash, pass)
+		return false
+	}
+
+	return compareHash(hash, pass)
+}
+
+// basicAuth parses a basic auth header like "Basic dXNlcjpwYXNz".
+func basicAuth(auth string) (string, string, bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
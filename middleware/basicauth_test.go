@@ -0,0 +1,121 @@
+package middleware_test
+
+import (
+	"context"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+const testHtpasswd = `# users
+bcrypt:$2a$04$Afq/xKrfQL4BBpsYUAGYRumvEnCxrzqF1avSsD3Hk0lnyk9EU63jC
+sha256:$5$saltsalt$gOjOtoMpVhru2uyjeJSEc/JaLQWOXMNmlOnj6T4AtC.
+sha1:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+`
+
+func TestParseHtpasswd(t *testing.T) {
+	got, err := middleware.ParseHtpasswd(strings.NewReader(testHtpasswd))
+
+	if assert.NoError(t, err) {
+		assert.Len(t, got, 3)
+		assert.Equal(t, "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", got["sha1"])
+	}
+}
+
+func TestParseHtpasswd_ErrorsOnUnsupportedHash(t *testing.T) {
+	_, err := middleware.ParseHtpasswd(strings.NewReader("user:$apr1$salt$hash"))
+
+	assert.Error(t, err)
+}
+
+func TestBasicAuth_ServeHTTP(t *testing.T) {
+	users, err := middleware.ParseHtpasswd(strings.NewReader(testHtpasswd))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		auth     string
+		want     int
+		wantUser string
+	}{
+		{
+			name:     "Bcrypt",
+			auth:     basicAuthHeader("bcrypt", "password"),
+			want:     200,
+			wantUser: "bcrypt",
+		},
+		{
+			name:     "SHA-256 Crypt",
+			auth:     basicAuthHeader("sha256", "password"),
+			want:     200,
+			wantUser: "sha256",
+		},
+		{
+			name:     "SHA-1",
+			auth:     basicAuthHeader("sha1", "password"),
+			want:     200,
+			wantUser: "sha1",
+		},
+		{
+			name: "Wrong Password",
+			auth: basicAuthHeader("bcrypt", "wrong"),
+			want: 401,
+		},
+		{
+			name: "Unknown User",
+			auth: basicAuthHeader("unknown", "password"),
+			want: 401,
+		},
+		{
+			name: "Invalid Header",
+			auth: "Basic not-base64",
+			want: 401,
+		},
+		{
+			name: "No Header",
+			want: 401,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/test"},
+				Header: http.Header{"X-User": []string{"spoofed"}},
+			}
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+
+			m := middleware.NewBasicAuth(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+				assert.Equal(t, "", r.Header.Get("Authorization"))
+				assert.Equal(t, tt.wantUser, r.Header.Get("X-User"))
+
+				return &http.Response{StatusCode: 200, StatusText: "OK"}
+			}), middleware.BasicAuthOpts{
+				Realm:       "test",
+				Users:       users,
+				HeaderField: "X-User",
+			})
+
+			got := m.ServeHTTP(context.Background(), req)
+
+			assert.Equal(t, tt.want, got.StatusCode)
+			if tt.want == 401 {
+				assert.Equal(t, `Basic realm="test"`, got.Header.Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func basicAuthHeader(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
@@ -5,129 +5,839 @@ import (
 	"context"
 	"io"
 	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nrwiersma/proxy/http"
-	"github.com/nrwiersma/proxy/internal/slices"
-	"github.com/patrickmn/go-cache"
 )
 
-var (
-	cacheControl        = "Cache-Control"
-	cacheControlNoCache = []string{
-		"no-cache",
-		"no-store",
-		"private",
-	}
-)
+// cacheableStatuses are the statuses that are cacheable by default.
+var cacheableStatuses = map[int]bool{
+	200: true,
+	203: true,
+	204: true,
+	300: true,
+	301: true,
+	308: true,
+	404: true,
+	405: true,
+	410: true,
+	414: true,
+	501: true,
+}
+
+// conditionalHeaders are the request headers of conditional requests
+// that are answered by the cache.
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since"}
 
 // Cache caches http responses.
+//
+// Responses are cached following RFC 9111 for a shared cache. The
+// freshness lifetime is taken from the s-maxage or max-age directives,
+// or the Expires header, falling back to the configured expiry.
+//
+// Stale responses with an ETag or Last-Modified header are revalidated
+// with a conditional request, and are served stale within their
+// stale-while-revalidate and stale-if-error windows.
+//
+// Concurrent misses for the same key are collapsed into a single
+// fetch, the other requests are served from its stored response.
+//
+// Entries can be purged by key, prefix, host or the cache tags in
+// their Surrogate-Key or Cache-Tag header, directly or with a PURGE
+// request. Purges only reach the entries in the store of the cache,
+// so caches on other routes are only purged if they share the store.
 type Cache struct {
 	h     http.Handler
-	cache *cache.Cache
+	store CacheStore
 
-	ignoreHeaders bool
+	expiry          time.Duration
+	staleTTL        time.Duration
+	coalesceTimeout time.Duration
+	maxObjectSize   int64
+	ignoreHeaders   bool
+	purgeAllow      []*net.IPNet
+	trustedProxies  []*net.IPNet
+	purgeToken      string
+	keyOpts         CacheKeyOpts
+
+	mu           sync.Mutex
+	revalidating map[string]bool
+	calls        map[string]chan struct{}
 }
 
 // CacheOpts configures a cache.
 type CacheOpts struct {
+	// Expiry is the freshness lifetime of responses without
+	// explicit freshness information.
 	Expiry time.Duration
 
+	// Purge is the interval expired items are purged in, when
+	// no Store is given.
 	Purge time.Duration
 
+	// Store is the store responses are cached in. Defaults to
+	// a memory store.
+	Store CacheStore
+
+	// Key configures the cache key. By default the key is
+	// the request host and URL.
+	Key CacheKeyOpts
+
+	// MaxObjectSize is the maximum body size of cached responses.
+	// Larger responses are passed through uncached.
+	MaxObjectSize int64
+
+	// StaleTTL is how long stale responses with validators are
+	// kept for revalidation. Defaults to 1 hour.
+	StaleTTL time.Duration
+
+	// CoalesceTimeout is how long concurrent misses wait on a single
+	// fetch before fetching individually. Defaults to 5 seconds.
+	CoalesceTimeout time.Duration
+
+	// IgnoreHeaders caches all cacheable responses for Expiry,
+	// ignoring caching headers.
 	IgnoreHeaders bool
+
+	// PurgeAllow are the networks allowed to send PURGE requests.
+	PurgeAllow []*net.IPNet
+
+	// TrustedProxies are the networks of proxies whose
+	// X-Forwarded-For headers are used to find the client ip
+	// of PURGE requests.
+	TrustedProxies []*net.IPNet
+
+	// PurgeToken is the bearer token required in PURGE requests.
+	//
+	// PURGE requests are only handled if PurgeAllow or
+	// PurgeToken is set.
+	PurgeToken string
 }
 
 // NewCache returns a cache middleware.
 func NewCache(h http.Handler, opts CacheOpts) *Cache {
-	c := cache.New(opts.Expiry, opts.Purge)
+	if opts.StaleTTL <= 0 {
+		opts.StaleTTL = time.Hour
+	}
+	if opts.CoalesceTimeout <= 0 {
+		opts.CoalesceTimeout = 5 * time.Second
+	}
+
+	if opts.Store == nil {
+		opts.Store = NewMemoryStore(MemoryStoreOpts{Purge: opts.Purge})
+	}
 
 	return &Cache{
-		h:             h,
-		cache:         c,
-		ignoreHeaders: opts.IgnoreHeaders,
+		h:               h,
+		store:           opts.Store,
+		expiry:          opts.Expiry,
+		staleTTL:        opts.StaleTTL,
+		coalesceTimeout: opts.CoalesceTimeout,
+		maxObjectSize:   opts.MaxObjectSize,
+		ignoreHeaders:   opts.IgnoreHeaders,
+		purgeAllow:      opts.PurgeAllow,
+		trustedProxies:  opts.TrustedProxies,
+		purgeToken:      opts.PurgeToken,
+		keyOpts:         opts.Key,
+		revalidating:    map[string]bool{},
+		calls:           map[string]chan struct{}{},
+	}
+}
+
+// CacheEntry is a cached response.
+type CacheEntry struct {
+	StatusCode int
+	StatusText string
+	Proto      string
+	Header     http.Header
+	Body       []byte
+
+	// Stored is when the response was stored.
+	Stored time.Time
+
+	// Age is the age of the response when it was stored.
+	Age time.Duration
+
+	// Lifetime is the freshness lifetime of the response.
+	Lifetime time.Duration
+
+	// StaleWhileRevalidate is how long after its lifetime the response
+	// may be served while it is revalidated in the background.
+	StaleWhileRevalidate time.Duration
+
+	// StaleIfError is how long after its lifetime the response
+	// may be served when revalidation fails.
+	StaleIfError time.Duration
+
+	// Vary are the fields of the Vary header. An entry with Vary
+	// fields is stored under the primary key of the request, pointing
+	// to the variants of the response.
+	Vary []string
+
+	// Open opens the body of entries that do not hold it in Body.
+	Open func() (io.ReadCloser, error) `json:"-"`
+}
+
+// Size returns the approximate memory size of the entry.
+func (e *CacheEntry) Size() int64 {
+	size := int64(len(e.StatusText)+len(e.Proto)+len(e.Body)) + 128
+	for k, vals := range e.Header {
+		size += int64(len(k))
+		for _, v := range vals {
+			size += int64(len(v))
+		}
+	}
+	for _, f := range e.Vary {
+		size += int64(len(f))
 	}
+	return size
+}
+
+// age returns the current age of the entry.
+func (e *CacheEntry) age(now time.Time) time.Duration {
+	return e.Age + now.Sub(e.Stored)
 }
 
-type cacheItem struct {
-	Response http.Response
-	Body     []byte
+// hasValidators determines if the entry can be revalidated.
+func (e *CacheEntry) hasValidators() bool {
+	return hasValidators(e.Header)
+}
+
+// response returns a response for the entry.
+func (e *CacheEntry) response(now time.Time, withBody bool) (*http.Response, error) {
+	resp := &http.Response{
+		StatusCode: e.StatusCode,
+		StatusText: e.StatusText,
+		Proto:      e.Proto,
+		Header:     cloneHeader(e.Header),
+	}
+	resp.Header.Set("Age", strconv.Itoa(int(e.age(now).Seconds())))
+	if !withBody {
+		return resp, nil
+	}
+
+	if e.Open == nil {
+		resp.Body = bytes.NewReader(e.Body)
+		return resp, nil
+	}
+
+	body, err := e.Open()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &eofCloser{ReadCloser: body}
+	return resp, nil
+}
+
+// eofCloser closes the reader once it is read completely.
+type eofCloser struct {
+	io.ReadCloser
+}
+
+// Read reads from the underlying reader, closing it on EOF.
+func (r *eofCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		_ = r.ReadCloser.Close()
+	}
+	return n, err
 }
 
 // ServeHTTP serves an HTTP request.
 func (c *Cache) ServeHTTP(ctx context.Context, r *http.Request) *http.Response {
-	key := c.cacheKey(r)
-	if v, ok := c.cache.Get(key); ok {
-		item := v.(cacheItem)
+	if r.Method == "PURGE" && c.isPurgeEnabled() {
+		return c.servePurge(r)
+	}
 
-		newResp := &http.Response{}
-		*newResp = item.Response
-		newResp.Body = bytes.NewReader(item.Body)
-		return newResp
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return c.h.ServeHTTP(ctx, r)
 	}
 
-	resp := c.h.ServeHTTP(ctx, r)
+	reqCC := parseCacheControl(r.Header)
+	now := time.Now()
 
-	if !c.shouldCache(r, resp) {
-		return resp
+	if !c.ignoreHeaders && reqCC.has("no-store") {
+		return c.h.ServeHTTP(ctx, r)
+	}
+
+	key := c.primaryKey(r)
+	e, ok := c.lookup(key, r)
+	if !ok {
+		return c.coalesce(ctx, key, r, nil, now)
 	}
 
-	body, err := c.readBody(resp)
+	noCache := !c.ignoreHeaders && (reqCC.has("no-cache") || reqCC.has("max-age=0"))
+	age := e.age(now)
+	switch {
+	case !noCache && age < e.Lifetime:
+		if resp := c.serve(r, e, now, "HIT"); resp != nil {
+			return resp
+		}
+		e = nil
+
+	case !noCache && age < e.Lifetime+e.StaleWhileRevalidate:
+		if resp := c.serve(r, e, now, "STALE"); resp != nil {
+			c.revalidateAsync(key, r, e)
+			return resp
+		}
+		e = nil
+	}
+
+	return c.coalesce(ctx, key, r, e, now)
+}
+
+// Stats returns the statistics of the cache store.
+func (c *Cache) Stats() CacheStats {
+	return c.store.Stats()
+}
+
+// serve serves the entry, answering conditional requests. If the
+// entry body cannot be opened, like when it was evicted from the
+// store in the meantime, nil is returned.
+func (c *Cache) serve(r *http.Request, e *CacheEntry, now time.Time, status string) *http.Response {
+	notModified := e.StatusCode == 200 && isNotModified(r.Header, e.Header)
+
+	if !notModified && isRangeRequest(r, e) {
+		if resp := c.serveRange(r, e, now); resp != nil {
+			removeSurrogateKeys(resp.Header)
+			resp.Header.Set("X-Cache", status)
+			return resp
+		}
+	}
+
+	resp, err := e.response(now, r.Method != "HEAD" && !notModified)
 	if err != nil {
-		return resp
+		return nil
 	}
+	switch {
+	case notModified:
+		resp.StatusCode = 304
+		resp.StatusText = "Not Modified"
+		resp.Header.Del("Content-Length")
+	case e.StatusCode == 200:
+		resp.Header.Set("Accept-Ranges", "bytes")
+	}
+	removeSurrogateKeys(resp.Header)
+	resp.Header.Set("X-Cache", status)
+	return resp
+}
 
-	newResp := *resp
-	newResp.Body = nil
+// coalesce fetches the response, collapsing concurrent fetches of the key.
+// Requests waiting on another fetch are served its stored response, or
+// fetch individually if it was not stored or the wait times out.
+func (c *Cache) coalesce(ctx context.Context, key string, r *http.Request, e *CacheEntry, now time.Time) *http.Response {
+	c.mu.Lock()
+	done, ok := c.calls[key]
+	if !ok {
+		done = make(chan struct{})
+		c.calls[key] = done
+		c.mu.Unlock()
 
-	c.cache.Set(key, cacheItem{
-		Response: newResp,
-		Body:     body,
-	}, cache.DefaultExpiration)
+		defer func() {
+			c.mu.Lock()
+			delete(c.calls, key)
+			c.mu.Unlock()
+			close(done)
+		}()
 
+		return c.fetch(ctx, key, r, e, now)
+	}
+	c.mu.Unlock()
+
+	timer := time.NewTimer(c.coalesceTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		now = time.Now()
+		if stored, ok := c.lookup(key, r); ok && stored.age(now) < stored.Lifetime {
+			if resp := c.serve(r, stored, now, "HIT"); resp != nil {
+				return resp
+			}
+		}
+	case <-timer.C:
+		now = time.Now()
+	}
+
+	return c.fetch(ctx, key, r, e, now)
+}
+
+// fetch fetches the response from the handler, storing it if possible.
+// If there is a stale entry, it is revalidated.
+func (c *Cache) fetch(ctx context.Context, key string, r *http.Request, e *CacheEntry, now time.Time) *http.Response {
+	// Client conditionals are answered from the cache, so the
+	// handler only sees the validators of the stale entry.
+	req := cloneRequest(r)
+	for _, k := range conditionalHeaders {
+		req.Header.Del(k)
+	}
+	if e != nil {
+		if etag := e.Header.Get("Etag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lm := e.Header.Get("Last-Modified"); lm != "" {
+			req.Header.Set("If-Modified-Since", lm)
+		}
+	}
+
+	resp := c.h.ServeHTTP(ctx, req)
+
+	switch {
+	case e != nil && resp.StatusCode == 304 && e.hasValidators():
+		if resp := c.serve(r, c.refresh(key, r, e, resp, now), now, "REVALIDATED"); resp != nil {
+			return resp
+		}
+		return c.fetch(ctx, key, r, nil, now)
+
+	case e != nil && isServerError(resp) && e.age(now) < e.Lifetime+e.StaleIfError:
+		if stale := c.serve(r, e, now, "STALE"); stale != nil {
+			return stale
+		}
+	}
+
+	if r.Method != "GET" || !c.shouldCache(r, resp) {
+		return c.miss(resp)
+	}
+
+	body, ok, err := c.readBody(resp)
+	if err != nil {
+		return &http.Response{StatusCode: 502, StatusText: "Bad Gateway", Error: err}
+	}
+	if !ok {
+		return c.miss(resp)
+	}
+
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	resp.Header.Del("Transfer-Encoding")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	// Conditional and range requests are answered from the stored response.
+	stored := c.newEntry(resp, body, now)
+	if c.save(key, r, stored) && (isNotModified(r.Header, stored.Header) || isRangeRequest(r, stored)) {
+		return c.serve(r, stored, now, "MISS")
+	}
+
+	return c.miss(resp)
+}
+
+// miss prepares a response that is not served from the cache.
+func (c *Cache) miss(resp *http.Response) *http.Response {
+	if len(resp.Header) == 0 {
+		return resp
+	}
+
+	removeSurrogateKeys(resp.Header)
+	resp.Header.Set("X-Cache", "MISS")
 	return resp
 }
 
-func (c *Cache) cacheKey(req *http.Request) string {
-	return req.Host + req.URL.String()
+// revalidateAsync revalidates the entry in the background, once per key.
+func (c *Cache) revalidateAsync(key string, r *http.Request, e *CacheEntry) {
+	c.mu.Lock()
+	if c.revalidating[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[key] = true
+	c.mu.Unlock()
+
+	req := cloneRequest(r)
+	req.Body = nil
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.revalidating, key)
+			c.mu.Unlock()
+		}()
+
+		resp := c.fetch(context.Background(), key, req, e, time.Now())
+		if resp.Body != nil {
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+		}
+	}()
+}
+
+// cloneRequest copies the request, so the handler may modify its
+// header and url without affecting the original request.
+func cloneRequest(r *http.Request) *http.Request {
+	req := &http.Request{}
+	*req = *r
+	req.Header = cloneHeader(r.Header)
+	if r.URL != nil {
+		u := *r.URL
+		req.URL = &u
+	}
+	return req
+}
+
+// refresh updates the entry with the headers of a 304 response.
+func (c *Cache) refresh(key string, r *http.Request, e *CacheEntry, resp *http.Response, now time.Time) *CacheEntry {
+	h := cloneHeader(e.Header)
+	for k, v := range resp.Header {
+		switch k {
+		case "Content-Length", "Transfer-Encoding", "Content-Encoding", "X-Cache":
+			continue
+		}
+		h[k] = append([]string(nil), v...)
+	}
+
+	updated := &http.Response{
+		StatusCode: e.StatusCode,
+		StatusText: e.StatusText,
+		Proto:      e.Proto,
+		Header:     h,
+	}
+	ne := c.newEntry(updated, e.Body, now)
+	ne.Open = e.Open
+	if c.save(key, r, ne) {
+		// The store may have moved the body, so the entry is served as stored.
+		if stored, ok := c.lookup(key, r); ok {
+			return stored
+		}
+	}
+	return ne
+}
+
+// variantKey returns the key of the request variant for the vary fields.
+func (c *Cache) variantKey(key string, req *http.Request, fields []string) string {
+	if len(fields) == 0 {
+		return key
+	}
+
+	var b strings.Builder
+	b.WriteString(key)
+	for _, f := range fields {
+		v := strings.Join(req.Header[f], ",")
+		if f == "Accept-Encoding" {
+			v = normalizeAcceptEncoding(v)
+		}
+		b.WriteString("|" + f + "=" + keyEscaper.Replace(v))
+	}
+	return b.String()
+}
+
+func (c *Cache) lookup(key string, r *http.Request) (*CacheEntry, bool) {
+	e, ok := c.store.Get(key)
+	if !ok || len(e.Vary) == 0 {
+		return e, ok
+	}
+
+	return c.store.Get(c.variantKey(key, r, e.Vary))
+}
+
+// newEntry returns a cache entry for the response.
+func (c *Cache) newEntry(resp *http.Response, body []byte, now time.Time) *CacheEntry {
+	e := &CacheEntry{
+		StatusCode: resp.StatusCode,
+		StatusText: resp.StatusText,
+		Proto:      resp.Proto,
+		Header:     cloneHeader(resp.Header),
+		Body:       body,
+		Stored:     now,
+		Lifetime:   c.lifetime(resp, now),
+	}
+	if age, err := strconv.Atoi(resp.Header.Get("Age")); err == nil && age > 0 {
+		e.Age = time.Duration(age) * time.Second
+	}
+	e.Header.Del("Age")
+	e.Header.Del("X-Cache")
+
+	if !c.ignoreHeaders {
+		cc := parseCacheControl(resp.Header)
+		if !cc.has("must-revalidate") && !cc.has("proxy-revalidate") {
+			e.StaleWhileRevalidate, _ = cc.duration("stale-while-revalidate")
+			e.StaleIfError, _ = cc.duration("stale-if-error")
+		}
+	}
+
+	return e
+}
+
+// save stores the entry, returning false if it cannot be stored.
+func (c *Cache) save(key string, r *http.Request, e *CacheEntry) bool {
+	// Stale entries are kept while they can still be served,
+	// or revalidated if they have validators.
+	stale := e.StaleWhileRevalidate
+	if e.StaleIfError > stale {
+		stale = e.StaleIfError
+	}
+	if e.hasValidators() && c.staleTTL > stale {
+		stale = c.staleTTL
+	}
+
+	ttl := e.Lifetime - e.Age + stale
+	if ttl <= 0 {
+		return false
+	}
+
+	fields := varyFields(e.Header)
+	if len(fields) > 0 {
+		c.store.Set(key, &CacheEntry{Vary: fields}, ttl)
+	}
+	c.store.Set(c.variantKey(key, r, fields), e, ttl)
+	return true
 }
 
 func (c *Cache) shouldCache(req *http.Request, resp *http.Response) bool {
+	// Partial responses are passed through, ranges are served
+	// from complete responses.
+	if resp.StatusCode == 206 {
+		return false
+	}
+
 	if c.ignoreHeaders {
-		return true
+		return cacheableStatuses[resp.StatusCode]
 	}
 
-	cc := strings.ToLower(req.Header.Get(cacheControl))
-	if slices.StringContains(cc, cacheControlNoCache) {
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	// Responses with no-cache can only be stored for revalidation.
+	if cc.has("no-cache") && !hasValidators(resp.Header) {
+		return false
+	}
+	if resp.Header.Get("Set-Cookie") != "" {
 		return false
 	}
 
-	cc = strings.ToLower(resp.Header.Get(cacheControl))
-	if slices.StringContains(cc, cacheControlNoCache) {
+	// Vary: * never matches a later request.
+	for _, f := range varyFields(resp.Header) {
+		if f == "*" {
+			return false
+		}
+	}
+
+	// Authorized responses are only cached if explicitly allowed.
+	if req.Header.Get("Authorization") != "" &&
+		!cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
 		return false
 	}
 
-	return resp.Header.Get("Set-Cookie") == ""
+	if cacheableStatuses[resp.StatusCode] {
+		return true
+	}
+	// Other statuses are only cached with explicit freshness.
+	return cc.has("public") || cc.has("s-maxage") || cc.has("max-age") || resp.Header.Get("Expires") != ""
+}
+
+// lifetime returns the freshness lifetime of the response.
+func (c *Cache) lifetime(resp *http.Response, now time.Time) time.Duration {
+	if c.ignoreHeaders {
+		return c.expiry
+	}
+
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-cache") {
+		return 0
+	}
+	if d, ok := cc.duration("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.duration("max-age"); ok {
+		return d
+	}
+
+	if exp := resp.Header.Get("Expires"); exp != "" {
+		t, err := parseHTTPDate(exp)
+		if err != nil {
+			// Invalid dates represent a time in the past.
+			return 0
+		}
+
+		date := now
+		if d, err := parseHTTPDate(resp.Header.Get("Date")); err == nil {
+			date = d
+		}
+		return t.Sub(date)
+	}
+
+	return c.expiry
 }
 
-func (c *Cache) readBody(resp *http.Response) ([]byte, error) {
+// readBody reads the response body, returning false if the
+// body is larger than the maximum object size.
+func (c *Cache) readBody(resp *http.Response) ([]byte, bool, error) {
 	if resp.Body == nil {
-		return nil, nil
+		return nil, true, nil
+	}
+
+	if c.maxObjectSize > 0 {
+		if n, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil && n > c.maxObjectSize {
+			return nil, false, nil
+		}
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	src := resp.Body
+	if c.maxObjectSize > 0 {
+		src = io.LimitReader(resp.Body, c.maxObjectSize+1)
+	}
+	body, err := ioutil.ReadAll(src)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+
+	if c.maxObjectSize > 0 && int64(len(body)) > c.maxObjectSize {
+		resp.Body = io.MultiReader(bytes.NewReader(body), resp.Body)
+		return nil, false, nil
 	}
 
 	if seeker, ok := resp.Body.(io.Seeker); ok {
 		_, err := seeker.Seek(0, io.SeekStart)
 		if err == nil {
-			return body, nil
+			return body, true, nil
 		}
 	}
 
 	resp.Body = bytes.NewReader(body)
-	return body, nil
+	return body, true, nil
+}
+
+// cacheControl contains parsed Cache-Control directives.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, line := range h["Cache-Control"] {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+
+			name, val := part, ""
+			if i := strings.Index(part, "="); i >= 0 {
+				name, val = part[:i], strings.Trim(part[i+1:], `"`)
+			}
+			cc[strings.ToLower(name)] = val
+		}
+	}
+	return cc
+}
+
+// has determines if the directive is set. A directive like
+// "max-age=0" also matches on its value.
+func (cc cacheControl) has(directive string) bool {
+	if i := strings.Index(directive, "="); i >= 0 {
+		v, ok := cc[directive[:i]]
+		return ok && v == directive[i+1:]
+	}
+
+	_, ok := cc[directive]
+	return ok
+}
+
+// duration returns the directive value as a duration in seconds.
+func (cc cacheControl) duration(directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// varyFields returns the canonical, sorted fields of the Vary header.
+func varyFields(h http.Header) []string {
+	var fields []string
+	for _, line := range h["Vary"] {
+		for _, f := range strings.Split(line, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				fields = append(fields, http.CanonicalHeaderKey(f))
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func normalizeAcceptEncoding(accept string) string {
+	if accept == "" {
+		return ""
+	}
+
+	encs := strings.Split(strings.ToLower(accept), ",")
+	for i, enc := range encs {
+		encs[i] = strings.Replace(enc, " ", "", -1)
+	}
+	sort.Strings(encs)
+	return strings.Join(encs, ",")
+}
+
+func hasValidators(h http.Header) bool {
+	return h.Get("Etag") != "" || h.Get("Last-Modified") != ""
+}
+
+// isNotModified determines if the conditional request matches
+// the response validators.
+func isNotModified(req, resp http.Header) bool {
+	if inm := req.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(resp.Get("Etag"), "W/")
+		if etag == "" {
+			return false
+		}
+
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := req.Get("If-Modified-Since"); ims != "" {
+		t, err := parseHTTPDate(ims)
+		if err != nil {
+			return false
+		}
+		lm, err := parseHTTPDate(resp.Get("Last-Modified"))
+		if err != nil {
+			return false
+		}
+		return !lm.After(t)
+	}
+
+	return false
+}
+
+func isServerError(resp *http.Response) bool {
+	return resp.Error != nil || resp.StatusCode >= 500
+}
+
+var httpDateFormats = []string{
+	time.RFC1123,
+	time.RFC850,
+	time.ANSIC,
+}
+
+func parseHTTPDate(s string) (time.Time, error) {
+	var err error
+	for _, layout := range httpDateFormats {
+		var t time.Time
+		if t, err = time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
 }
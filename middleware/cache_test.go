@@ -5,6 +5,9 @@ import (
 	"context"
 	"io/ioutil"
 	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -48,6 +51,10 @@ func TestCache_ServeHTTP(t *testing.T) {
 	want := &http.Response{
 		StatusCode: 200,
 		StatusText: "OK",
+		Header: http.Header{
+			"Content-Length": []string{"4"},
+			"X-Cache":        []string{"MISS"},
+		},
 	}
 	assert.Equal(t, want, resp)
 
@@ -57,6 +64,12 @@ func TestCache_ServeHTTP(t *testing.T) {
 	body, _ = ioutil.ReadAll(resp.Body)
 	assert.Equal(t, []byte("test"), body)
 	resp.Body = nil
+	want.Header = http.Header{
+		"Accept-Ranges":  []string{"bytes"},
+		"Age":            []string{"0"},
+		"Content-Length": []string{"4"},
+		"X-Cache":        []string{"HIT"},
+	}
 	assert.Equal(t, want, resp)
 
 	assert.Equal(t, 1, count)
@@ -134,3 +147,597 @@ func TestCache_ServeHTTPIgnoresHeaders(t *testing.T) {
 
 	assert.Equal(t, 1, count)
 }
+
+func TestCache_ServeHTTPCacheability(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		reqHeader http.Header
+		status    int
+		header    http.Header
+		wantCalls int
+	}{
+		{
+			name:      "Cacheable",
+			method:    "GET",
+			status:    200,
+			header:    http.Header{"Cache-Control": []string{"max-age=60"}},
+			wantCalls: 1,
+		},
+		{
+			name:      "Default Expiry",
+			method:    "GET",
+			status:    404,
+			header:    http.Header{},
+			wantCalls: 1,
+		},
+		{
+			name:      "POST",
+			method:    "POST",
+			status:    200,
+			header:    http.Header{"Cache-Control": []string{"max-age=60"}},
+			wantCalls: 2,
+		},
+		{
+			name:      "Server Error",
+			method:    "GET",
+			status:    500,
+			header:    http.Header{},
+			wantCalls: 2,
+		},
+		{
+			name:      "Explicit Server Error",
+			method:    "GET",
+			status:    500,
+			header:    http.Header{"Cache-Control": []string{"s-maxage=60"}},
+			wantCalls: 1,
+		},
+		{
+			name:      "Private",
+			method:    "GET",
+			status:    200,
+			header:    http.Header{"Cache-Control": []string{"private, max-age=60"}},
+			wantCalls: 2,
+		},
+		{
+			name:      "Max Age Zero",
+			method:    "GET",
+			status:    200,
+			header:    http.Header{"Cache-Control": []string{"max-age=0"}},
+			wantCalls: 2,
+		},
+		{
+			name:      "S-Maxage Precedence",
+			method:    "GET",
+			status:    200,
+			header:    http.Header{"Cache-Control": []string{"max-age=60, s-maxage=0"}},
+			wantCalls: 2,
+		},
+		{
+			name:      "Expires",
+			method:    "GET",
+			status:    200,
+			header:    http.Header{"Expires": []string{time.Now().Add(time.Minute).UTC().Format(time.RFC1123)}},
+			wantCalls: 1,
+		},
+		{
+			name:      "Expired",
+			method:    "GET",
+			status:    200,
+			header:    http.Header{"Expires": []string{time.Now().Add(-time.Minute).UTC().Format(time.RFC1123)}},
+			wantCalls: 2,
+		},
+		{
+			name:      "Authorization",
+			method:    "GET",
+			reqHeader: http.Header{"Authorization": []string{"Bearer token"}},
+			status:    200,
+			header:    http.Header{"Cache-Control": []string{"max-age=60"}},
+			wantCalls: 2,
+		},
+		{
+			name:      "Authorization Public",
+			method:    "GET",
+			reqHeader: http.Header{"Authorization": []string{"Bearer token"}},
+			status:    200,
+			header:    http.Header{"Cache-Control": []string{"public, max-age=60"}},
+			wantCalls: 1,
+		},
+		{
+			name:      "Vary All",
+			method:    "GET",
+			status:    200,
+			header:    http.Header{"Cache-Control": []string{"max-age=60"}, "Vary": []string{"*"}},
+			wantCalls: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqHeader := tt.reqHeader
+			if reqHeader == nil {
+				reqHeader = http.Header{}
+			}
+			req := &http.Request{
+				Method: tt.method,
+				URL:    &url.URL{Path: "/test"},
+				Host:   "localhost",
+				Header: reqHeader,
+			}
+
+			calls := 0
+			cache := middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+				calls++
+
+				return &http.Response{
+					StatusCode: tt.status,
+					Header:     cloneHeader(tt.header),
+					Body:       bytes.NewReader([]byte("test")),
+				}
+			}), middleware.CacheOpts{Expiry: time.Minute})
+
+			_ = cache.ServeHTTP(context.Background(), req)
+			_ = cache.ServeHTTP(context.Background(), req)
+
+			assert.Equal(t, tt.wantCalls, calls)
+		})
+	}
+}
+
+func TestCache_ServeHTTPVary(t *testing.T) {
+	calls := 0
+	cache := middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		calls++
+
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header: http.Header{
+				"Cache-Control": []string{"max-age=60"},
+				"Vary":          []string{"Accept-Language"},
+			},
+			Body: bytes.NewReader([]byte(r.Header.Get("Accept-Language"))),
+		}
+	}), middleware.CacheOpts{})
+
+	newReq := func(lang string) *http.Request {
+		return &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Path: "/test"},
+			Host:   "localhost",
+			Header: http.Header{"Accept-Language": []string{lang}},
+		}
+	}
+
+	for _, lang := range []string{"en", "nl", "en", "nl"} {
+		resp := cache.ServeHTTP(context.Background(), newReq(lang))
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, lang, string(body))
+	}
+	assert.Equal(t, 2, calls)
+}
+
+func TestCache_ServeHTTPAge(t *testing.T) {
+	cache := middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header: http.Header{
+				"Cache-Control": []string{"max-age=60"},
+				"Age":           []string{"10"},
+			},
+			Body: bytes.NewReader([]byte("test")),
+		}
+	}), middleware.CacheOpts{})
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Host:   "localhost",
+		Header: http.Header{},
+	}
+
+	resp := cache.ServeHTTP(context.Background(), req)
+	assert.Equal(t, "MISS", resp.Header.Get("X-Cache"))
+
+	resp = cache.ServeHTTP(context.Background(), req)
+	assert.Equal(t, "HIT", resp.Header.Get("X-Cache"))
+	age, _ := strconv.Atoi(resp.Header.Get("Age"))
+	assert.InDelta(t, 10, age, 1)
+}
+
+func TestCache_ServeHTTPRevalidates(t *testing.T) {
+	var inm []string
+	cache := middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		inm = append(inm, r.Header.Get("If-None-Match"))
+
+		if r.Header.Get("If-None-Match") == `"abc"` {
+			return &http.Response{
+				StatusCode: 304,
+				StatusText: "Not Modified",
+				Header: http.Header{
+					"Cache-Control": []string{"max-age=60"},
+					"Etag":          []string{`"abc"`},
+				},
+			}
+		}
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header: http.Header{
+				"Cache-Control": []string{"max-age=0"},
+				"Etag":          []string{`"abc"`},
+			},
+			Body: bytes.NewReader([]byte("test")),
+		}
+	}), middleware.CacheOpts{})
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Host:   "localhost",
+		Header: http.Header{},
+	}
+
+	resp := cache.ServeHTTP(context.Background(), req)
+	assert.Equal(t, "MISS", resp.Header.Get("X-Cache"))
+
+	resp = cache.ServeHTTP(context.Background(), req)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "REVALIDATED", resp.Header.Get("X-Cache"))
+	assert.Equal(t, "max-age=60", resp.Header.Get("Cache-Control"))
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "test", string(body))
+
+	resp = cache.ServeHTTP(context.Background(), req)
+	assert.Equal(t, "HIT", resp.Header.Get("X-Cache"))
+	assert.Equal(t, []string{"", `"abc"`}, inm)
+}
+
+func TestCache_ServeHTTPConditionalRequests(t *testing.T) {
+	var inm []string
+	cache := middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		inm = append(inm, r.Header.Get("If-None-Match"))
+
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header: http.Header{
+				"Cache-Control": []string{"max-age=60"},
+				"Etag":          []string{`"abc"`},
+				"Last-Modified": []string{"Mon, 02 Jan 2006 15:04:05 GMT"},
+			},
+			Body: bytes.NewReader([]byte("test")),
+		}
+	}), middleware.CacheOpts{})
+
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+		cache  string
+	}{
+		{
+			name:   "Miss If-None-Match",
+			header: http.Header{"If-None-Match": []string{`"abc"`}},
+			status: 304,
+			cache:  "MISS",
+		},
+		{
+			name:   "Hit If-None-Match",
+			header: http.Header{"If-None-Match": []string{`"xyz", W/"abc"`}},
+			status: 304,
+			cache:  "HIT",
+		},
+		{
+			name:   "Hit If-None-Match Star",
+			header: http.Header{"If-None-Match": []string{"*"}},
+			status: 304,
+			cache:  "HIT",
+		},
+		{
+			name:   "Hit If-None-Match Changed",
+			header: http.Header{"If-None-Match": []string{`"xyz"`}},
+			status: 200,
+			cache:  "HIT",
+		},
+		{
+			name:   "Hit If-Modified-Since",
+			header: http.Header{"If-Modified-Since": []string{"Mon, 02 Jan 2006 15:04:05 GMT"}},
+			status: 304,
+			cache:  "HIT",
+		},
+		{
+			name:   "Hit If-Modified-Since Modified",
+			header: http.Header{"If-Modified-Since": []string{"Sun, 01 Jan 2006 15:04:05 GMT"}},
+			status: 200,
+			cache:  "HIT",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/test"},
+				Host:   "localhost",
+				Header: tt.header,
+			}
+
+			resp := cache.ServeHTTP(context.Background(), req)
+
+			assert.Equal(t, tt.status, resp.StatusCode)
+			assert.Equal(t, tt.cache, resp.Header.Get("X-Cache"))
+			if tt.status == 304 {
+				assert.Nil(t, resp.Body)
+				assert.Equal(t, `"abc"`, resp.Header.Get("Etag"))
+			}
+		})
+	}
+
+	assert.Equal(t, []string{""}, inm)
+}
+
+func TestCache_ServeHTTPStaleWhileRevalidate(t *testing.T) {
+	calls := make(chan struct{}, 2)
+	cache := middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		calls <- struct{}{}
+
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header: http.Header{
+				"Cache-Control": []string{"max-age=0, stale-while-revalidate=60"},
+			},
+			Body: bytes.NewReader([]byte("test")),
+		}
+	}), middleware.CacheOpts{})
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Host:   "localhost",
+		Header: http.Header{},
+	}
+
+	resp := cache.ServeHTTP(context.Background(), req)
+	assert.Equal(t, "MISS", resp.Header.Get("X-Cache"))
+	<-calls
+
+	resp = cache.ServeHTTP(context.Background(), req)
+	assert.Equal(t, "STALE", resp.Header.Get("X-Cache"))
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "test", string(body))
+
+	select {
+	case <-calls:
+	case <-time.After(time.Second):
+		t.Fatal("expected background revalidation")
+	}
+}
+
+func TestCache_ServeHTTPDoesNotShareURLWithHandler(t *testing.T) {
+	calls := make(chan struct{}, 2)
+	cache := middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		// Inner middleware, such as rewrite, may modify the url.
+		r.URL.Path = "/rewritten"
+		calls <- struct{}{}
+
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header: http.Header{
+				"Cache-Control": []string{"max-age=0, stale-while-revalidate=60"},
+			},
+			Body: bytes.NewReader([]byte("test")),
+		}
+	}), middleware.CacheOpts{})
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Host:   "localhost",
+		Header: http.Header{},
+	}
+
+	_ = cache.ServeHTTP(context.Background(), req)
+	<-calls
+	assert.Equal(t, "/test", req.URL.Path)
+
+	resp := cache.ServeHTTP(context.Background(), req)
+	assert.Equal(t, "STALE", resp.Header.Get("X-Cache"))
+	assert.Equal(t, "/test", req.URL.Path)
+
+	select {
+	case <-calls:
+	case <-time.After(time.Second):
+		t.Fatal("expected background revalidation")
+	}
+	assert.Equal(t, "/test", req.URL.Path)
+}
+
+func TestCache_ServeHTTPStaleIfError(t *testing.T) {
+	calls := 0
+	cache := middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		calls++
+
+		if calls > 1 {
+			return &http.Response{StatusCode: 503, StatusText: "Service Unavailable"}
+		}
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header: http.Header{
+				"Cache-Control": []string{"max-age=0, stale-if-error=60"},
+			},
+			Body: bytes.NewReader([]byte("test")),
+		}
+	}), middleware.CacheOpts{})
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Host:   "localhost",
+		Header: http.Header{},
+	}
+
+	resp := cache.ServeHTTP(context.Background(), req)
+	assert.Equal(t, "MISS", resp.Header.Get("X-Cache"))
+
+	resp = cache.ServeHTTP(context.Background(), req)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "STALE", resp.Header.Get("X-Cache"))
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "test", string(body))
+	assert.Equal(t, 2, calls)
+}
+
+func TestCache_ServeHTTPCoalescesMisses(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+	cache := middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+			<-release
+		}
+
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header:     http.Header{"Cache-Control": []string{"max-age=60"}},
+			Body:       bytes.NewReader([]byte("test")),
+		}
+	}), middleware.CacheOpts{})
+	newReq := func() *http.Request {
+		return &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Path: "/test"},
+			Host:   "localhost",
+			Header: http.Header{},
+		}
+	}
+
+	var wg sync.WaitGroup
+	bodies := make(chan string, 5)
+	serve := func() {
+		defer wg.Done()
+		resp := cache.ServeHTTP(context.Background(), newReq())
+		body, _ := ioutil.ReadAll(resp.Body)
+		bodies <- string(body)
+	}
+
+	wg.Add(1)
+	go serve()
+	<-started
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go serve()
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	close(release)
+	wg.Wait()
+	close(bodies)
+	for body := range bodies {
+		assert.Equal(t, "test", body)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestCache_ServeHTTPCoalesceTimeout(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	cache := middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+			<-release
+		}
+
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header:     http.Header{"Cache-Control": []string{"max-age=60"}},
+			Body:       bytes.NewReader([]byte("test")),
+		}
+	}), middleware.CacheOpts{CoalesceTimeout: 10 * time.Millisecond})
+	newReq := func() *http.Request {
+		return &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Path: "/test"},
+			Host:   "localhost",
+			Header: http.Header{},
+		}
+	}
+
+	go cache.ServeHTTP(context.Background(), newReq())
+	<-started
+
+	resp := cache.ServeHTTP(context.Background(), newReq())
+
+	assert.Equal(t, "MISS", resp.Header.Get("X-Cache"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestCache_ServeHTTPMaxObjectSize(t *testing.T) {
+	calls := 0
+	cache := middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		calls++
+
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header:     http.Header{"Cache-Control": []string{"max-age=60"}},
+			Body:       bytes.NewReader([]byte("test")),
+		}
+	}), middleware.CacheOpts{MaxObjectSize: 3})
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Host:   "localhost",
+		Header: http.Header{},
+	}
+
+	for i := 0; i < 2; i++ {
+		resp := cache.ServeHTTP(context.Background(), req)
+
+		assert.Equal(t, "MISS", resp.Header.Get("X-Cache"))
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "test", string(body))
+	}
+	assert.Equal(t, 2, calls)
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := http.Header{}
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+func TestCache_Stats(t *testing.T) {
+	cache := middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header:     http.Header{"Cache-Control": []string{"max-age=60"}},
+			Body:       bytes.NewReader([]byte("test")),
+		}
+	}), middleware.CacheOpts{})
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Host:   "localhost",
+		Header: http.Header{},
+	}
+
+	for i := 0; i < 2; i++ {
+		resp := cache.ServeHTTP(context.Background(), req)
+		_, _ = ioutil.ReadAll(resp.Body)
+	}
+
+	got := cache.Stats()
+
+	assert.Equal(t, 1, got.Entries)
+	assert.Equal(t, int64(1), got.Hits)
+	assert.True(t, got.Bytes > 0)
+}
@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/nrwiersma/proxy/http"
+)
+
+// CacheKeyOpts configures the composition of cache keys.
+//
+// Keys always contain the request host and path.
+type CacheKeyOpts struct {
+	// IncludeQuery are the query parameters in the key. A parameter
+	// may contain a "*" wildcard like "utm_*". If empty, all
+	// parameters are included.
+	IncludeQuery []string
+
+	// ExcludeQuery are the query parameters left out of the key.
+	// A parameter may contain a "*" wildcard.
+	ExcludeQuery []string
+
+	// SortQuery sorts the query parameters, so their order
+	// does not matter.
+	SortQuery bool
+
+	// Headers are the request headers in the key.
+	Headers []string
+
+	// Cookies are the request cookies in the key.
+	Cookies []string
+
+	// Method adds the request method to the key.
+	Method bool
+
+	// DeviceClass adds the client device class to the key. The class
+	// is "mobile", "tablet" or "desktop", based on the User-Agent header.
+	DeviceClass bool
+}
+
+// keyEscaper escapes the "|" separating key parts.
+var keyEscaper = strings.NewReplacer("%", "%25", "|", "%7C")
+
+// baseKey returns the key of the request URL, the host followed by
+// the path and query. The scheme and host of absolute request URIs
+// are left out, so the key does not depend on the request form.
+func (c *Cache) baseKey(r *http.Request) string {
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	query := r.URL.RawQuery
+	opts := c.keyOpts
+	if len(opts.IncludeQuery) > 0 || len(opts.ExcludeQuery) > 0 || opts.SortQuery {
+		query = c.keyQuery(query)
+	}
+	if query == "" {
+		return r.Host + path
+	}
+	// The query is already escaped, so only the separator is.
+	return r.Host + path + "?" + strings.Replace(query, "|", "%7C", -1)
+}
+
+// primaryKey returns the key of the request, without its variants.
+func (c *Cache) primaryKey(r *http.Request) string {
+	opts := c.keyOpts
+
+	var b strings.Builder
+	b.WriteString(c.baseKey(r))
+	if opts.Method {
+		b.WriteString("|method=" + r.Method)
+	}
+	for _, h := range opts.Headers {
+		b.WriteString("|header:" + h + "=" + keyEscaper.Replace(strings.Join(r.Header[http.CanonicalHeaderKey(h)], ",")))
+	}
+	for _, name := range opts.Cookies {
+		v, _ := readCookie(r.Header, name)
+		b.WriteString("|cookie:" + name + "=" + keyEscaper.Replace(v))
+	}
+	if opts.DeviceClass {
+		b.WriteString("|device=" + DeviceClass(r.Header.Get("User-Agent")))
+	}
+	return b.String()
+}
+
+// keyQuery returns the query of the key.
+func (c *Cache) keyQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+
+	var params []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+
+		name := param
+		if i := strings.Index(param, "="); i >= 0 {
+			name = param[:i]
+		}
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+
+		if len(c.keyOpts.IncludeQuery) > 0 && !matchAnyWildcard(c.keyOpts.IncludeQuery, name) {
+			continue
+		}
+		if matchAnyWildcard(c.keyOpts.ExcludeQuery, name) {
+			continue
+		}
+		params = append(params, param)
+	}
+
+	if c.keyOpts.SortQuery {
+		sort.Strings(params)
+	}
+	return strings.Join(params, "&")
+}
+
+func matchAnyWildcard(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if matchWildcard(p, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// DeviceClass returns the device class of the user agent, either
+// "mobile", "tablet" or "desktop".
+func DeviceClass(ua string) string {
+	ua = strings.ToLower(ua)
+
+	switch {
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet") ||
+		strings.Contains(ua, "android") && !strings.Contains(ua, "mobile"):
+		return "tablet"
+
+	case strings.Contains(ua, "mobi") || strings.Contains(ua, "iphone") ||
+		strings.Contains(ua, "ipod") || strings.Contains(ua, "android"):
+		return "mobile"
+
+	default:
+		return "desktop"
+	}
+}
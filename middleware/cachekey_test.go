@@ -0,0 +1,157 @@
+package middleware_test
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache_ServeHTTPKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     middleware.CacheKeyOpts
+		first   *http.Request
+		second  *http.Request
+		wantHit bool
+	}{
+		{
+			name:    "Default Query",
+			first:   &http.Request{URL: &url.URL{Path: "/test", RawQuery: "a=1&b=2"}},
+			second:  &http.Request{URL: &url.URL{Path: "/test", RawQuery: "b=2&a=1"}},
+			wantHit: false,
+		},
+		{
+			name:    "Sort Query",
+			key:     middleware.CacheKeyOpts{SortQuery: true},
+			first:   &http.Request{URL: &url.URL{Path: "/test", RawQuery: "a=1&b=2"}},
+			second:  &http.Request{URL: &url.URL{Path: "/test", RawQuery: "b=2&a=1"}},
+			wantHit: true,
+		},
+		{
+			name:    "Exclude Query",
+			key:     middleware.CacheKeyOpts{ExcludeQuery: []string{"utm_*", "fbclid"}},
+			first:   &http.Request{URL: &url.URL{Path: "/test", RawQuery: "a=1&utm_source=x&fbclid=y"}},
+			second:  &http.Request{URL: &url.URL{Path: "/test", RawQuery: "a=1&utm_medium=z"}},
+			wantHit: true,
+		},
+		{
+			name:    "Exclude Query Keeps Others",
+			key:     middleware.CacheKeyOpts{ExcludeQuery: []string{"utm_*"}},
+			first:   &http.Request{URL: &url.URL{Path: "/test", RawQuery: "a=1"}},
+			second:  &http.Request{URL: &url.URL{Path: "/test", RawQuery: "a=2"}},
+			wantHit: false,
+		},
+		{
+			name:    "Include Query",
+			key:     middleware.CacheKeyOpts{IncludeQuery: []string{"page"}},
+			first:   &http.Request{URL: &url.URL{Path: "/test", RawQuery: "page=1&session=a"}},
+			second:  &http.Request{URL: &url.URL{Path: "/test", RawQuery: "session=b&page=1"}},
+			wantHit: true,
+		},
+		{
+			name: "Headers",
+			key:  middleware.CacheKeyOpts{Headers: []string{"x-tenant"}},
+			first: &http.Request{
+				URL:    &url.URL{Path: "/test"},
+				Header: http.Header{"X-Tenant": []string{"a"}},
+			},
+			second: &http.Request{
+				URL:    &url.URL{Path: "/test"},
+				Header: http.Header{"X-Tenant": []string{"b"}},
+			},
+			wantHit: false,
+		},
+		{
+			name: "Cookies",
+			key:  middleware.CacheKeyOpts{Cookies: []string{"lang"}},
+			first: &http.Request{
+				URL:    &url.URL{Path: "/test"},
+				Header: http.Header{"Cookie": []string{"lang=en; session=a"}},
+			},
+			second: &http.Request{
+				URL:    &url.URL{Path: "/test"},
+				Header: http.Header{"Cookie": []string{"session=b; lang=en"}},
+			},
+			wantHit: true,
+		},
+		{
+			name: "Cookies Differ",
+			key:  middleware.CacheKeyOpts{Cookies: []string{"lang"}},
+			first: &http.Request{
+				URL:    &url.URL{Path: "/test"},
+				Header: http.Header{"Cookie": []string{"lang=en"}},
+			},
+			second: &http.Request{
+				URL:    &url.URL{Path: "/test"},
+				Header: http.Header{"Cookie": []string{"lang=nl"}},
+			},
+			wantHit: false,
+		},
+		{
+			name: "Device Class",
+			key:  middleware.CacheKeyOpts{DeviceClass: true},
+			first: &http.Request{
+				URL:    &url.URL{Path: "/test"},
+				Header: http.Header{"User-Agent": []string{"Mozilla/5.0 (iPhone; CPU iPhone OS 13_0 like Mac OS X) Mobile/15E148"}},
+			},
+			second: &http.Request{
+				URL:    &url.URL{Path: "/test"},
+				Header: http.Header{"User-Agent": []string{"Mozilla/5.0 (Windows NT 10.0; Win64; x64)"}},
+			},
+			wantHit: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+				return &http.Response{
+					StatusCode: 200,
+					StatusText: "OK",
+					Header:     http.Header{"Cache-Control": []string{"max-age=60"}},
+					Body:       bytes.NewReader([]byte("test")),
+				}
+			}), middleware.CacheOpts{Key: tt.key})
+
+			for _, req := range []*http.Request{tt.first, tt.second} {
+				req.Method = "GET"
+				req.Host = "localhost"
+				if req.Header == nil {
+					req.Header = http.Header{}
+				}
+			}
+
+			_ = cache.ServeHTTP(context.Background(), tt.first)
+			resp := cache.ServeHTTP(context.Background(), tt.second)
+
+			assert.Equal(t, tt.wantHit, resp.Header.Get("X-Cache") == "HIT")
+		})
+	}
+}
+
+func TestDeviceClass(t *testing.T) {
+	tests := []struct {
+		ua   string
+		want string
+	}{
+		{ua: "Mozilla/5.0 (iPhone; CPU iPhone OS 13_0 like Mac OS X) Mobile/15E148", want: "mobile"},
+		{ua: "Mozilla/5.0 (Linux; Android 10; SM-G973F) Mobile Safari/537.36", want: "mobile"},
+		{ua: "Mozilla/5.0 (iPad; CPU OS 13_0 like Mac OS X)", want: "tablet"},
+		{ua: "Mozilla/5.0 (Linux; Android 10; SM-T510) Safari/537.36", want: "tablet"},
+		{ua: "Mozilla/5.0 (Windows NT 10.0; Win64; x64)", want: "desktop"},
+		{ua: "", want: "desktop"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			got := middleware.DeviceClass(tt.ua)
+
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/nrwiersma/proxy/http"
+)
+
+// surrogateKeyHeaders are the response headers containing cache tags.
+var surrogateKeyHeaders = []string{"Surrogate-Key", "Cache-Tag"}
+
+// PurgeKey removes the entry with the key, including its variants.
+// It returns the number of removed entries.
+func (c *Cache) PurgeKey(key string) int {
+	return c.purge(func(k string, e *CacheEntry) bool {
+		return k == key || strings.HasPrefix(k, key+"|")
+	})
+}
+
+// PurgePrefix removes the entries with a key starting with the prefix.
+// It returns the number of removed entries.
+func (c *Cache) PurgePrefix(prefix string) int {
+	return c.purge(func(k string, e *CacheEntry) bool {
+		return strings.HasPrefix(k, prefix)
+	})
+}
+
+// PurgeHost removes the entries of the host, regardless of the port.
+// It returns the number of removed entries.
+func (c *Cache) PurgeHost(host string) int {
+	host = hostname(host)
+	return c.purge(func(k string, e *CacheEntry) bool {
+		i := strings.Index(k, "/")
+		return i >= 0 && strings.EqualFold(hostname(k[:i]), host)
+	})
+}
+
+// PurgeTags removes the entries tagged with any of the tags in their
+// Surrogate-Key or Cache-Tag header. It returns the number of removed entries.
+func (c *Cache) PurgeTags(tags ...string) int {
+	want := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		want[tag] = true
+	}
+
+	return c.purge(func(k string, e *CacheEntry) bool {
+		for _, tag := range surrogateKeys(e.Header) {
+			if want[tag] {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (c *Cache) purge(match func(key string, e *CacheEntry) bool) int {
+	var keys []string
+	c.store.Range(func(key string, e *CacheEntry) bool {
+		if match(key, e) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+
+	for _, key := range keys {
+		c.store.Delete(key)
+	}
+	return len(keys)
+}
+
+// isPurgeEnabled determines if PURGE requests are handled.
+func (c *Cache) isPurgeEnabled() bool {
+	return len(c.purgeAllow) > 0 || c.purgeToken != ""
+}
+
+// servePurge serves a PURGE request.
+//
+// The request URL is purged unless the X-Purge-Scope header selects the
+// "prefix" of the URL or the "host". If the Surrogate-Key header is set,
+// the entries tagged with its keys are purged instead. Only the entries
+// of this cache are purged.
+func (c *Cache) servePurge(r *http.Request) *http.Response {
+	if !c.isPurgeAllowed(r) {
+		return &http.Response{
+			StatusCode: 403,
+			StatusText: "Forbidden",
+			Header:     http.Header{"Content-Length": []string{"0"}},
+		}
+	}
+
+	var n int
+	switch scope := strings.ToLower(r.Header.Get("X-Purge-Scope")); {
+	case r.Header.Get("Surrogate-Key") != "":
+		n = c.PurgeTags(strings.Fields(r.Header.Get("Surrogate-Key"))...)
+
+	case scope == "" || scope == "key":
+		n = c.PurgeKey(c.baseKey(r))
+
+	case scope == "prefix":
+		n = c.PurgePrefix(c.baseKey(r))
+
+	case scope == "host":
+		n = c.PurgeHost(r.Host)
+
+	default:
+		return &http.Response{
+			StatusCode: 400,
+			StatusText: "Bad Request",
+			Header:     http.Header{"Content-Length": []string{"0"}},
+		}
+	}
+
+	body := []byte(`{"purged":` + strconv.Itoa(n) + "}")
+	return &http.Response{
+		StatusCode: 200,
+		StatusText: "OK",
+		Header: http.Header{
+			"Content-Type":   []string{"application/json"},
+			"Content-Length": []string{strconv.Itoa(len(body))},
+		},
+		Body: bytes.NewReader(body),
+	}
+}
+
+func (c *Cache) isPurgeAllowed(r *http.Request) bool {
+	if len(c.purgeAllow) > 0 && !containsIP(c.purgeAllow, clientIP(r, c.trustedProxies)) {
+		return false
+	}
+
+	if c.purgeToken != "" {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return false
+		}
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(c.purgeToken)) != 1 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hostname returns the host without its port.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// surrogateKeys returns the cache tags of the response.
+func surrogateKeys(h http.Header) []string {
+	var keys []string
+	for _, v := range h["Surrogate-Key"] {
+		keys = append(keys, strings.Fields(v)...)
+	}
+	for _, v := range h["Cache-Tag"] {
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				keys = append(keys, tag)
+			}
+		}
+	}
+	return keys
+}
+
+// removeSurrogateKeys removes the cache tags from the response.
+func removeSurrogateKeys(h http.Header) {
+	for _, k := range surrogateKeyHeaders {
+		h.Del(k)
+	}
+}
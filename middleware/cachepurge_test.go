@@ -0,0 +1,273 @@
+package middleware_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func newPurgeCache(opts middleware.CacheOpts) *middleware.Cache {
+	return middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header: http.Header{
+				"Cache-Control": []string{"max-age=60"},
+				"Surrogate-Key": []string{"all " + r.URL.Path},
+			},
+			Body: bytes.NewReader([]byte("test")),
+		}
+	}), opts)
+}
+
+func fillPurgeCache(t *testing.T, cache *middleware.Cache) {
+	t.Helper()
+
+	for _, u := range []string{"a.com/foo", "a.com/foo/bar", "a.com:8080/baz", "b.com/foo"} {
+		parts := strings.SplitN(u, "/", 2)
+		req := &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Path: "/" + parts[1]},
+			Host:   parts[0],
+			Header: http.Header{},
+		}
+
+		resp := cache.ServeHTTP(context.Background(), req)
+
+		assert.Equal(t, "", resp.Header.Get("Surrogate-Key"))
+	}
+}
+
+func TestCache_Purge(t *testing.T) {
+	tests := []struct {
+		name  string
+		purge func(c *middleware.Cache) int
+		want  int
+	}{
+		{
+			name:  "Key",
+			purge: func(c *middleware.Cache) int { return c.PurgeKey("a.com/foo") },
+			want:  1,
+		},
+		{
+			name:  "Prefix",
+			purge: func(c *middleware.Cache) int { return c.PurgePrefix("a.com/foo") },
+			want:  2,
+		},
+		{
+			name:  "Host",
+			purge: func(c *middleware.Cache) int { return c.PurgeHost("a.com") },
+			want:  3,
+		},
+		{
+			name:  "Host With Port",
+			purge: func(c *middleware.Cache) int { return c.PurgeHost("a.com:443") },
+			want:  3,
+		},
+		{
+			name:  "Tags",
+			purge: func(c *middleware.Cache) int { return c.PurgeTags("/foo", "/baz") },
+			want:  3,
+		},
+		{
+			name:  "Unknown Tag",
+			purge: func(c *middleware.Cache) int { return c.PurgeTags("/qux") },
+			want:  0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newPurgeCache(middleware.CacheOpts{})
+			fillPurgeCache(t, cache)
+
+			got := tt.purge(cache)
+
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCache_PurgeAbsoluteFormRequests(t *testing.T) {
+	cache := newPurgeCache(middleware.CacheOpts{})
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Scheme: "http", Host: "c.com", Path: "/foo"},
+		Host:   "c.com",
+		Header: http.Header{},
+	}
+	_ = cache.ServeHTTP(context.Background(), req)
+
+	assert.Equal(t, 1, cache.PurgeKey("c.com/foo"))
+	_ = cache.ServeHTTP(context.Background(), req)
+	assert.Equal(t, 1, cache.PurgeHost("c.com"))
+}
+
+func TestCache_PurgeKeyEscapesSeparator(t *testing.T) {
+	cache := newPurgeCache(middleware.CacheOpts{})
+	for _, q := range []string{"a=1", "a=1|b=2"} {
+		_ = cache.ServeHTTP(context.Background(), &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Path: "/foo", RawQuery: q},
+			Host:   "a.com",
+			Header: http.Header{},
+		})
+	}
+
+	assert.Equal(t, 1, cache.PurgeKey("a.com/foo?a=1"))
+	assert.Equal(t, 1, cache.PurgeKey("a.com/foo?a=1%7Cb=2"))
+}
+
+func TestCache_ServeHTTPPurge(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.0.0.0/8")
+	_, trusted, _ := net.ParseCIDR("172.16.0.0/12")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "Key",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"Authorization": []string{"Bearer secret"}},
+			path:       "/foo",
+			wantStatus: 200,
+			wantBody:   `{"purged":1}`,
+		},
+		{
+			name:       "Prefix",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				"Authorization": []string{"Bearer secret"},
+				"X-Purge-Scope": []string{"prefix"},
+			},
+			path:       "/foo",
+			wantStatus: 200,
+			wantBody:   `{"purged":2}`,
+		},
+		{
+			name:       "Host",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				"Authorization": []string{"Bearer secret"},
+				"X-Purge-Scope": []string{"host"},
+			},
+			path:       "/",
+			wantStatus: 200,
+			wantBody:   `{"purged":3}`,
+		},
+		{
+			name:       "Surrogate Key",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				"Authorization": []string{"Bearer secret"},
+				"Surrogate-Key": []string{"all"},
+			},
+			path:       "/",
+			wantStatus: 200,
+			wantBody:   `{"purged":4}`,
+		},
+		{
+			name:       "Invalid Scope",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				"Authorization": []string{"Bearer secret"},
+				"X-Purge-Scope": []string{"everything"},
+			},
+			path:       "/",
+			wantStatus: 400,
+		},
+		{
+			name:       "Invalid Token",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"Authorization": []string{"Bearer wrong"}},
+			path:       "/foo",
+			wantStatus: 403,
+		},
+		{
+			name:       "Invalid IP",
+			remoteAddr: "192.168.0.1:1234",
+			header:     http.Header{"Authorization": []string{"Bearer secret"}},
+			path:       "/foo",
+			wantStatus: 403,
+		},
+		{
+			name:       "Trusted Proxy",
+			remoteAddr: "172.16.0.1:1234",
+			header: http.Header{
+				"Authorization":   []string{"Bearer secret"},
+				"X-Forwarded-For": []string{"10.0.0.1"},
+			},
+			path:       "/foo",
+			wantStatus: 200,
+			wantBody:   `{"purged":1}`,
+		},
+		{
+			name:       "Untrusted Proxy",
+			remoteAddr: "192.168.0.1:1234",
+			header: http.Header{
+				"Authorization":   []string{"Bearer secret"},
+				"X-Forwarded-For": []string{"10.0.0.1"},
+			},
+			path:       "/foo",
+			wantStatus: 403,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newPurgeCache(middleware.CacheOpts{
+				PurgeAllow:     []*net.IPNet{allowed},
+				TrustedProxies: []*net.IPNet{trusted},
+				PurgeToken:     "secret",
+			})
+			fillPurgeCache(t, cache)
+			req := &http.Request{
+				Method:     "PURGE",
+				URL:        &url.URL{Path: tt.path},
+				Host:       "a.com",
+				RemoteAddr: tt.remoteAddr,
+				Header:     tt.header,
+			}
+
+			resp := cache.ServeHTTP(context.Background(), req)
+
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			if tt.wantBody != "" {
+				body, _ := ioutil.ReadAll(resp.Body)
+				assert.Equal(t, tt.wantBody, string(body))
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPPurgeDisabled(t *testing.T) {
+	var method string
+	cache := middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		method = r.Method
+		return &http.Response{StatusCode: 405, StatusText: "Method Not Allowed"}
+	}), middleware.CacheOpts{})
+	req := &http.Request{
+		Method: "PURGE",
+		URL:    &url.URL{Path: "/foo"},
+		Host:   "a.com",
+		Header: http.Header{},
+	}
+
+	resp := cache.ServeHTTP(context.Background(), req)
+
+	assert.Equal(t, 405, resp.StatusCode)
+	assert.Equal(t, "PURGE", method)
+}
@@ -0,0 +1,231 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nrwiersma/proxy/http"
+)
+
+// maxRanges is the maximum number of ranges served in a single response.
+const maxRanges = 16
+
+// byteRange is a range of bytes.
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// isRangeRequest determines if the range of the entry should be served.
+func isRangeRequest(r *http.Request, e *CacheEntry) bool {
+	if r.Method != "GET" || e.StatusCode != 200 || r.Header.Get("Range") == "" {
+		return false
+	}
+
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+
+	// Entity tags must match strongly.
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		etag := e.Header.Get("Etag")
+		return etag != "" && !strings.HasPrefix(etag, "W/") && etag == ifRange
+	}
+
+	t, err := parseHTTPDate(ifRange)
+	if err != nil {
+		return false
+	}
+	lm, err := parseHTTPDate(e.Header.Get("Last-Modified"))
+	return err == nil && lm.Equal(t)
+}
+
+// serveRange serves the requested ranges of the entry. If the
+// Range header is invalid or the body cannot be opened, nil is returned.
+func (c *Cache) serveRange(r *http.Request, e *CacheEntry, now time.Time) *http.Response {
+	size, err := strconv.ParseInt(e.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		size = int64(len(e.Body))
+	}
+
+	ranges, ok := parseRange(r.Header.Get("Range"), size)
+	if !ok {
+		return nil
+	}
+
+	if len(ranges) == 0 {
+		return &http.Response{
+			StatusCode: 416,
+			StatusText: "Range Not Satisfiable",
+			Header: http.Header{
+				"Content-Range":  []string{"bytes */" + strconv.FormatInt(size, 10)},
+				"Content-Length": []string{"0"},
+			},
+		}
+	}
+
+	resp, err := e.response(now, false)
+	if err != nil {
+		return nil
+	}
+	ra, closer, err := e.readerAt()
+	if err != nil {
+		return nil
+	}
+
+	resp.StatusCode = 206
+	resp.StatusText = "Partial Content"
+	resp.Header.Set("Accept-Ranges", "bytes")
+
+	if len(ranges) == 1 {
+		rng := ranges[0]
+		resp.Header.Set("Content-Range", rng.contentRange(size))
+		resp.Header.Set("Content-Length", strconv.FormatInt(rng.length, 10))
+		resp.Body = withCloser(io.NewSectionReader(ra, rng.start, rng.length), closer)
+		return resp
+	}
+
+	boundary := randomString()
+	ctype := resp.Header.Get("Content-Type")
+
+	var length int64
+	readers := make([]io.Reader, 0, 2*len(ranges)+1)
+	for i, rng := range ranges {
+		var hdr bytes.Buffer
+		if i > 0 {
+			hdr.WriteString("\r\n")
+		}
+		hdr.WriteString("--" + boundary + "\r\n")
+		if ctype != "" {
+			hdr.WriteString("Content-Type: " + ctype + "\r\n")
+		}
+		hdr.WriteString("Content-Range: " + rng.contentRange(size) + "\r\n\r\n")
+
+		length += int64(hdr.Len()) + rng.length
+		readers = append(readers, &hdr, io.NewSectionReader(ra, rng.start, rng.length))
+	}
+	trailer := "\r\n--" + boundary + "--\r\n"
+	length += int64(len(trailer))
+	readers = append(readers, strings.NewReader(trailer))
+
+	resp.Header.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	resp.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	resp.Body = withCloser(io.MultiReader(readers...), closer)
+	return resp
+}
+
+// readerAt returns a reader of the entry body. The closer
+// must be closed once reading is done, if it is not nil.
+func (e *CacheEntry) readerAt() (io.ReaderAt, io.Closer, error) {
+	if e.Open == nil {
+		return bytes.NewReader(e.Body), nil, nil
+	}
+
+	rc, err := e.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	if ra, ok := rc.(io.ReaderAt); ok {
+		return ra, rc, nil
+	}
+
+	b, err := ioutil.ReadAll(rc)
+	_ = rc.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	return bytes.NewReader(b), nil, nil
+}
+
+func withCloser(r io.Reader, c io.Closer) io.Reader {
+	if c == nil {
+		return r
+	}
+
+	return &eofCloser{ReadCloser: struct {
+		io.Reader
+		io.Closer
+	}{r, c}}
+}
+
+// parseRange parses the Range header for a body of the given size. It
+// returns false if the header is invalid, and no ranges if none of
+// the ranges can be satisfied.
+func parseRange(s string, size int64) ([]byteRange, bool) {
+	if !strings.HasPrefix(s, "bytes=") {
+		return nil, false
+	}
+
+	var (
+		specs  int
+		ranges []byteRange
+	)
+	for _, spec := range strings.Split(s[len("bytes="):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		specs++
+
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, false
+		}
+		first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+		var rng byteRange
+		switch {
+		case first == "":
+			// A suffix range of the last bytes.
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			rng = byteRange{start: size - n, length: n}
+
+		default:
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, false
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, false
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				continue
+			}
+			rng = byteRange{start: start, length: end - start + 1}
+		}
+
+		if rng.length > 0 {
+			ranges = append(ranges, rng)
+		}
+	}
+
+	if specs == 0 || len(ranges) > maxRanges {
+		return nil, false
+	}
+	return ranges, true
+}
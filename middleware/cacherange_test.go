@@ -0,0 +1,221 @@
+package middleware_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRangeCache() *middleware.Cache {
+	return middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header: http.Header{
+				"Cache-Control": []string{"max-age=60"},
+				"Content-Type":  []string{"text/plain"},
+				"Etag":          []string{`"abc"`},
+				"Last-Modified": []string{"Mon, 02 Jan 2006 15:04:05 GMT"},
+			},
+			Body: bytes.NewReader([]byte("0123456789")),
+		}
+	}), middleware.CacheOpts{})
+}
+
+func TestCache_ServeHTTPRange(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      http.Header
+		wantStatus  int
+		wantRange   string
+		wantBody    string
+		wantLength  string
+		wantIgnored bool
+	}{
+		{
+			name:       "Single Range",
+			header:     http.Header{"Range": []string{"bytes=2-4"}},
+			wantStatus: 206,
+			wantRange:  "bytes 2-4/10",
+			wantBody:   "234",
+			wantLength: "3",
+		},
+		{
+			name:       "Open Range",
+			header:     http.Header{"Range": []string{"bytes=7-"}},
+			wantStatus: 206,
+			wantRange:  "bytes 7-9/10",
+			wantBody:   "789",
+			wantLength: "3",
+		},
+		{
+			name:       "Suffix Range",
+			header:     http.Header{"Range": []string{"bytes=-2"}},
+			wantStatus: 206,
+			wantRange:  "bytes 8-9/10",
+			wantBody:   "89",
+			wantLength: "2",
+		},
+		{
+			name:       "Clipped Range",
+			header:     http.Header{"Range": []string{"bytes=8-20"}},
+			wantStatus: 206,
+			wantRange:  "bytes 8-9/10",
+			wantBody:   "89",
+			wantLength: "2",
+		},
+		{
+			name:       "Unsatisfiable Range",
+			header:     http.Header{"Range": []string{"bytes=20-30"}},
+			wantStatus: 416,
+			wantRange:  "bytes */10",
+			wantLength: "0",
+		},
+		{
+			name:        "Invalid Range",
+			header:      http.Header{"Range": []string{"bytes=4-2"}},
+			wantStatus:  200,
+			wantIgnored: true,
+		},
+		{
+			name: "If-Range ETag",
+			header: http.Header{
+				"Range":    []string{"bytes=2-4"},
+				"If-Range": []string{`"abc"`},
+			},
+			wantStatus: 206,
+			wantRange:  "bytes 2-4/10",
+			wantBody:   "234",
+			wantLength: "3",
+		},
+		{
+			name: "If-Range Date",
+			header: http.Header{
+				"Range":    []string{"bytes=2-4"},
+				"If-Range": []string{"Mon, 02 Jan 2006 15:04:05 GMT"},
+			},
+			wantStatus: 206,
+			wantRange:  "bytes 2-4/10",
+			wantBody:   "234",
+			wantLength: "3",
+		},
+		{
+			name: "If-Range Changed",
+			header: http.Header{
+				"Range":    []string{"bytes=2-4"},
+				"If-Range": []string{`"xyz"`},
+			},
+			wantStatus:  200,
+			wantIgnored: true,
+		},
+		{
+			name: "If-Range Weak",
+			header: http.Header{
+				"Range":    []string{"bytes=2-4"},
+				"If-Range": []string{`W/"abc"`},
+			},
+			wantStatus:  200,
+			wantIgnored: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newRangeCache()
+			for _, status := range []string{"MISS", "HIT"} {
+				req := &http.Request{
+					Method: "GET",
+					URL:    &url.URL{Path: "/test"},
+					Host:   "localhost",
+					Header: cloneHeader(tt.header),
+				}
+
+				resp := cache.ServeHTTP(context.Background(), req)
+
+				assert.Equal(t, tt.wantStatus, resp.StatusCode)
+				assert.Equal(t, status, resp.Header.Get("X-Cache"))
+				if tt.wantIgnored {
+					continue
+				}
+				assert.Equal(t, tt.wantRange, resp.Header.Get("Content-Range"))
+				assert.Equal(t, tt.wantLength, resp.Header.Get("Content-Length"))
+				if resp.Body != nil {
+					body, _ := ioutil.ReadAll(resp.Body)
+					assert.Equal(t, tt.wantBody, string(body))
+				}
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPMultipartRange(t *testing.T) {
+	cache := newRangeCache()
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Host:   "localhost",
+		Header: http.Header{"Range": []string{"bytes=0-1, 8-"}},
+	}
+
+	resp := cache.ServeHTTP(context.Background(), req)
+
+	assert.Equal(t, 206, resp.StatusCode)
+	ctype := resp.Header.Get("Content-Type")
+	require.True(t, strings.HasPrefix(ctype, "multipart/byteranges; boundary="))
+	boundary := strings.TrimPrefix(ctype, "multipart/byteranges; boundary=")
+	body, _ := ioutil.ReadAll(resp.Body)
+	want := "--" + boundary + "\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Range: bytes 0-1/10\r\n\r\n" +
+		"01\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Range: bytes 8-9/10\r\n\r\n" +
+		"89\r\n" +
+		"--" + boundary + "--\r\n"
+	assert.Equal(t, want, string(body))
+	assert.Equal(t, strconv.Itoa(len(want)), resp.Header.Get("Content-Length"))
+}
+
+func TestCache_ServeHTTPPassesRangeThrough(t *testing.T) {
+	var rng string
+	cache := middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		rng = r.Header.Get("Range")
+
+		return &http.Response{
+			StatusCode: 206,
+			StatusText: "Partial Content",
+			Header: http.Header{
+				"Cache-Control":  []string{"max-age=60"},
+				"Content-Range":  []string{"bytes 2-4/10"},
+				"Content-Length": []string{"3"},
+			},
+			Body: bytes.NewReader([]byte("234")),
+		}
+	}), middleware.CacheOpts{})
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Host:   "localhost",
+		Header: http.Header{"Range": []string{"bytes=2-4"}},
+	}
+
+	for i := 0; i < 2; i++ {
+		resp := cache.ServeHTTP(context.Background(), req)
+
+		assert.Equal(t, 206, resp.StatusCode)
+		assert.Equal(t, "MISS", resp.Header.Get("X-Cache"))
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "234", string(body))
+	}
+	assert.Equal(t, "bytes=2-4", rng)
+}
@@ -0,0 +1,266 @@
+package middleware
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// CacheStore stores cache entries.
+type CacheStore interface {
+	// Get returns the entry stored under the key.
+	Get(key string) (*CacheEntry, bool)
+
+	// Set stores the entry under the key for the given duration.
+	Set(key string, e *CacheEntry, ttl time.Duration)
+
+	// Delete removes the entry stored under the key.
+	Delete(key string)
+
+	// Range calls fn for each stored entry until fn returns false.
+	Range(fn func(key string, e *CacheEntry) bool)
+
+	// Stats returns the store statistics.
+	Stats() CacheStats
+}
+
+// CacheStats contains cache store statistics.
+type CacheStats struct {
+	Entries   int
+	Bytes     int64
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+// Eviction policies.
+const (
+	EvictLRU = "lru"
+	EvictLFU = "lfu"
+)
+
+// MemoryStoreOpts configures a memory store.
+type MemoryStoreOpts struct {
+	// MaxBytes is the memory budget of the store. Defaults to 64MB.
+	MaxBytes int64
+
+	// Policy is the eviction policy, either EvictLRU or EvictLFU.
+	// Defaults to EvictLRU.
+	Policy string
+
+	// Purge is the interval expired entries are purged in.
+	Purge time.Duration
+}
+
+type memoryItem struct {
+	key     string
+	entry   *CacheEntry
+	size    int64
+	expires time.Time
+	freq    int
+}
+
+// MemoryStore is a size bounded in-memory cache store.
+//
+// When the memory budget is exceeded, entries are evicted following
+// the least recently used or least frequently used policy.
+type MemoryStore struct {
+	maxBytes int64
+	lfu      bool
+	purge    time.Duration
+
+	mu        sync.Mutex
+	items     map[string]*list.Element
+	lists     map[int]*list.List
+	minFreq   int
+	lastPurge time.Time
+	stats     CacheStats
+}
+
+// NewMemoryStore returns a memory store.
+func NewMemoryStore(opts MemoryStoreOpts) *MemoryStore {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 64 << 20
+	}
+
+	return &MemoryStore{
+		maxBytes:  opts.MaxBytes,
+		lfu:       opts.Policy == EvictLFU,
+		purge:     opts.Purge,
+		items:     map[string]*list.Element{},
+		lists:     map[int]*list.List{},
+		lastPurge: time.Now(),
+	}
+}
+
+// Get returns the entry stored under the key.
+func (s *MemoryStore) Get(key string) (*CacheEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		s.stats.Misses++
+		return nil, false
+	}
+
+	item := el.Value.(*memoryItem)
+	if time.Now().After(item.expires) {
+		s.remove(el)
+		s.stats.Misses++
+		return nil, false
+	}
+
+	s.touch(el)
+	s.stats.Hits++
+	return item.entry, true
+}
+
+// Set stores the entry under the key for the given duration.
+func (s *MemoryStore) Set(key string, e *CacheEntry, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.purge > 0 && now.Sub(s.lastPurge) >= s.purge {
+		s.purgeExpired(now)
+	}
+
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+
+	item := &memoryItem{
+		key:     key,
+		entry:   e,
+		size:    int64(len(key)) + e.Size(),
+		expires: now.Add(ttl),
+		freq:    1,
+	}
+	if item.size > s.maxBytes {
+		return
+	}
+
+	for s.stats.Bytes+item.size > s.maxBytes {
+		s.evict()
+	}
+
+	s.items[key] = s.list(1).PushFront(item)
+	s.minFreq = 1
+	s.stats.Bytes += item.size
+	s.stats.Entries++
+}
+
+// Delete removes the entry stored under the key.
+func (s *MemoryStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+}
+
+// Range calls fn for each stored entry until fn returns false.
+func (s *MemoryStore) Range(fn func(key string, e *CacheEntry) bool) {
+	s.mu.Lock()
+	now := time.Now()
+	items := make([]*memoryItem, 0, len(s.items))
+	for _, el := range s.items {
+		if item := el.Value.(*memoryItem); !now.After(item.expires) {
+			items = append(items, item)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, item := range items {
+		if !fn(item.key, item.entry) {
+			return
+		}
+	}
+}
+
+// Stats returns the store statistics.
+func (s *MemoryStore) Stats() CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stats
+}
+
+// list returns the list of items with the given frequency. With
+// the LRU policy, all items are kept in a single list.
+func (s *MemoryStore) list(freq int) *list.List {
+	if !s.lfu {
+		freq = 1
+	}
+
+	l, ok := s.lists[freq]
+	if !ok {
+		l = list.New()
+		s.lists[freq] = l
+	}
+	return l
+}
+
+func (s *MemoryStore) touch(el *list.Element) {
+	item := el.Value.(*memoryItem)
+	if !s.lfu {
+		s.list(1).MoveToFront(el)
+		return
+	}
+
+	s.unlink(el)
+	item.freq++
+	s.items[item.key] = s.list(item.freq).PushFront(item)
+	if _, ok := s.lists[s.minFreq]; !ok {
+		s.minFreq = item.freq
+	}
+}
+
+func (s *MemoryStore) evict() {
+	l, ok := s.lists[s.minFreq]
+	if !ok {
+		// The least used list was emptied, find the next one.
+		s.minFreq = 0
+		for freq := range s.lists {
+			if s.minFreq == 0 || freq < s.minFreq {
+				s.minFreq = freq
+			}
+		}
+		l = s.lists[s.minFreq]
+	}
+
+	s.remove(l.Back())
+	s.stats.Evictions++
+}
+
+func (s *MemoryStore) remove(el *list.Element) {
+	item := el.Value.(*memoryItem)
+	s.unlink(el)
+	delete(s.items, item.key)
+	s.stats.Bytes -= item.size
+	s.stats.Entries--
+}
+
+func (s *MemoryStore) unlink(el *list.Element) {
+	freq := el.Value.(*memoryItem).freq
+	if !s.lfu {
+		freq = 1
+	}
+
+	l := s.lists[freq]
+	l.Remove(el)
+	if l.Len() == 0 {
+		delete(s.lists, freq)
+	}
+}
+
+func (s *MemoryStore) purgeExpired(now time.Time) {
+	for _, el := range s.items {
+		if now.After(el.Value.(*memoryItem).expires) {
+			s.remove(el)
+		}
+	}
+	s.lastPurge = now
+}
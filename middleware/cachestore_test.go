@@ -0,0 +1,95 @@
+package middleware_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := middleware.NewMemoryStore(middleware.MemoryStoreOpts{})
+	e := &middleware.CacheEntry{StatusCode: 200, Body: []byte("test")}
+
+	s.Set("a", e, time.Minute)
+
+	got, ok := s.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, e, got)
+
+	s.Delete("a")
+
+	_, ok = s.Get("a")
+	assert.False(t, ok)
+	stats := s.Stats()
+	assert.Equal(t, 0, stats.Entries)
+	assert.Equal(t, int64(0), stats.Bytes)
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+}
+
+func TestMemoryStore_Expires(t *testing.T) {
+	s := middleware.NewMemoryStore(middleware.MemoryStoreOpts{})
+
+	s.Set("a", &middleware.CacheEntry{}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	_, ok := s.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, s.Stats().Entries)
+}
+
+func TestMemoryStore_Evicts(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		evicted string
+	}{
+		{
+			name:    "LRU",
+			policy:  middleware.EvictLRU,
+			evicted: "b",
+		},
+		{
+			name:    "LFU",
+			policy:  middleware.EvictLFU,
+			evicted: "c",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := make([]byte, 1000)
+			size := int64(1) + (&middleware.CacheEntry{Body: body}).Size()
+			s := middleware.NewMemoryStore(middleware.MemoryStoreOpts{
+				MaxBytes: 3 * size,
+				Policy:   tt.policy,
+			})
+
+			s.Set("a", &middleware.CacheEntry{Body: body}, time.Minute)
+			s.Set("b", &middleware.CacheEntry{Body: body}, time.Minute)
+			s.Get("b")
+			s.Get("a")
+			s.Get("a")
+			s.Set("c", &middleware.CacheEntry{Body: body}, time.Minute)
+			s.Set("d", &middleware.CacheEntry{Body: body}, time.Minute)
+
+			_, ok := s.Get(tt.evicted)
+			assert.False(t, ok)
+			stats := s.Stats()
+			assert.Equal(t, 3, stats.Entries)
+			assert.Equal(t, 3*size, stats.Bytes)
+			assert.Equal(t, int64(1), stats.Evictions)
+		})
+	}
+}
+
+func TestMemoryStore_IgnoresLargeEntries(t *testing.T) {
+	s := middleware.NewMemoryStore(middleware.MemoryStoreOpts{MaxBytes: 100})
+
+	s.Set("a", &middleware.CacheEntry{Body: make([]byte, 100)}, time.Minute)
+
+	_, ok := s.Get("a")
+	assert.False(t, ok)
+}
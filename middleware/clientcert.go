@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"context"
+	"strings"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/internal/slices"
+)
+
+// ClientCertOpts configures a client certificate middleware.
+type ClientCertOpts struct {
+	// Subjects are the allowed certificate subjects or common names.
+	Subjects []string
+
+	// Fingerprints are the allowed SHA-256 certificate fingerprints.
+	Fingerprints []string
+
+	// SubjectHeader is the header the certificate subject is forwarded in.
+	SubjectHeader string
+
+	// FingerprintHeader is the header the certificate fingerprint is forwarded in.
+	FingerprintHeader string
+}
+
+// ClientCert matches and forwards verified client certificates.
+type ClientCert struct {
+	h    http.Handler
+	opts ClientCertOpts
+}
+
+// NewClientCert returns a client certificate middleware.
+func NewClientCert(h http.Handler, opts ClientCertOpts) *ClientCert {
+	fps := make([]string, len(opts.Fingerprints))
+	for i, fp := range opts.Fingerprints {
+		fps[i] = normalizeFingerprint(fp)
+	}
+	opts.Fingerprints = fps
+
+	return &ClientCert{
+		h:    h,
+		opts: opts,
+	}
+}
+
+// ServeHTTP serves an HTTP request.
+func (c *ClientCert) ServeHTTP(ctx context.Context, r *http.Request) *http.Response {
+	// Never trust certificate headers sent by the client.
+	if c.opts.SubjectHeader != "" {
+		r.Header.Del(c.opts.SubjectHeader)
+	}
+	if c.opts.FingerprintHeader != "" {
+		r.Header.Del(c.opts.FingerprintHeader)
+	}
+
+	cert := r.ClientCertificate()
+	if cert == nil {
+		if len(c.opts.Subjects) > 0 || len(c.opts.Fingerprints) > 0 {
+			return &http.Response{StatusCode: 403, StatusText: "Forbidden"}
+		}
+		return c.h.ServeHTTP(ctx, r)
+	}
+
+	subject := cert.Subject.String()
+	fingerprint := http.Fingerprint(cert)
+
+	if len(c.opts.Subjects) > 0 &&
+		!slices.StringContains(subject, c.opts.Subjects) &&
+		!slices.StringContains(cert.Subject.CommonName, c.opts.Subjects) {
+		return &http.Response{StatusCode: 403, StatusText: "Forbidden"}
+	}
+	if len(c.opts.Fingerprints) > 0 && !slices.StringContains(fingerprint, c.opts.Fingerprints) {
+		return &http.Response{StatusCode: 403, StatusText: "Forbidden"}
+	}
+
+	if c.opts.SubjectHeader != "" {
+		r.Header.Set(c.opts.SubjectHeader, subject)
+	}
+	if c.opts.FingerprintHeader != "" {
+		r.Header.Set(c.opts.FingerprintHeader, fingerprint)
+	}
+
+	return c.h.ServeHTTP(ctx, r)
+}
+
+// normalizeFingerprint converts fingerprints like "AB:CD:..." to "abcd...".
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.Replace(fp, ":", "", -1))
+}
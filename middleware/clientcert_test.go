@@ -0,0 +1,152 @@
+package middleware_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/url"
+	"testing"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func loadTestCert(t *testing.T) *x509.Certificate {
+	b, err := ioutil.ReadFile("../testdata/cert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestClientCert_ServeHTTP(t *testing.T) {
+	cert := loadTestCert(t)
+
+	tests := []struct {
+		name      string
+		opts      middleware.ClientCertOpts
+		state     *tls.ConnectionState
+		want      int
+		wantCalls int
+	}{
+		{
+			name:      "No Certificate Without Rules",
+			opts:      middleware.ClientCertOpts{},
+			want:      200,
+			wantCalls: 1,
+		},
+		{
+			name:      "No Certificate With Rules",
+			opts:      middleware.ClientCertOpts{Subjects: []string{"localhost"}},
+			want:      403,
+			wantCalls: 0,
+		},
+		{
+			name:      "Unverified Certificate",
+			opts:      middleware.ClientCertOpts{Subjects: []string{"localhost"}},
+			state:     &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+			want:      403,
+			wantCalls: 0,
+		},
+		{
+			name:      "Matches Common Name",
+			opts:      middleware.ClientCertOpts{Subjects: []string{"localhost"}},
+			state:     &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			want:      200,
+			wantCalls: 1,
+		},
+		{
+			name:      "No Match Subject",
+			opts:      middleware.ClientCertOpts{Subjects: []string{"example.com"}},
+			state:     &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			want:      403,
+			wantCalls: 0,
+		},
+		{
+			name:      "Matches Fingerprint",
+			opts:      middleware.ClientCertOpts{Fingerprints: []string{http.Fingerprint(cert)}},
+			state:     &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			want:      200,
+			wantCalls: 1,
+		},
+		{
+			name:      "No Match Fingerprint",
+			opts:      middleware.ClientCertOpts{Fingerprints: []string{"AB:CD"}},
+			state:     &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			want:      403,
+			wantCalls: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/test"},
+				Header: http.Header{},
+				TLS:    tt.state,
+			}
+
+			calls := 0
+			m := middleware.NewClientCert(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+				calls++
+				return &http.Response{StatusCode: 200, StatusText: "OK"}
+			}), tt.opts)
+
+			got := m.ServeHTTP(context.Background(), req)
+
+			assert.Equal(t, tt.want, got.StatusCode)
+			assert.Equal(t, tt.wantCalls, calls)
+		})
+	}
+}
+
+func TestClientCert_ServeHTTPForwardsHeaders(t *testing.T) {
+	cert := loadTestCert(t)
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Header: http.Header{
+			"X-Client-Subject": []string{"spoofed"},
+		},
+		TLS: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+	}
+
+	m := middleware.NewClientCert(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		assert.Equal(t, cert.Subject.String(), r.Header.Get("X-Client-Subject"))
+		assert.Equal(t, http.Fingerprint(cert), r.Header.Get("X-Client-Fingerprint"))
+
+		return &http.Response{StatusCode: 200, StatusText: "OK"}
+	}), middleware.ClientCertOpts{
+		SubjectHeader:     "X-Client-Subject",
+		FingerprintHeader: "X-Client-Fingerprint",
+	})
+
+	_ = m.ServeHTTP(context.Background(), req)
+}
+
+func TestClientCert_ServeHTTPStripsHeadersWithoutCertificate(t *testing.T) {
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Header: http.Header{
+			"X-Client-Subject": []string{"spoofed"},
+		},
+	}
+
+	m := middleware.NewClientCert(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		assert.Equal(t, "", r.Header.Get("X-Client-Subject"))
+
+		return &http.Response{StatusCode: 200, StatusText: "OK"}
+	}), middleware.ClientCertOpts{SubjectHeader: "X-Client-Subject"})
+
+	_ = m.ServeHTTP(context.Background(), req)
+}
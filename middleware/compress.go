@@ -0,0 +1,359 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nrwiersma/proxy/http"
+)
+
+var defaultCompressTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/*+json",
+	"application/*+xml",
+	"image/svg+xml",
+}
+
+// CompressOpts configures a compression middleware.
+type CompressOpts struct {
+	// Encodings are the supported encodings in order of preference.
+	// Defaults to "br", "zstd" and "gzip".
+	Encodings []string
+
+	// ContentTypes are the compressed content types. A type may
+	// contain a "*" wildcard like "text/*". Defaults to common
+	// text based types.
+	ContentTypes []string
+
+	// MinSize is the minimum body size that is compressed.
+	// Defaults to 1024 bytes.
+	MinSize int
+}
+
+// Compress compresses response bodies.
+//
+// Bodies are compressed as they are read, using the chunked
+// transfer encoding, so they are never fully buffered.
+type Compress struct {
+	h    http.Handler
+	opts CompressOpts
+}
+
+// NewCompress returns a compression middleware.
+func NewCompress(h http.Handler, opts CompressOpts) *Compress {
+	if len(opts.Encodings) == 0 {
+		opts.Encodings = []string{"br", "zstd", "gzip"}
+	}
+	if len(opts.ContentTypes) == 0 {
+		opts.ContentTypes = defaultCompressTypes
+	}
+	if opts.MinSize <= 0 {
+		opts.MinSize = 1024
+	}
+
+	return &Compress{
+		h:    h,
+		opts: opts,
+	}
+}
+
+// ServeHTTP serves an HTTP request.
+func (c *Compress) ServeHTTP(ctx context.Context, r *http.Request) *http.Response {
+	enc := NegotiateEncoding(r.Header.Get("Accept-Encoding"), c.opts.Encodings)
+
+	resp := c.h.ServeHTTP(ctx, r)
+	if !c.isCompressible(resp) {
+		return resp
+	}
+
+	appendVary(resp.Header, "Accept-Encoding")
+
+	// Chunked responses are not supported by HTTP/1.0 clients.
+	if enc == "" || r.Method == "HEAD" || r.Proto == "HTTP/1.0" {
+		return resp
+	}
+
+	closer, _ := resp.Body.(io.Closer)
+	if cl := resp.Header.Get("Content-Length"); cl != "" {
+		if n, err := strconv.Atoi(cl); err == nil && n < c.opts.MinSize {
+			return resp
+		}
+	} else {
+		// Read ahead to decide if the body is large enough.
+		prefix := make([]byte, c.opts.MinSize)
+		n, err := io.ReadFull(resp.Body, prefix)
+		prefix = prefix[:n]
+		if err != nil {
+			if closer != nil {
+				_ = closer.Close()
+			}
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				return &http.Response{StatusCode: 502, StatusText: "Bad Gateway", Error: err}
+			}
+
+			resp.Body = bytes.NewReader(prefix)
+			resp.Header.Set("Content-Length", strconv.Itoa(n))
+			return resp
+		}
+		resp.Body = io.MultiReader(bytes.NewReader(prefix), resp.Body)
+	}
+
+	resp.Body = newCompressReader(resp.Body, closer, enc)
+	resp.Header.Set("Content-Encoding", enc)
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Transfer-Encoding", "chunked")
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+
+	return resp
+}
+
+func (c *Compress) isCompressible(resp *http.Response) bool {
+	if resp.Body == nil || resp.Header == nil {
+		return false
+	}
+	if resp.StatusCode < 200 || resp.StatusCode == 204 || resp.StatusCode == 206 || resp.StatusCode == 304 {
+		return false
+	}
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Range") != "" {
+		return false
+	}
+	if strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+
+	typ := strings.ToLower(resp.Header.Get("Content-Type"))
+	if i := strings.Index(typ, ";"); i >= 0 {
+		typ = typ[:i]
+	}
+	typ = strings.TrimSpace(typ)
+	for _, pattern := range c.opts.ContentTypes {
+		if matchWildcard(pattern, typ) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchWildcard determines if s matches the pattern, which may
+// contain a single "*" wildcard.
+func matchWildcard(pattern, s string) bool {
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return pattern == s
+	}
+	return len(s) >= len(pattern)-1 &&
+		strings.HasPrefix(s, pattern[:i]) &&
+		strings.HasSuffix(s, pattern[i+1:])
+}
+
+// NegotiateEncoding returns the preferred supported encoding accepted by
+// the Accept-Encoding header, or an empty string if there is none.
+func NegotiateEncoding(accept string, supported []string) string {
+	type encoding struct {
+		name string
+		q    float64
+		pref int
+	}
+
+	var encs []encoding
+	wildcard := -1.0
+	qs := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		name, q := parseQValue(part)
+		if name == "" {
+			continue
+		}
+		if name == "*" {
+			wildcard = q
+			continue
+		}
+		qs[name] = q
+	}
+
+	for i, name := range supported {
+		q, ok := qs[name]
+		if !ok {
+			q = wildcard
+		}
+		if q <= 0 {
+			continue
+		}
+		encs = append(encs, encoding{name: name, q: q, pref: i})
+	}
+	if len(encs) == 0 {
+		return ""
+	}
+
+	sort.SliceStable(encs, func(i, j int) bool {
+		return encs[i].q > encs[j].q
+	})
+	return encs[0].name
+}
+
+func parseQValue(s string) (string, float64) {
+	parts := strings.Split(s, ";")
+	name := strings.ToLower(strings.TrimSpace(parts[0]))
+
+	q := 1.0
+	for _, param := range parts[1:] {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(param, "q=") {
+			continue
+		}
+		v, err := strconv.ParseFloat(param[2:], 64)
+		if err != nil {
+			return name, 0
+		}
+		q = v
+	}
+	return name, q
+}
+
+// appendVary adds the field to the Vary header if it is not there yet.
+func appendVary(h http.Header, field string) {
+	for _, v := range h["Vary"] {
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if f == "*" || strings.EqualFold(f, field) {
+				return
+			}
+		}
+	}
+	appendHeader(h, "Vary", field)
+}
+
+// compressReader compresses the source as it is read.
+type compressReader struct {
+	src    io.Reader
+	closer io.Closer
+	enc    io.WriteCloser
+	buf    bytes.Buffer
+
+	chunk     []byte
+	encClosed bool
+	err       error
+}
+
+// newCompressReader returns a reader compressing src. The closer, if
+// not nil, is closed when the reader is closed.
+func newCompressReader(src io.Reader, closer io.Closer, encoding string) *compressReader {
+	r := &compressReader{
+		src:    src,
+		closer: closer,
+		chunk:  make([]byte, 32*1024),
+	}
+
+	switch encoding {
+	case "br":
+		r.enc = brotli.NewWriterLevel(&r.buf, brotli.DefaultCompression)
+	case "zstd":
+		r.enc, r.err = newZstdWriter(&r.buf)
+	default:
+		r.enc = gzip.NewWriter(&r.buf)
+	}
+
+	return r
+}
+
+// Read reads compressed data.
+func (r *compressReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 && r.err == nil {
+		n, err := r.src.Read(r.chunk)
+		if n > 0 {
+			if _, werr := r.enc.Write(r.chunk[:n]); werr != nil {
+				r.err = werr
+				break
+			}
+		}
+
+		switch {
+		case err == io.EOF:
+			r.encClosed = true
+			if cerr := r.enc.Close(); cerr != nil {
+				r.err = cerr
+				break
+			}
+			r.err = io.EOF
+		case err != nil:
+			r.err = err
+		}
+	}
+
+	if r.buf.Len() > 0 {
+		return r.buf.Read(p)
+	}
+	return 0, r.err
+}
+
+// Close releases the encoder and closes the source.
+func (r *compressReader) Close() error {
+	var err error
+	if !r.encClosed && r.enc != nil {
+		r.encClosed = true
+		err = r.enc.Close()
+	}
+	if r.closer != nil {
+		if cerr := r.closer.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// zstdWriter encodes each write as a separate zstd frame.
+//
+// The streaming zstd encoder writes from its own goroutines, which
+// would race with the reader draining the buffer, so every write is
+// encoded synchronously instead.
+type zstdWriter struct {
+	w   io.Writer
+	enc *zstd.Encoder
+
+	wrote bool
+}
+
+func newZstdWriter(w io.Writer) (*zstdWriter, error) {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithZeroFrames(true))
+	if err != nil {
+		return nil, err
+	}
+
+	return &zstdWriter{w: w, enc: enc}, nil
+}
+
+// Write writes p as a zstd frame.
+func (z *zstdWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	z.wrote = true
+	if _, err := z.w.Write(z.enc.EncodeAll(p, nil)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes an empty frame if nothing was written and
+// releases the encoder.
+func (z *zstdWriter) Close() error {
+	if !z.wrote {
+		z.wrote = true
+		if _, err := z.w.Write(z.enc.EncodeAll(nil, nil)); err != nil {
+			return err
+		}
+	}
+	return z.enc.Close()
+}
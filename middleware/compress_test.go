@@ -0,0 +1,310 @@
+package middleware_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	supported := []string{"br", "zstd", "gzip"}
+
+	tests := []struct {
+		name   string
+		accept string
+		want   string
+	}{
+		{
+			name:   "Server Preference",
+			accept: "gzip, br, zstd",
+			want:   "br",
+		},
+		{
+			name:   "Client Quality",
+			accept: "gzip;q=1.0, br;q=0.5",
+			want:   "gzip",
+		},
+		{
+			name:   "Wildcard",
+			accept: "*",
+			want:   "br",
+		},
+		{
+			name:   "Wildcard Excluded",
+			accept: "*, br;q=0",
+			want:   "zstd",
+		},
+		{
+			name:   "Unsupported",
+			accept: "deflate",
+			want:   "",
+		},
+		{
+			name:   "Empty",
+			accept: "",
+			want:   "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := middleware.NegotiateEncoding(tt.accept, supported)
+
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCompress_ServeHTTP(t *testing.T) {
+	body := strings.Repeat("compress me ", 200)
+
+	tests := []struct {
+		name   string
+		accept string
+		decode func(io.Reader) (io.Reader, error)
+	}{
+		{
+			name:   "Brotli",
+			accept: "br",
+			decode: func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		},
+		{
+			name:   "Zstd",
+			accept: "zstd",
+			decode: func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+		},
+		{
+			name:   "Gzip",
+			accept: "gzip",
+			decode: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/test"},
+				Proto:  "HTTP/1.1",
+				Header: http.Header{"Accept-Encoding": []string{tt.accept}},
+			}
+
+			m := middleware.NewCompress(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+				return &http.Response{
+					StatusCode: 200,
+					StatusText: "OK",
+					Header: http.Header{
+						"Content-Type": []string{"text/plain; charset=utf-8"},
+						"Etag":         []string{`"abc"`},
+					},
+					// The body is unbuffered, with an unknown length.
+					Body: io.MultiReader(strings.NewReader(body)),
+				}
+			}), middleware.CompressOpts{})
+
+			got := m.ServeHTTP(context.Background(), req)
+
+			assert.Equal(t, tt.accept, got.Header.Get("Content-Encoding"))
+			assert.Equal(t, "Accept-Encoding", got.Header.Get("Vary"))
+			assert.Equal(t, "chunked", got.Header.Get("Transfer-Encoding"))
+			assert.Equal(t, "", got.Header.Get("Content-Length"))
+			assert.Equal(t, `W/"abc"`, got.Header.Get("ETag"))
+			r, err := tt.decode(got.Body)
+			require.NoError(t, err)
+			b, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, body, string(b))
+		})
+	}
+}
+
+func TestCompress_ServeHTTPLargeZstdBody(t *testing.T) {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 4<<20; i++ {
+		fmt.Fprintf(&buf, "line %d of a large body\n", i)
+	}
+	body := buf.String()
+
+	m := middleware.NewCompress(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header:     http.Header{"Content-Type": []string{"text/plain"}},
+			Body:       io.MultiReader(strings.NewReader(body)),
+		}
+	}), middleware.CompressOpts{})
+
+	got := m.ServeHTTP(context.Background(), &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Proto:  "HTTP/1.1",
+		Header: http.Header{"Accept-Encoding": []string{"zstd"}},
+	})
+	require.Equal(t, "zstd", got.Header.Get("Content-Encoding"))
+
+	dec, err := zstd.NewReader(got.Body)
+	require.NoError(t, err)
+	defer dec.Close()
+	b, err := ioutil.ReadAll(dec)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(b))
+	assert.NoError(t, got.Body.(io.Closer).Close())
+}
+
+func TestCompress_ServeHTTPClosesSource(t *testing.T) {
+	for _, enc := range []string{"br", "zstd", "gzip"} {
+		t.Run(enc, func(t *testing.T) {
+			src := &closeRecorder{Reader: strings.NewReader(strings.Repeat("compress me ", 10000))}
+			m := middleware.NewCompress(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+				return &http.Response{
+					StatusCode: 200,
+					StatusText: "OK",
+					Header:     http.Header{"Content-Type": []string{"text/plain"}},
+					Body:       src,
+				}
+			}), middleware.CompressOpts{})
+
+			got := m.ServeHTTP(context.Background(), &http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/test"},
+				Proto:  "HTTP/1.1",
+				Header: http.Header{"Accept-Encoding": []string{enc}},
+			})
+			require.Equal(t, enc, got.Header.Get("Content-Encoding"))
+
+			// Stop reading part way, as when the client disconnects.
+			_, err := got.Body.Read(make([]byte, 16))
+			require.NoError(t, err)
+			c, ok := got.Body.(io.Closer)
+			require.True(t, ok)
+
+			assert.NoError(t, c.Close())
+			assert.True(t, src.closed)
+		})
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestCompress_ServeHTTPSkipsIneligibleResponses(t *testing.T) {
+	large := strings.Repeat("a", 2048)
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		body     string
+		wantVary string
+	}{
+		{
+			name:     "Small Body",
+			header:   http.Header{"Content-Type": []string{"application/json"}},
+			body:     "{}",
+			wantVary: "Accept-Encoding",
+		},
+		{
+			name:     "Small Body With Length",
+			header:   http.Header{"Content-Type": []string{"application/json"}, "Content-Length": []string{"2"}},
+			body:     "{}",
+			wantVary: "Accept-Encoding",
+		},
+		{
+			name:   "Content Type",
+			header: http.Header{"Content-Type": []string{"image/png"}},
+			body:   large,
+		},
+		{
+			name:   "Already Encoded",
+			header: http.Header{"Content-Type": []string{"text/html"}, "Content-Encoding": []string{"gzip"}},
+			body:   large,
+		},
+		{
+			name:   "No Transform",
+			header: http.Header{"Content-Type": []string{"text/html"}, "Cache-Control": []string{"no-transform"}},
+			body:   large,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/test"},
+				Proto:  "HTTP/1.1",
+				Header: http.Header{"Accept-Encoding": []string{"gzip"}},
+			}
+
+			m := middleware.NewCompress(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+				return &http.Response{
+					StatusCode: 200,
+					StatusText: "OK",
+					Header:     tt.header,
+					Body:       io.MultiReader(strings.NewReader(tt.body)),
+				}
+			}), middleware.CompressOpts{})
+
+			got := m.ServeHTTP(context.Background(), req)
+
+			assert.Equal(t, tt.wantVary, got.Header.Get("Vary"))
+			b, _ := ioutil.ReadAll(got.Body)
+			assert.Equal(t, tt.body, string(b))
+		})
+	}
+}
+
+func TestCompress_ServeHTTPWithCache(t *testing.T) {
+	body := strings.Repeat("compress me ", 200)
+
+	var calls int
+	m := middleware.NewCache(middleware.NewCompress(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		calls++
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header:     http.Header{"Content-Type": []string{"text/plain"}},
+			Body:       bytes.NewReader([]byte(body)),
+		}
+	}), middleware.CompressOpts{}), middleware.CacheOpts{Expiry: 60e9})
+
+	newReq := func(accept string) *http.Request {
+		return &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Path: "/test"},
+			Proto:  "HTTP/1.1",
+			Header: http.Header{"Accept-Encoding": []string{accept}},
+		}
+	}
+
+	_ = m.ServeHTTP(context.Background(), newReq("gzip"))
+	got := m.ServeHTTP(context.Background(), newReq("gzip"))
+	assert.Equal(t, "gzip", got.Header.Get("Content-Encoding"))
+	assert.NotEqual(t, "", got.Header.Get("Content-Length"))
+	assert.Equal(t, 1, calls)
+
+	got = m.ServeHTTP(context.Background(), newReq(""))
+	assert.Equal(t, "", got.Header.Get("Content-Encoding"))
+	b, _ := ioutil.ReadAll(got.Body)
+	assert.Equal(t, body, string(b))
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/nrwiersma/proxy/http"
+)
+
+// ConcurrencyLimitOpts configures a concurrency limit middleware.
+type ConcurrencyLimitOpts struct {
+	// MaxInFlight is the maximum number of concurrent requests.
+	MaxInFlight int
+
+	// MaxQueue is the maximum number of requests waiting for
+	// a free slot. If MaxQueue is zero, excess requests are
+	// rejected immediately.
+	MaxQueue int
+
+	// MaxWait is the maximum time a request waits in the queue.
+	// If MaxWait is zero, requests wait until a slot is free.
+	MaxWait time.Duration
+
+	// RetryAfter is the optional Retry-After sent with rejected requests.
+	RetryAfter time.Duration
+}
+
+// ConcurrencyLimit limits the number of concurrent requests,
+// queueing excess requests up to a maximum depth.
+type ConcurrencyLimit struct {
+	h    http.Handler
+	opts ConcurrencyLimitOpts
+
+	slots  chan struct{}
+	queued int64
+}
+
+// NewConcurrencyLimit returns a concurrency limit middleware.
+func NewConcurrencyLimit(h http.Handler, opts ConcurrencyLimitOpts) *ConcurrencyLimit {
+	if opts.MaxInFlight <= 0 {
+		opts.MaxInFlight = 1
+	}
+
+	return &ConcurrencyLimit{
+		h:     h,
+		opts:  opts,
+		slots: make(chan struct{}, opts.MaxInFlight),
+	}
+}
+
+// ServeHTTP serves an HTTP request.
+func (m *ConcurrencyLimit) ServeHTTP(ctx context.Context, r *http.Request) *http.Response {
+	if !m.acquire(ctx) {
+		return m.unavailable()
+	}
+	defer func() { <-m.slots }()
+
+	return m.h.ServeHTTP(ctx, r)
+}
+
+func (m *ConcurrencyLimit) acquire(ctx context.Context) bool {
+	select {
+	case m.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if atomic.AddInt64(&m.queued, 1) > int64(m.opts.MaxQueue) {
+		atomic.AddInt64(&m.queued, -1)
+		return false
+	}
+	defer atomic.AddInt64(&m.queued, -1)
+
+	var timeout <-chan time.Time
+	if m.opts.MaxWait > 0 {
+		timer := time.NewTimer(m.opts.MaxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+		return true
+	case <-timeout:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (m *ConcurrencyLimit) unavailable() *http.Response {
+	resp := &http.Response{
+		StatusCode: 503,
+		StatusText: "Service Unavailable",
+		Header: http.Header{
+			"Content-Length": []string{"0"},
+		},
+	}
+	if m.opts.RetryAfter > 0 {
+		resp.Header.Set("Retry-After", strconv.Itoa(seconds(m.opts.RetryAfter)))
+	}
+	return resp
+}
+
+// InFlight returns the number of requests being served.
+func (m *ConcurrencyLimit) InFlight() int {
+	return len(m.slots)
+}
+
+// Queued returns the number of requests waiting for a slot.
+func (m *ConcurrencyLimit) Queued() int {
+	return int(atomic.LoadInt64(&m.queued))
+}
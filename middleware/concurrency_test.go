@@ -0,0 +1,81 @@
+package middleware_test
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrencyLimit_ServeHTTP(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	m := middleware.NewConcurrencyLimit(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		started <- struct{}{}
+		<-release
+		return &http.Response{StatusCode: 200, StatusText: "OK"}
+	}), middleware.ConcurrencyLimitOpts{
+		MaxInFlight: 1,
+		MaxQueue:    1,
+		RetryAfter:  time.Second,
+	})
+	req := &http.Request{Method: "GET", URL: &url.URL{Path: "/test"}, Header: http.Header{}}
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- m.ServeHTTP(context.Background(), req).StatusCode
+		}()
+	}
+
+	<-started
+	for m.Queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 1, m.InFlight())
+
+	got := m.ServeHTTP(context.Background(), req)
+	assert.Equal(t, 503, got.StatusCode)
+	assert.Equal(t, "1", got.Header.Get("Retry-After"))
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		assert.Equal(t, 200, code)
+	}
+	assert.Equal(t, 0, m.InFlight())
+	assert.Equal(t, 0, m.Queued())
+}
+
+func TestConcurrencyLimit_ServeHTTPTimesOutQueuedRequests(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	m := middleware.NewConcurrencyLimit(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		close(started)
+		<-release
+		return &http.Response{StatusCode: 200, StatusText: "OK"}
+	}), middleware.ConcurrencyLimitOpts{
+		MaxInFlight: 1,
+		MaxQueue:    1,
+		MaxWait:     10 * time.Millisecond,
+	})
+	req := &http.Request{Method: "GET", URL: &url.URL{Path: "/test"}, Header: http.Header{}}
+
+	go m.ServeHTTP(context.Background(), req)
+	<-started
+
+	got := m.ServeHTTP(context.Background(), req)
+
+	assert.Equal(t, 503, got.StatusCode)
+	assert.Equal(t, 0, m.Queued())
+}
@@ -0,0 +1,235 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nrwiersma/proxy/http"
+)
+
+// CORSOpts configures a CORS middleware.
+type CORSOpts struct {
+	// AllowedOrigins are the allowed origins. An origin may be
+	// "*" to allow all origins, or contain a single "*" wildcard
+	// like "https://*.example.com".
+	AllowedOrigins []string
+
+	// AllowedOriginRegexes are regexes of allowed origins. A regex
+	// must match the whole origin, it is anchored if it is not.
+	AllowedOriginRegexes []*regexp.Regexp
+
+	// AllowedMethods are the methods allowed in preflight
+	// requests. Defaults to GET, HEAD and POST.
+	AllowedMethods []string
+
+	// AllowedHeaders are the headers allowed in preflight requests.
+	// If AllowedHeaders contains "*", all requested headers are allowed.
+	AllowedHeaders []string
+
+	// ExposedHeaders are the response headers exposed to the client.
+	ExposedHeaders []string
+
+	// AllowCredentials allows requests with credentials. It cannot
+	// be combined with allowing all origins.
+	AllowCredentials bool
+
+	// MaxAge is how long preflight results may be cached.
+	MaxAge time.Duration
+}
+
+// CORS handles cross-origin resource sharing.
+//
+// Preflight requests are answered directly without
+// being passed to the handler.
+type CORS struct {
+	h    http.Handler
+	opts CORSOpts
+
+	allowAll  bool
+	wildcards [][2]string
+}
+
+// NewCORS returns a CORS middleware.
+func NewCORS(h http.Handler, opts CORSOpts) (*CORS, error) {
+	if len(opts.AllowedMethods) == 0 {
+		opts.AllowedMethods = []string{"GET", "HEAD", "POST"}
+	}
+	for i, m := range opts.AllowedMethods {
+		opts.AllowedMethods[i] = strings.ToUpper(m)
+	}
+
+	c := &CORS{
+		h:    h,
+		opts: opts,
+	}
+
+	origins := make([]string, 0, len(opts.AllowedOrigins))
+	for _, o := range opts.AllowedOrigins {
+		o = strings.ToLower(o)
+		switch {
+		case o == "*":
+			c.allowAll = true
+
+		case strings.Contains(o, "*"):
+			parts := strings.SplitN(o, "*", 2)
+			c.wildcards = append(c.wildcards, [2]string{parts[0], parts[1]})
+
+		default:
+			origins = append(origins, o)
+		}
+	}
+	c.opts.AllowedOrigins = origins
+
+	// A partial match would allow look-alike origins such
+	// as "https://example.com.evil.com".
+	regexes := make([]*regexp.Regexp, 0, len(opts.AllowedOriginRegexes))
+	for _, re := range opts.AllowedOriginRegexes {
+		regexes = append(regexes, regexp.MustCompile(`^(?:`+re.String()+`)$`))
+	}
+	c.opts.AllowedOriginRegexes = regexes
+
+	if c.allowAll && opts.AllowCredentials {
+		return nil, errors.New("middleware: cors credentials cannot be allowed for all origins")
+	}
+
+	return c, nil
+}
+
+// ServeHTTP serves an HTTP request.
+func (c *CORS) ServeHTTP(ctx context.Context, r *http.Request) *http.Response {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return c.h.ServeHTTP(ctx, r)
+	}
+
+	if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+		return c.preflight(r, origin)
+	}
+
+	resp := c.h.ServeHTTP(ctx, r)
+	resp.EnsureHeader()
+	appendHeader(resp.Header, "Vary", "Origin")
+
+	if !c.isOriginAllowed(origin) {
+		return resp
+	}
+
+	c.setOrigin(resp.Header, origin)
+	if len(c.opts.ExposedHeaders) > 0 {
+		resp.Header.Set("Access-Control-Expose-Headers", strings.Join(c.opts.ExposedHeaders, ", "))
+	}
+
+	return resp
+}
+
+func (c *CORS) preflight(r *http.Request, origin string) *http.Response {
+	h := http.Header{
+		"Vary":           []string{"Origin, Access-Control-Request-Method, Access-Control-Request-Headers"},
+		"Content-Length": []string{"0"},
+	}
+	forbidden := &http.Response{StatusCode: 403, StatusText: "Forbidden", Header: h}
+
+	if !c.isOriginAllowed(origin) {
+		return forbidden
+	}
+
+	method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	if !c.isMethodAllowed(method) {
+		return forbidden
+	}
+
+	reqHeaders := parseHeaderList(r.Header.Get("Access-Control-Request-Headers"))
+	if !c.areHeadersAllowed(reqHeaders) {
+		return forbidden
+	}
+
+	c.setOrigin(h, origin)
+	h.Set("Access-Control-Allow-Methods", strings.Join(c.opts.AllowedMethods, ", "))
+	if len(reqHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(reqHeaders, ", "))
+	}
+	if c.opts.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.opts.MaxAge.Seconds())))
+	}
+
+	return &http.Response{StatusCode: 204, StatusText: "No Content", Header: h}
+}
+
+func (c *CORS) setOrigin(h http.Header, origin string) {
+	if c.allowAll {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if c.opts.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (c *CORS) isOriginAllowed(origin string) bool {
+	if c.allowAll {
+		return true
+	}
+
+	lower := strings.ToLower(origin)
+	for _, o := range c.opts.AllowedOrigins {
+		if o == lower {
+			return true
+		}
+	}
+	for _, w := range c.wildcards {
+		if len(lower) >= len(w[0])+len(w[1]) && strings.HasPrefix(lower, w[0]) && strings.HasSuffix(lower, w[1]) {
+			return true
+		}
+	}
+	for _, re := range c.opts.AllowedOriginRegexes {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) isMethodAllowed(method string) bool {
+	if method == "OPTIONS" {
+		return true
+	}
+	for _, m := range c.opts.AllowedMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) areHeadersAllowed(headers []string) bool {
+	for _, hdr := range headers {
+		var found bool
+		for _, allowed := range c.opts.AllowedHeaders {
+			if allowed == "*" || http.CanonicalHeaderKey(allowed) == hdr {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// parseHeaderList parses a comma separated list of header names.
+func parseHeaderList(s string) []string {
+	var headers []string
+	for _, hdr := range strings.Split(s, ",") {
+		if hdr = strings.TrimSpace(hdr); hdr != "" {
+			headers = append(headers, http.CanonicalHeaderKey(hdr))
+		}
+	}
+	return headers
+}
@@ -0,0 +1,211 @@
+package middleware_test
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORS_ServeHTTPPreflight(t *testing.T) {
+	tests := []struct {
+		name        string
+		origin      string
+		method      string
+		headers     string
+		want        int
+		wantOrigin  string
+		wantHeaders string
+	}{
+		{
+			name:        "Exact Origin",
+			origin:      "https://app.example.com",
+			method:      "PUT",
+			headers:     "content-type, x-request-id",
+			want:        204,
+			wantOrigin:  "https://app.example.com",
+			wantHeaders: "Content-Type, X-Request-Id",
+		},
+		{
+			name:       "Wildcard Origin",
+			origin:     "https://api.test.com",
+			method:     "GET",
+			want:       204,
+			wantOrigin: "https://api.test.com",
+		},
+		{
+			name:       "Regex Origin",
+			origin:     "http://localhost:3000",
+			method:     "GET",
+			want:       204,
+			wantOrigin: "http://localhost:3000",
+		},
+		{
+			name:   "Look-alike Regex Origin",
+			origin: "https://example.com.evil.com",
+			method: "GET",
+			want:   403,
+		},
+		{
+			name:   "Look-alike Regex Port Origin",
+			origin: "http://localhost:3000.evil.com",
+			method: "GET",
+			want:   403,
+		},
+		{
+			name:   "Invalid Origin",
+			origin: "https://evil.com",
+			method: "GET",
+			want:   403,
+		},
+		{
+			name:   "Invalid Wildcard Origin",
+			origin: "https://test.com",
+			method: "GET",
+			want:   403,
+		},
+		{
+			name:   "Invalid Method",
+			origin: "https://app.example.com",
+			method: "DELETE",
+			want:   403,
+		},
+		{
+			name:    "Invalid Header",
+			origin:  "https://app.example.com",
+			method:  "GET",
+			headers: "X-Other",
+			want:    403,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method: "OPTIONS",
+				URL:    &url.URL{Path: "/test"},
+				Header: http.Header{
+					"Origin":                        []string{tt.origin},
+					"Access-Control-Request-Method": []string{tt.method},
+				},
+			}
+			if tt.headers != "" {
+				req.Header.Set("Access-Control-Request-Headers", tt.headers)
+			}
+
+			m, err := middleware.NewCORS(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+				t.Error("Preflight passed to handler")
+				return &http.Response{StatusCode: 200, StatusText: "OK"}
+			}), middleware.CORSOpts{
+				AllowedOrigins:       []string{"https://app.example.com", "https://*.test.com"},
+				AllowedOriginRegexes: []*regexp.Regexp{regexp.MustCompile(`http://localhost:\d+`), regexp.MustCompile(`https://example\.com`)},
+				AllowedMethods:       []string{"get", "put"},
+				AllowedHeaders:       []string{"Content-Type", "X-Request-ID"},
+				AllowCredentials:     true,
+				MaxAge:               time.Hour,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := m.ServeHTTP(context.Background(), req)
+
+			assert.Equal(t, tt.want, got.StatusCode)
+			assert.Equal(t, tt.wantOrigin, got.Header.Get("Access-Control-Allow-Origin"))
+			assert.Equal(t, tt.wantHeaders, got.Header.Get("Access-Control-Allow-Headers"))
+			if tt.want == 204 {
+				assert.Equal(t, "GET, PUT", got.Header.Get("Access-Control-Allow-Methods"))
+				assert.Equal(t, "true", got.Header.Get("Access-Control-Allow-Credentials"))
+				assert.Equal(t, "3600", got.Header.Get("Access-Control-Max-Age"))
+			}
+		})
+	}
+}
+
+func TestCORS_ServeHTTP(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        middleware.CORSOpts
+		origin      string
+		wantOrigin  string
+		wantExposed string
+	}{
+		{
+			name:        "Allowed Origin",
+			opts:        middleware.CORSOpts{AllowedOrigins: []string{"https://app.example.com"}, ExposedHeaders: []string{"X-Total"}},
+			origin:      "https://app.example.com",
+			wantOrigin:  "https://app.example.com",
+			wantExposed: "X-Total",
+		},
+		{
+			name:       "All Origins",
+			opts:       middleware.CORSOpts{AllowedOrigins: []string{"*"}},
+			origin:     "https://app.example.com",
+			wantOrigin: "*",
+		},
+		{
+			name:   "Disallowed Origin",
+			opts:   middleware.CORSOpts{AllowedOrigins: []string{"https://app.example.com"}},
+			origin: "https://evil.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/test"},
+				Header: http.Header{"Origin": []string{tt.origin}},
+			}
+
+			m, err := middleware.NewCORS(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+				return &http.Response{StatusCode: 200, StatusText: "OK"}
+			}), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := m.ServeHTTP(context.Background(), req)
+
+			assert.Equal(t, 200, got.StatusCode)
+			assert.Equal(t, tt.wantOrigin, got.Header.Get("Access-Control-Allow-Origin"))
+			assert.Equal(t, tt.wantExposed, got.Header.Get("Access-Control-Expose-Headers"))
+			assert.Equal(t, "Origin", got.Header.Get("Vary"))
+		})
+	}
+}
+
+func TestNewCORS_ErrorsOnAllOriginsWithCredentials(t *testing.T) {
+	_, err := middleware.NewCORS(nil, middleware.CORSOpts{
+		AllowedOrigins:   []string{"*"},
+		AllowCredentials: true,
+	})
+
+	assert.Error(t, err)
+}
+
+func TestCORS_ServeHTTPFramesHeaderlessResponse(t *testing.T) {
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Header: http.Header{"Origin": []string{"https://app.example.com"}},
+	}
+
+	m, err := middleware.NewCORS(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		return &http.Response{StatusCode: 502, StatusText: "Bad Gateway"}
+	}), middleware.CORSOpts{AllowedOrigins: []string{"https://app.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := m.ServeHTTP(context.Background(), req)
+
+	assert.Equal(t, "0", got.Header.Get("Content-Length"))
+	assert.Equal(t, "close", got.Header.Get("Connection"))
+	assert.Equal(t, "Origin", got.Header.Get("Vary"))
+}
@@ -0,0 +1,434 @@
+package middleware
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	diskMetaExt = ".meta"
+	diskBodyExt = ".body"
+	diskTmpPre  = "tmp-"
+)
+
+// DiskStoreOpts configures a disk store.
+type DiskStoreOpts struct {
+	// Dir is the directory entries are stored in.
+	Dir string
+
+	// MaxBytes is the disk budget of the store. Defaults to 1GB.
+	MaxBytes int64
+}
+
+type diskItem struct {
+	key     string
+	name    string
+	body    string
+	entry   *CacheEntry
+	size    int64
+	expires time.Time
+}
+
+type diskMeta struct {
+	Key     string
+	Body    string
+	Expires time.Time
+	Entry   *CacheEntry
+}
+
+// DiskStore is a size bounded cache store on disk.
+//
+// Each entry is written to the directory as a metadata file and a
+// body file. Bodies are streamed from disk when they are served, and
+// stored entries are loaded again when the store is created. When
+// the disk budget is exceeded, the least recently used entries are
+// evicted.
+//
+// Every write of an entry gets a new body file, so an entry never
+// opens the body of another write. Opening the body of an entry that
+// was evicted or replaced since it was returned fails.
+type DiskStore struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	items map[string]*list.Element
+	ll    *list.List
+	stats CacheStats
+}
+
+// NewDiskStore returns a disk store, loading the entries in the directory.
+func NewDiskStore(opts DiskStoreOpts) (*DiskStore, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("middleware: disk store requires a directory")
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 1 << 30
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &DiskStore{
+		dir:      opts.Dir,
+		maxBytes: opts.MaxBytes,
+		items:    map[string]*list.Element{},
+		ll:       list.New(),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// load indexes the entries in the directory, removing expired
+// and incomplete entries.
+func (s *DiskStore) load() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	type loaded struct {
+		item   *diskItem
+		stored time.Time
+	}
+
+	now := time.Now()
+	var (
+		items  []loaded
+		bodies []string
+	)
+	for _, fi := range files {
+		name := fi.Name()
+		if strings.HasPrefix(name, diskTmpPre) {
+			_ = os.Remove(filepath.Join(s.dir, name))
+			continue
+		}
+		if strings.HasSuffix(name, diskBodyExt) {
+			bodies = append(bodies, strings.TrimSuffix(name, diskBodyExt))
+			continue
+		}
+		if !strings.HasSuffix(name, diskMetaExt) {
+			continue
+		}
+		name = strings.TrimSuffix(name, diskMetaExt)
+
+		meta, err := s.readMeta(name)
+		if err != nil || meta.Entry == nil || now.After(meta.Expires) || s.name(meta.Key) != name {
+			s.removeFiles(name, "")
+			continue
+		}
+
+		size := fi.Size()
+		if meta.Body != "" {
+			bfi, err := os.Stat(s.path(meta.Body, diskBodyExt))
+			if err != nil {
+				s.removeFiles(name, "")
+				continue
+			}
+			size += bfi.Size()
+		} else if len(meta.Entry.Vary) == 0 {
+			s.removeFiles(name, "")
+			continue
+		}
+
+		items = append(items, loaded{
+			item: &diskItem{
+				key:     meta.Key,
+				name:    name,
+				body:    meta.Body,
+				entry:   meta.Entry,
+				size:    size,
+				expires: meta.Expires,
+			},
+			stored: meta.Entry.Stored,
+		})
+	}
+
+	// Bodies left by replaced or incomplete entries are removed.
+	used := make(map[string]bool, len(items))
+	for _, l := range items {
+		used[l.item.body] = true
+	}
+	for _, body := range bodies {
+		if !used[body] {
+			_ = os.Remove(s.path(body, diskBodyExt))
+		}
+	}
+
+	// The most recently stored entries are the most recently used.
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].stored.After(items[j].stored)
+	})
+	for _, l := range items {
+		s.items[l.item.key] = s.ll.PushBack(l.item)
+		s.stats.Bytes += l.item.size
+		s.stats.Entries++
+	}
+
+	for s.stats.Bytes > s.maxBytes {
+		s.evict()
+	}
+
+	return nil
+}
+
+// Get returns the entry stored under the key.
+func (s *DiskStore) Get(key string) (*CacheEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		s.stats.Misses++
+		return nil, false
+	}
+
+	item := el.Value.(*diskItem)
+	if time.Now().After(item.expires) {
+		s.remove(el)
+		s.stats.Misses++
+		return nil, false
+	}
+
+	s.ll.MoveToFront(el)
+	s.stats.Hits++
+
+	e := *item.entry
+	if item.body != "" {
+		path := s.path(item.body, diskBodyExt)
+		e.Open = func() (io.ReadCloser, error) {
+			return os.Open(path)
+		}
+	}
+	return &e, true
+}
+
+// Set stores the entry under the key for the given duration.
+func (s *DiskStore) Set(key string, e *CacheEntry, ttl time.Duration) {
+	name := s.name(key)
+	expires := time.Now().Add(ttl)
+
+	// Files are written before locking, and moved into place once complete.
+	bodyTmp, bodySize, err := s.writeBody(e)
+	if err != nil {
+		return
+	}
+	var body string
+	if bodyTmp != "" {
+		body = name + "-" + randomString()
+	}
+	entry := *e
+	entry.Body = nil
+	entry.Open = nil
+
+	metaTmp, metaSize, err := s.writeMeta(key, body, &entry, expires)
+	if err != nil {
+		if bodyTmp != "" {
+			_ = os.Remove(bodyTmp)
+		}
+		return
+	}
+
+	size := bodySize + metaSize
+	if size > s.maxBytes {
+		_ = os.Remove(bodyTmp)
+		_ = os.Remove(metaTmp)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+
+	for s.stats.Bytes+size > s.maxBytes {
+		s.evict()
+	}
+
+	if bodyTmp != "" {
+		if err := os.Rename(bodyTmp, s.path(body, diskBodyExt)); err != nil {
+			_ = os.Remove(bodyTmp)
+			_ = os.Remove(metaTmp)
+			return
+		}
+	}
+	if err := os.Rename(metaTmp, s.path(name, diskMetaExt)); err != nil {
+		_ = os.Remove(metaTmp)
+		s.removeFiles(name, body)
+		return
+	}
+
+	s.items[key] = s.ll.PushFront(&diskItem{
+		key:     key,
+		name:    name,
+		body:    body,
+		entry:   &entry,
+		size:    size,
+		expires: expires,
+	})
+	s.stats.Bytes += size
+	s.stats.Entries++
+}
+
+// Delete removes the entry stored under the key.
+func (s *DiskStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+}
+
+// Range calls fn for each stored entry until fn returns false.
+func (s *DiskStore) Range(fn func(key string, e *CacheEntry) bool) {
+	s.mu.Lock()
+	now := time.Now()
+	items := make([]*diskItem, 0, len(s.items))
+	for _, el := range s.items {
+		if item := el.Value.(*diskItem); !now.After(item.expires) {
+			items = append(items, item)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, item := range items {
+		if !fn(item.key, item.entry) {
+			return
+		}
+	}
+}
+
+// Stats returns the store statistics.
+func (s *DiskStore) Stats() CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stats
+}
+
+func (s *DiskStore) writeBody(e *CacheEntry) (string, int64, error) {
+	if len(e.Vary) > 0 {
+		return "", 0, nil
+	}
+
+	var src io.Reader = bytes.NewReader(e.Body)
+	if e.Open != nil {
+		rc, err := e.Open()
+		if err != nil {
+			return "", 0, err
+		}
+		defer rc.Close()
+		src = rc
+	}
+
+	f, err := ioutil.TempFile(s.dir, diskTmpPre)
+	if err != nil {
+		return "", 0, err
+	}
+
+	n, err := io.Copy(f, src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", 0, err
+	}
+	return f.Name(), n, nil
+}
+
+func (s *DiskStore) writeMeta(key, body string, e *CacheEntry, expires time.Time) (string, int64, error) {
+	b, err := json.Marshal(diskMeta{Key: key, Body: body, Expires: expires, Entry: e})
+	if err != nil {
+		return "", 0, err
+	}
+
+	f, err := ioutil.TempFile(s.dir, diskTmpPre)
+	if err != nil {
+		return "", 0, err
+	}
+
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", 0, err
+	}
+	return f.Name(), int64(len(b)), nil
+}
+
+func (s *DiskStore) readMeta(name string) (*diskMeta, error) {
+	b, err := ioutil.ReadFile(s.path(name, diskMetaExt))
+	if err != nil {
+		return nil, err
+	}
+
+	var meta diskMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func (s *DiskStore) evict() {
+	el := s.ll.Back()
+	if el == nil {
+		return
+	}
+
+	s.remove(el)
+	s.stats.Evictions++
+}
+
+func (s *DiskStore) remove(el *list.Element) {
+	item := el.Value.(*diskItem)
+	s.unlink(el)
+	s.removeFiles(item.name, item.body)
+}
+
+func (s *DiskStore) unlink(el *list.Element) {
+	item := el.Value.(*diskItem)
+	s.ll.Remove(el)
+	delete(s.items, item.key)
+	s.stats.Bytes -= item.size
+	s.stats.Entries--
+}
+
+func (s *DiskStore) removeFiles(name, body string) {
+	_ = os.Remove(s.path(name, diskMetaExt))
+	if body != "" {
+		_ = os.Remove(s.path(body, diskBodyExt))
+	}
+}
+
+// name returns the file name of the key.
+func (s *DiskStore) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *DiskStore) path(name, ext string) string {
+	return filepath.Join(s.dir, name+ext)
+}
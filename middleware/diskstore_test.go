@@ -0,0 +1,282 @@
+package middleware_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDiskStore_RequiresDir(t *testing.T) {
+	_, err := middleware.NewDiskStore(middleware.DiskStoreOpts{})
+
+	assert.Error(t, err)
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := middleware.NewDiskStore(middleware.DiskStoreOpts{Dir: dir})
+	require.NoError(t, err)
+
+	s.Set("a", &middleware.CacheEntry{
+		StatusCode: 200,
+		StatusText: "OK",
+		Header:     http.Header{"Content-Length": []string{"4"}},
+		Body:       []byte("test"),
+	}, time.Minute)
+
+	got, ok := s.Get("a")
+	require.True(t, ok)
+	assert.Equal(t, 200, got.StatusCode)
+	assert.Equal(t, "4", got.Header.Get("Content-Length"))
+	assert.Nil(t, got.Body)
+	body, err := got.Open()
+	require.NoError(t, err)
+	b, _ := ioutil.ReadAll(body)
+	_ = body.Close()
+	assert.Equal(t, "test", string(b))
+
+	s.Delete("a")
+
+	_, ok = s.Get("a")
+	assert.False(t, ok)
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 0)
+}
+
+func TestDiskStore_LoadsEntries(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := middleware.NewDiskStore(middleware.DiskStoreOpts{Dir: dir})
+	require.NoError(t, err)
+	s.Set("a", &middleware.CacheEntry{StatusCode: 200, Body: []byte("test")}, time.Minute)
+	s.Set("b", &middleware.CacheEntry{Vary: []string{"Accept"}}, time.Minute)
+	s.Set("c", &middleware.CacheEntry{StatusCode: 200}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	s, err = middleware.NewDiskStore(middleware.DiskStoreOpts{Dir: dir})
+	require.NoError(t, err)
+
+	got, ok := s.Get("a")
+	require.True(t, ok)
+	body, err := got.Open()
+	require.NoError(t, err)
+	b, _ := ioutil.ReadAll(body)
+	_ = body.Close()
+	assert.Equal(t, "test", string(b))
+	got, ok = s.Get("b")
+	require.True(t, ok)
+	assert.Equal(t, []string{"Accept"}, got.Vary)
+	_, ok = s.Get("c")
+	assert.False(t, ok)
+	assert.Equal(t, 2, s.Stats().Entries)
+}
+
+func TestDiskStore_Evicts(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := middleware.NewDiskStore(middleware.DiskStoreOpts{Dir: dir, MaxBytes: 3000})
+	require.NoError(t, err)
+
+	body := make([]byte, 1000)
+	s.Set("a", &middleware.CacheEntry{Body: body}, time.Minute)
+	s.Set("b", &middleware.CacheEntry{Body: body}, time.Minute)
+	s.Get("a")
+	s.Set("c", &middleware.CacheEntry{Body: body}, time.Minute)
+
+	_, ok := s.Get("b")
+	assert.False(t, ok)
+	_, ok = s.Get("a")
+	assert.True(t, ok)
+	stats := s.Stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.True(t, stats.Bytes <= 3000)
+	assert.Equal(t, int64(1), stats.Evictions)
+}
+
+func TestCache_ServeHTTPWithDiskStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := middleware.NewDiskStore(middleware.DiskStoreOpts{Dir: dir})
+	require.NoError(t, err)
+	calls := 0
+	cache := middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		calls++
+
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header:     http.Header{"Cache-Control": []string{"max-age=60"}},
+			Body:       bytes.NewReader([]byte("test")),
+		}
+	}), middleware.CacheOpts{Store: store})
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Host:   "localhost",
+		Header: http.Header{},
+	}
+
+	for _, status := range []string{"MISS", "HIT"} {
+		resp := cache.ServeHTTP(context.Background(), req)
+
+		assert.Equal(t, status, resp.Header.Get("X-Cache"))
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "test", string(body))
+	}
+	assert.Equal(t, 1, calls)
+}
+
+func TestDiskStore_OpenFailsAfterEviction(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := middleware.NewDiskStore(middleware.DiskStoreOpts{Dir: dir})
+	require.NoError(t, err)
+	s.Set("a", &middleware.CacheEntry{StatusCode: 200, Body: []byte("test")}, time.Minute)
+	got, ok := s.Get("a")
+	require.True(t, ok)
+
+	s.Delete("a")
+
+	_, err = got.Open()
+	assert.Error(t, err)
+}
+
+func TestDiskStore_OpenFailsAfterReplace(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := middleware.NewDiskStore(middleware.DiskStoreOpts{Dir: dir})
+	require.NoError(t, err)
+	s.Set("a", &middleware.CacheEntry{StatusCode: 200, Body: []byte("test")}, time.Minute)
+	old, ok := s.Get("a")
+	require.True(t, ok)
+
+	s.Set("a", &middleware.CacheEntry{StatusCode: 200, Body: []byte("replaced")}, time.Minute)
+
+	_, err = old.Open()
+	assert.Error(t, err)
+	got, ok := s.Get("a")
+	require.True(t, ok)
+	body, err := got.Open()
+	require.NoError(t, err)
+	b, _ := ioutil.ReadAll(body)
+	_ = body.Close()
+	assert.Equal(t, "replaced", string(b))
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 2)
+}
+
+// evictingStore evicts entries right after they are returned.
+type evictingStore struct {
+	middleware.CacheStore
+}
+
+func (s evictingStore) Get(key string) (*middleware.CacheEntry, bool) {
+	e, ok := s.CacheStore.Get(key)
+	if ok && len(e.Vary) == 0 {
+		s.CacheStore.Delete(key)
+	}
+	return e, ok
+}
+
+func TestCache_ServeHTTPRefetchesEvictedBody(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := middleware.NewDiskStore(middleware.DiskStoreOpts{Dir: dir})
+	require.NoError(t, err)
+	calls := 0
+	cache := middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		calls++
+
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header:     http.Header{"Cache-Control": []string{"max-age=60"}},
+			Body:       bytes.NewReader([]byte("test")),
+		}
+	}), middleware.CacheOpts{Store: evictingStore{store}})
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Host:   "localhost",
+		Header: http.Header{},
+	}
+
+	for i := 0; i < 2; i++ {
+		resp := cache.ServeHTTP(context.Background(), req)
+
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "MISS", resp.Header.Get("X-Cache"))
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "test", string(body))
+	}
+	assert.Equal(t, 2, calls)
+}
+
+func TestCache_ServeHTTPRevalidatesWithDiskStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := middleware.NewDiskStore(middleware.DiskStoreOpts{Dir: dir})
+	require.NoError(t, err)
+	calls := 0
+	cache := middleware.NewCache(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		calls++
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			return &http.Response{
+				StatusCode: 304,
+				StatusText: "Not Modified",
+				Header:     http.Header{"Etag": []string{`"v1"`}},
+			}
+		}
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header: http.Header{
+				"Cache-Control": []string{"no-cache"},
+				"Etag":          []string{`"v1"`},
+			},
+			Body: bytes.NewReader([]byte("test")),
+		}
+	}), middleware.CacheOpts{Store: store})
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Host:   "localhost",
+		Header: http.Header{},
+	}
+
+	for _, status := range []string{"MISS", "REVALIDATED", "REVALIDATED"} {
+		resp := cache.ServeHTTP(context.Background(), req)
+
+		assert.Equal(t, status, resp.Header.Get("X-Cache"))
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "test", string(body))
+	}
+	assert.Equal(t, 3, calls)
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "proxy-cache")
+	require.NoError(t, err)
+	return dir
+}
@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/nrwiersma/proxy/http"
+)
+
+// ForwardAuthOpts configures a forward auth middleware.
+type ForwardAuthOpts struct {
+	// Auth is the handler the auth subrequest is sent to.
+	Auth http.Handler
+
+	// Path is the path of the auth subrequest. Defaults to "/".
+	Path string
+
+	// RequestHeaders are the request headers sent to the auth
+	// service. If empty, all request headers are sent.
+	RequestHeaders []string
+
+	// ResponseHeaders are the auth response headers copied
+	// to the upstream request when the request is allowed.
+	ResponseHeaders []string
+}
+
+// ForwardAuth delegates authentication decisions to an external service.
+//
+// A subrequest is sent to the auth service for each request, with the
+// original method and uri in the X-Forwarded-Method and X-Forwarded-Uri
+// headers. A 2xx response allows the request, any other response is
+// returned to the client.
+type ForwardAuth struct {
+	h    http.Handler
+	opts ForwardAuthOpts
+}
+
+// NewForwardAuth returns a forward auth middleware.
+func NewForwardAuth(h http.Handler, opts ForwardAuthOpts) *ForwardAuth {
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+
+	return &ForwardAuth{
+		h:    h,
+		opts: opts,
+	}
+}
+
+// ServeHTTP serves an HTTP request.
+func (m *ForwardAuth) ServeHTTP(ctx context.Context, r *http.Request) *http.Response {
+	resp := m.opts.Auth.ServeHTTP(ctx, m.authRequest(r))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp
+	}
+
+	for _, k := range m.opts.ResponseHeaders {
+		v, ok := resp.Header[http.CanonicalHeaderKey(k)]
+		if !ok {
+			r.Header.Del(k)
+			continue
+		}
+		r.Header[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+	}
+
+	return m.h.ServeHTTP(ctx, r)
+}
+
+func (m *ForwardAuth) authRequest(r *http.Request) *http.Request {
+	header := http.Header{}
+	if len(m.opts.RequestHeaders) == 0 {
+		for k, v := range r.Header {
+			header[k] = append([]string(nil), v...)
+		}
+		// The subrequest never has a body.
+		header.Del("Content-Length")
+		header.Del("Transfer-Encoding")
+		header.Del("Expect")
+	} else {
+		for _, k := range m.opts.RequestHeaders {
+			if v, ok := r.Header[http.CanonicalHeaderKey(k)]; ok {
+				header[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+			}
+		}
+	}
+
+	header.Set("Host", r.Host)
+	header.Set("X-Forwarded-Method", r.Method)
+	header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	header.Set("X-Forwarded-Host", r.Host)
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	header.Set("X-Forwarded-Proto", proto)
+
+	return &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: m.opts.Path},
+		Host:       r.Host,
+		Proto:      "HTTP/1.1",
+		Header:     header,
+		RequestURI: m.opts.Path,
+		RemoteAddr: r.RemoteAddr,
+		TLS:        r.TLS,
+	}
+}
@@ -0,0 +1,127 @@
+package middleware_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/url"
+	"testing"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardAuth_ServeHTTP(t *testing.T) {
+	auth := http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		assert.Equal(t, "GET", r.Method)
+		assert.Equal(t, "/auth", r.URL.Path)
+		assert.Equal(t, "POST", r.Header.Get("X-Forwarded-Method"))
+		assert.Equal(t, "/test?foo=bar", r.Header.Get("X-Forwarded-Uri"))
+		assert.Equal(t, "example.com", r.Header.Get("X-Forwarded-Host"))
+		assert.Equal(t, "http", r.Header.Get("X-Forwarded-Proto"))
+		assert.Equal(t, "", r.Header.Get("Content-Length"))
+		assert.Nil(t, r.Body)
+
+		if r.Header.Get("Authorization") != "Bearer good" {
+			return &http.Response{
+				StatusCode: 401,
+				StatusText: "Unauthorized",
+				Header:     http.Header{"Content-Length": []string{"6"}},
+				Body:       bytes.NewReader([]byte("denied")),
+			}
+		}
+
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Header: http.Header{
+				"X-User":  []string{"alice"},
+				"X-Other": []string{"other"},
+			},
+		}
+	})
+
+	tests := []struct {
+		name     string
+		auth     string
+		want     int
+		wantBody string
+	}{
+		{
+			name: "Allowed",
+			auth: "Bearer good",
+			want: 200,
+		},
+		{
+			name:     "Denied",
+			auth:     "Bearer bad",
+			want:     401,
+			wantBody: "denied",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method: "POST",
+				URL:    &url.URL{Path: "/test", RawQuery: "foo=bar"},
+				Host:   "example.com",
+				Header: http.Header{
+					"Authorization":  []string{tt.auth},
+					"Content-Length": []string{"4"},
+					"X-User":         []string{"spoofed"},
+				},
+				Body: bytes.NewReader([]byte("body")),
+			}
+
+			m := middleware.NewForwardAuth(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+				assert.Equal(t, "alice", r.Header.Get("X-User"))
+				assert.Equal(t, "", r.Header.Get("X-Other"))
+				assert.Equal(t, "4", r.Header.Get("Content-Length"))
+
+				return &http.Response{StatusCode: 200, StatusText: "OK"}
+			}), middleware.ForwardAuthOpts{
+				Auth:            auth,
+				Path:            "/auth",
+				ResponseHeaders: []string{"X-User"},
+			})
+
+			got := m.ServeHTTP(context.Background(), req)
+
+			assert.Equal(t, tt.want, got.StatusCode)
+			if tt.wantBody != "" {
+				b, _ := ioutil.ReadAll(got.Body)
+				assert.Equal(t, tt.wantBody, string(b))
+			}
+		})
+	}
+}
+
+func TestForwardAuth_ServeHTTPSendsSelectedHeaders(t *testing.T) {
+	auth := http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		assert.Equal(t, "session", r.Header.Get("Cookie"))
+		assert.Equal(t, "", r.Header.Get("X-Other"))
+
+		return &http.Response{StatusCode: 204, StatusText: "No Content"}
+	})
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Header: http.Header{
+			"Cookie":  []string{"session"},
+			"X-Other": []string{"other"},
+		},
+	}
+
+	m := middleware.NewForwardAuth(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		return &http.Response{StatusCode: 200, StatusText: "OK"}
+	}), middleware.ForwardAuthOpts{
+		Auth:           auth,
+		RequestHeaders: []string{"cookie"},
+	})
+
+	got := m.ServeHTTP(context.Background(), req)
+
+	assert.Equal(t, 200, got.StatusCode)
+}
@@ -0,0 +1,186 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/nrwiersma/proxy/http"
+)
+
+var forwardedHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"X-Forwarded-Port",
+}
+
+// ForwardedOpts configures a forwarded headers middleware.
+type ForwardedOpts struct {
+	// TrustedProxies are the networks of proxies whose forwarded
+	// headers are kept. Forwarded headers from all other clients
+	// are overwritten.
+	TrustedProxies []*net.IPNet
+
+	// TrustAll keeps the forwarded headers of all clients.
+	TrustAll bool
+
+	// Port is the port the entrypoint listens on. It is sent as
+	// X-Forwarded-Port when the Host header has no port.
+	Port string
+
+	// Pseudonym is the name of the proxy used in Via headers.
+	// If Pseudonym is empty, "proxy" is used.
+	Pseudonym string
+}
+
+// Forwarded sets the Forwarded, X-Forwarded-* and Via headers.
+type Forwarded struct {
+	h    http.Handler
+	opts ForwardedOpts
+}
+
+// NewForwarded returns a forwarded headers middleware.
+func NewForwarded(h http.Handler, opts ForwardedOpts) *Forwarded {
+	if opts.Pseudonym == "" {
+		opts.Pseudonym = "proxy"
+	}
+
+	return &Forwarded{
+		h:    h,
+		opts: opts,
+	}
+}
+
+// ServeHTTP serves an HTTP request.
+func (f *Forwarded) ServeHTTP(ctx context.Context, r *http.Request) *http.Response {
+	ip := remoteIP(r.RemoteAddr)
+
+	if !f.isTrusted(ip) {
+		for _, k := range forwardedHeaders {
+			r.Header.Del(k)
+		}
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	// The port is the one the client used, which may differ from
+	// the entrypoint port behind a load balancer.
+	_, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		switch {
+		case f.opts.Port != "":
+			port = f.opts.Port
+		case r.TLS != nil:
+			port = "443"
+		default:
+			port = "80"
+		}
+	}
+
+	if ip != nil {
+		appendHeader(r.Header, "X-Forwarded-For", ip.String())
+	}
+	setDefaultHeader(r.Header, "X-Forwarded-Proto", proto)
+	setDefaultHeader(r.Header, "X-Forwarded-Host", r.Host)
+	setDefaultHeader(r.Header, "X-Forwarded-Port", port)
+
+	fwd := "proto=" + proto
+	if ip != nil {
+		fwd = "for=" + forwardedNode(ip) + ";" + fwd
+	}
+	if r.Host != "" {
+		fwd += ";host=" + forwardedValue(r.Host)
+	}
+	appendHeader(r.Header, "Forwarded", fwd)
+
+	via := viaProtocol(r.Proto) + " " + f.opts.Pseudonym
+	appendHeader(r.Header, "Via", via)
+
+	resp := f.h.ServeHTTP(ctx, r)
+
+	if resp != nil {
+		resp.EnsureHeader()
+		appendHeader(resp.Header, "Via", viaProtocol(resp.Proto)+" "+f.opts.Pseudonym)
+	}
+
+	return resp
+}
+
+func (f *Forwarded) isTrusted(ip net.IP) bool {
+	if f.opts.TrustAll {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range f.opts.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the ip of the remote address, or nil.
+func remoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	return net.ParseIP(host)
+}
+
+// appendHeader appends the value to a comma separated header.
+func appendHeader(h http.Header, k, v string) {
+	if prev := h[http.CanonicalHeaderKey(k)]; len(prev) > 0 {
+		v = strings.Join(prev, ", ") + ", " + v
+	}
+	h.Set(k, v)
+}
+
+func setDefaultHeader(h http.Header, k, v string) {
+	if h.Get(k) != "" {
+		return
+	}
+	h.Set(k, v)
+}
+
+// forwardedNode formats the ip as an RFC 7239 node.
+func forwardedNode(ip net.IP) string {
+	if ip.To4() == nil {
+		return `"[` + ip.String() + `]"`
+	}
+	return ip.String()
+}
+
+// forwardedValue quotes the value if it is not a valid token.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.Replace(v, `"`, `\"`, -1) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+// viaProtocol returns the Via protocol of the version, ie "1.1" for "HTTP/1.1".
+func viaProtocol(proto string) string {
+	if proto == "" {
+		return "1.1"
+	}
+	return strings.TrimPrefix(proto, "HTTP/")
+}
@@ -0,0 +1,233 @@
+package middleware_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwarded_ServeHTTP(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+
+	tests := []struct {
+		name   string
+		opts   middleware.ForwardedOpts
+		remote string
+		host   string
+		tls    bool
+		header http.Header
+		want   http.Header
+	}{
+		{
+			name:   "Sets Headers",
+			remote: "192.168.0.1:1234",
+			host:   "example.com",
+			header: http.Header{},
+			want: http.Header{
+				"Forwarded":         []string{"for=192.168.0.1;proto=http;host=example.com"},
+				"X-Forwarded-For":   []string{"192.168.0.1"},
+				"X-Forwarded-Proto": []string{"http"},
+				"X-Forwarded-Host":  []string{"example.com"},
+				"X-Forwarded-Port":  []string{"80"},
+				"Via":               []string{"1.1 proxy"},
+			},
+		},
+		{
+			name:   "Sets TLS Headers",
+			remote: "[2001:db8::1]:1234",
+			host:   "example.com:8443",
+			tls:    true,
+			header: http.Header{},
+			want: http.Header{
+				"Forwarded":         []string{`for="[2001:db8::1]";proto=https;host="example.com:8443"`},
+				"X-Forwarded-For":   []string{"2001:db8::1"},
+				"X-Forwarded-Proto": []string{"https"},
+				"X-Forwarded-Host":  []string{"example.com:8443"},
+				"X-Forwarded-Port":  []string{"8443"},
+				"Via":               []string{"1.1 proxy"},
+			},
+		},
+		{
+			name:   "Prefers Host Port",
+			opts:   middleware.ForwardedOpts{Port: "8080"},
+			remote: "192.168.0.1:1234",
+			host:   "example.com:9000",
+			header: http.Header{},
+			want: http.Header{
+				"Forwarded":         []string{`for=192.168.0.1;proto=http;host="example.com:9000"`},
+				"X-Forwarded-For":   []string{"192.168.0.1"},
+				"X-Forwarded-Proto": []string{"http"},
+				"X-Forwarded-Host":  []string{"example.com:9000"},
+				"X-Forwarded-Port":  []string{"9000"},
+				"Via":               []string{"1.1 proxy"},
+			},
+		},
+		{
+			name:   "Falls Back To Entrypoint Port",
+			opts:   middleware.ForwardedOpts{Port: "8080"},
+			remote: "192.168.0.1:1234",
+			host:   "example.com",
+			header: http.Header{},
+			want: http.Header{
+				"Forwarded":         []string{"for=192.168.0.1;proto=http;host=example.com"},
+				"X-Forwarded-For":   []string{"192.168.0.1"},
+				"X-Forwarded-Proto": []string{"http"},
+				"X-Forwarded-Host":  []string{"example.com"},
+				"X-Forwarded-Port":  []string{"8080"},
+				"Via":               []string{"1.1 proxy"},
+			},
+		},
+		{
+			name:   "Keeps Trusted Port",
+			opts:   middleware.ForwardedOpts{TrustAll: true, Port: "8080"},
+			remote: "192.168.0.1:1234",
+			host:   "example.com",
+			header: http.Header{
+				"X-Forwarded-Port": []string{"443"},
+			},
+			want: http.Header{
+				"Forwarded":         []string{"for=192.168.0.1;proto=http;host=example.com"},
+				"X-Forwarded-For":   []string{"192.168.0.1"},
+				"X-Forwarded-Proto": []string{"http"},
+				"X-Forwarded-Host":  []string{"example.com"},
+				"X-Forwarded-Port":  []string{"443"},
+				"Via":               []string{"1.1 proxy"},
+			},
+		},
+		{
+			name:   "Overwrites Untrusted Headers",
+			opts:   middleware.ForwardedOpts{TrustedProxies: []*net.IPNet{trusted}},
+			remote: "192.168.0.1:1234",
+			host:   "example.com",
+			header: http.Header{
+				"Forwarded":         []string{"for=1.2.3.4"},
+				"X-Forwarded-For":   []string{"1.2.3.4"},
+				"X-Forwarded-Proto": []string{"https"},
+				"Via":               []string{"1.0 other"},
+			},
+			want: http.Header{
+				"Forwarded":         []string{"for=192.168.0.1;proto=http;host=example.com"},
+				"X-Forwarded-For":   []string{"192.168.0.1"},
+				"X-Forwarded-Proto": []string{"http"},
+				"X-Forwarded-Host":  []string{"example.com"},
+				"X-Forwarded-Port":  []string{"80"},
+				"Via":               []string{"1.0 other, 1.1 proxy"},
+			},
+		},
+		{
+			name:   "Keeps Trusted Headers",
+			opts:   middleware.ForwardedOpts{TrustedProxies: []*net.IPNet{trusted}, Pseudonym: "edge"},
+			remote: "10.0.0.1:1234",
+			host:   "example.com",
+			header: http.Header{
+				"Forwarded":         []string{"for=1.2.3.4;proto=https"},
+				"X-Forwarded-For":   []string{"1.2.3.4", "5.6.7.8"},
+				"X-Forwarded-Proto": []string{"https"},
+				"X-Forwarded-Host":  []string{"example.org"},
+				"X-Forwarded-Port":  []string{"443"},
+			},
+			want: http.Header{
+				"Forwarded":         []string{"for=1.2.3.4;proto=https, for=10.0.0.1;proto=http;host=example.com"},
+				"X-Forwarded-For":   []string{"1.2.3.4, 5.6.7.8, 10.0.0.1"},
+				"X-Forwarded-Proto": []string{"https"},
+				"X-Forwarded-Host":  []string{"example.org"},
+				"X-Forwarded-Port":  []string{"443"},
+				"Via":               []string{"1.1 edge"},
+			},
+		},
+		{
+			name:   "Trusts All",
+			opts:   middleware.ForwardedOpts{TrustAll: true},
+			remote: "192.168.0.1:1234",
+			host:   "example.com",
+			header: http.Header{
+				"X-Forwarded-For": []string{"1.2.3.4"},
+			},
+			want: http.Header{
+				"Forwarded":         []string{"for=192.168.0.1;proto=http;host=example.com"},
+				"X-Forwarded-For":   []string{"1.2.3.4, 192.168.0.1"},
+				"X-Forwarded-Proto": []string{"http"},
+				"X-Forwarded-Host":  []string{"example.com"},
+				"X-Forwarded-Port":  []string{"80"},
+				"Via":               []string{"1.1 proxy"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method:     "GET",
+				URL:        &url.URL{Path: "/test"},
+				Host:       tt.host,
+				Proto:      "HTTP/1.1",
+				Header:     tt.header,
+				RemoteAddr: tt.remote,
+			}
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+
+			var got http.Header
+			m := middleware.NewForwarded(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+				got = r.Header
+				return &http.Response{StatusCode: 200, StatusText: "OK"}
+			}), tt.opts)
+
+			_ = m.ServeHTTP(context.Background(), req)
+
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestForwarded_ServeHTTPAddsResponseVia(t *testing.T) {
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: "/test"},
+		Host:       "example.com",
+		Proto:      "HTTP/1.1",
+		Header:     http.Header{},
+		RemoteAddr: "192.168.0.1:1234",
+	}
+
+	m := middleware.NewForwarded(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: 200,
+			StatusText: "OK",
+			Proto:      "HTTP/1.0",
+			Header:     http.Header{"Via": []string{"1.1 upstream"}},
+		}
+	}), middleware.ForwardedOpts{})
+
+	got := m.ServeHTTP(context.Background(), req)
+
+	assert.Equal(t, "1.1 upstream, 1.0 proxy", got.Header.Get("Via"))
+}
+
+func TestForwarded_ServeHTTPAddsViaToHeaderlessResponse(t *testing.T) {
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: "/test"},
+		Host:       "example.com",
+		Proto:      "HTTP/1.1",
+		Header:     http.Header{},
+		RemoteAddr: "192.168.0.1:1234",
+	}
+
+	m := middleware.NewForwarded(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		return &http.Response{StatusCode: 502, StatusText: "Bad Gateway"}
+	}), middleware.ForwardedOpts{})
+
+	got := m.ServeHTTP(context.Background(), req)
+
+	assert.Equal(t, "1.1 proxy", got.Header.Get("Via"))
+	assert.Equal(t, "0", got.Header.Get("Content-Length"))
+	assert.Equal(t, "close", got.Header.Get("Connection"))
+}
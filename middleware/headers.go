@@ -0,0 +1,299 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"strings"
+	"text/template"
+
+	"github.com/nrwiersma/proxy/http"
+)
+
+// StatusRange is an inclusive range of status codes.
+type StatusRange struct {
+	From int
+	To   int
+}
+
+// Contains determines if the status code is in the range.
+func (r StatusRange) Contains(code int) bool {
+	return code >= r.From && code <= r.To
+}
+
+// HeaderRules are header manipulation rules.
+//
+// Rules are applied in the order rename, remove, set, add. Values
+// may be templates, see HeaderData for the available fields.
+type HeaderRules struct {
+	// Rename renames headers from the key to the value.
+	Rename map[string]string
+
+	// Remove removes headers.
+	Remove []string
+
+	// Set sets headers, replacing existing values.
+	Set map[string]string
+
+	// Add adds header values.
+	Add map[string]string
+
+	// StatusCodes restricts response rules to the given status codes.
+	// If StatusCodes is empty, the rules are applied to all responses.
+	StatusCodes []StatusRange
+}
+
+// HeadersOpts configures a headers middleware.
+type HeadersOpts struct {
+	// Route is the name of the route the middleware is on.
+	Route string
+
+	// Request are the rules applied to the request.
+	Request HeaderRules
+
+	// Response are the rules applied to the response.
+	Response HeaderRules
+
+	// RequestID sets a generated X-Request-Id header on requests
+	// without one, and on their responses.
+	RequestID bool
+}
+
+// HeaderData is the data available in header value templates.
+type HeaderData struct {
+	ClientIP              string
+	Route                 string
+	RequestID             string
+	Method                string
+	Host                  string
+	Path                  string
+	TLSVersion            string
+	TLSServerName         string
+	ClientCertSubject     string
+	ClientCertFingerprint string
+}
+
+type headerValue struct {
+	raw  string
+	tmpl *template.Template
+}
+
+func newHeaderValue(v string) (headerValue, error) {
+	if !strings.Contains(v, "{{") {
+		return headerValue{raw: v}, nil
+	}
+
+	tmpl, err := template.New("").Option("missingkey=zero").Parse(v)
+	if err != nil {
+		return headerValue{}, err
+	}
+	return headerValue{tmpl: tmpl}, nil
+}
+
+func (v headerValue) render(data *HeaderData) string {
+	if v.tmpl == nil {
+		return v.raw
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := v.tmpl.Execute(buf, data); err != nil {
+		return ""
+	}
+
+	// Template data comes from the request, so remove anything that
+	// would end the header line.
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '\r', '\n', 0:
+			return -1
+		}
+		return r
+	}, buf.String())
+}
+
+type headerRules struct {
+	rename      map[string]string
+	remove      []string
+	set         map[string]headerValue
+	add         map[string]headerValue
+	statusCodes []StatusRange
+}
+
+func newHeaderRules(r HeaderRules) (headerRules, error) {
+	rules := headerRules{
+		rename:      r.Rename,
+		remove:      r.Remove,
+		set:         make(map[string]headerValue, len(r.Set)),
+		add:         make(map[string]headerValue, len(r.Add)),
+		statusCodes: r.StatusCodes,
+	}
+
+	for k, v := range r.Set {
+		val, err := newHeaderValue(v)
+		if err != nil {
+			return headerRules{}, err
+		}
+		rules.set[k] = val
+	}
+	for k, v := range r.Add {
+		val, err := newHeaderValue(v)
+		if err != nil {
+			return headerRules{}, err
+		}
+		rules.add[k] = val
+	}
+
+	return rules, nil
+}
+
+func (r headerRules) matches(code int) bool {
+	if len(r.statusCodes) == 0 {
+		return true
+	}
+
+	for _, rng := range r.statusCodes {
+		if rng.Contains(code) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r headerRules) apply(h http.Header, data *HeaderData) {
+	for from, to := range r.rename {
+		vals, ok := h[http.CanonicalHeaderKey(from)]
+		if !ok {
+			continue
+		}
+		h.Del(from)
+		h[http.CanonicalHeaderKey(to)] = vals
+	}
+	for _, k := range r.remove {
+		h.Del(k)
+	}
+	for k, v := range r.set {
+		h.Set(k, v.render(data))
+	}
+	for k, v := range r.add {
+		h.Add(k, v.render(data))
+	}
+}
+
+// Headers manipulates request and response headers.
+type Headers struct {
+	h     http.Handler
+	route string
+	reqID bool
+	req   headerRules
+	resp  headerRules
+}
+
+// NewHeaders returns a headers middleware.
+func NewHeaders(h http.Handler, opts HeadersOpts) (*Headers, error) {
+	req, err := newHeaderRules(opts.Request)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := newHeaderRules(opts.Response)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Headers{
+		h:     h,
+		route: opts.Route,
+		reqID: opts.RequestID,
+		req:   req,
+		resp:  resp,
+	}, nil
+}
+
+// ServeHTTP serves an HTTP request.
+//
+// If request IDs are enabled and the request has no X-Request-Id
+// header, the generated request ID is set on the request and the
+// response.
+func (m *Headers) ServeHTTP(ctx context.Context, r *http.Request) *http.Response {
+	data := m.data(r)
+
+	var reqID string
+	if m.reqID && r.Header.Get("X-Request-Id") == "" && data.RequestID != "" {
+		reqID = data.RequestID
+		r.Header.Set("X-Request-Id", reqID)
+	}
+
+	m.req.apply(r.Header, data)
+
+	resp := m.h.ServeHTTP(ctx, r)
+	if resp == nil {
+		return nil
+	}
+
+	if reqID != "" && resp.Header.Get("X-Request-Id") == "" {
+		resp.EnsureHeader()
+		resp.Header.Set("X-Request-Id", reqID)
+	}
+
+	if !m.resp.matches(resp.StatusCode) {
+		return resp
+	}
+
+	resp.EnsureHeader()
+	m.resp.apply(resp.Header, data)
+
+	return resp
+}
+
+func (m *Headers) data(r *http.Request) *HeaderData {
+	data := &HeaderData{
+		Route:     m.route,
+		RequestID: r.Header.Get("X-Request-Id"),
+		Method:    r.Method,
+		Host:      r.Host,
+	}
+	if r.URL != nil {
+		data.Path = r.URL.Path
+	}
+	if ip := remoteIP(r.RemoteAddr); ip != nil {
+		data.ClientIP = ip.String()
+	}
+	if data.RequestID == "" {
+		data.RequestID = newRequestID()
+	}
+
+	if r.TLS != nil {
+		data.TLSVersion = tlsVersionName(r.TLS.Version)
+		data.TLSServerName = r.TLS.ServerName
+	}
+	if cert := r.ClientCertificate(); cert != nil {
+		data.ClientCertSubject = cert.Subject.String()
+		data.ClientCertFingerprint = http.Fingerprint(cert)
+	}
+
+	return data
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,231 @@
+package middleware_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net/url"
+	"testing"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHeaders_ErrorsOnInvalidTemplate(t *testing.T) {
+	_, err := middleware.NewHeaders(nil, middleware.HeadersOpts{
+		Request: middleware.HeaderRules{Set: map[string]string{"X-Foo": "{{ .Foo"}},
+	})
+
+	assert.Error(t, err)
+}
+
+func TestHeaders_ServeHTTPRequest(t *testing.T) {
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Host:   "example.com",
+		Header: http.Header{
+			"X-Old":        []string{"foo"},
+			"X-Remove":     []string{"bar"},
+			"X-Set":        []string{"baz"},
+			"X-Add":        []string{"bat"},
+			"X-Request-Id": []string{"abc"},
+		},
+		RemoteAddr: "192.168.0.1:1234",
+		TLS:        &tls.ConnectionState{Version: tls.VersionTLS12, ServerName: "example.com"},
+	}
+
+	m, err := middleware.NewHeaders(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		want := http.Header{
+			"X-New":        []string{"foo"},
+			"X-Set":        []string{"test-route 192.168.0.1"},
+			"X-Add":        []string{"bat", "abc"},
+			"X-Tls":        []string{"1.2 example.com"},
+			"X-Request-Id": []string{"abc"},
+		}
+		assert.Equal(t, want, r.Header)
+
+		return &http.Response{StatusCode: 200, StatusText: "OK"}
+	}), middleware.HeadersOpts{
+		Route: "test-route",
+		Request: middleware.HeaderRules{
+			Rename: map[string]string{"X-Old": "X-New"},
+			Remove: []string{"x-remove"},
+			Set: map[string]string{
+				"X-Set": "{{ .Route }} {{ .ClientIP }}",
+				"X-TLS": "{{ .TLSVersion }} {{ .TLSServerName }}",
+			},
+			Add: map[string]string{"X-Add": "{{ .RequestID }}"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = m.ServeHTTP(context.Background(), req)
+}
+
+func TestHeaders_ServeHTTPStripsLineBreaksFromTemplates(t *testing.T) {
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/a\r\nX-Evil: 1\x00"},
+		Host:   "example.com",
+		Header: http.Header{},
+	}
+
+	m, err := middleware.NewHeaders(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		assert.Equal(t, "/aX-Evil: 1", r.Header.Get("X-Path"))
+
+		return &http.Response{StatusCode: 200, StatusText: "OK", Header: http.Header{"Content-Length": []string{"0"}}}
+	}), middleware.HeadersOpts{
+		Request:  middleware.HeaderRules{Set: map[string]string{"X-Path": "{{ .Path }}"}},
+		Response: middleware.HeaderRules{Set: map[string]string{"X-Path": "{{ .Path }}"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := m.ServeHTTP(context.Background(), req)
+
+	assert.Equal(t, "/aX-Evil: 1", got.Header.Get("X-Path"))
+	assert.Empty(t, got.Header.Get("X-Evil"))
+}
+
+func TestHeaders_ServeHTTPResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		codes  []middleware.StatusRange
+		want   string
+	}{
+		{
+			name:   "All Status Codes",
+			status: 500,
+			want:   "max-age=31536000",
+		},
+		{
+			name:   "Matching Status Code",
+			status: 204,
+			codes:  []middleware.StatusRange{{From: 200, To: 299}},
+			want:   "max-age=31536000",
+		},
+		{
+			name:   "Non Matching Status Code",
+			status: 404,
+			codes:  []middleware.StatusRange{{From: 200, To: 299}, {From: 500, To: 500}},
+			want:   "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/test"},
+				Header: http.Header{},
+			}
+
+			m, err := middleware.NewHeaders(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+				return &http.Response{
+					StatusCode: tt.status,
+					Header:     http.Header{"X-Powered-By": []string{"php"}},
+				}
+			}), middleware.HeadersOpts{
+				Response: middleware.HeaderRules{
+					Remove:      []string{"X-Powered-By"},
+					Set:         map[string]string{"Strict-Transport-Security": "max-age=31536000"},
+					StatusCodes: tt.codes,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := m.ServeHTTP(context.Background(), req)
+
+			assert.Equal(t, tt.want, got.Header.Get("Strict-Transport-Security"))
+			assert.Equal(t, tt.want == "", got.Header.Get("X-Powered-By") != "")
+		})
+	}
+}
+
+func TestHeaders_ServeHTTPFramesHeaderlessResponse(t *testing.T) {
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Header: http.Header{"X-Request-Id": []string{"abc"}},
+	}
+
+	m, err := middleware.NewHeaders(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		return &http.Response{StatusCode: 502, StatusText: "Bad Gateway"}
+	}), middleware.HeadersOpts{
+		Response: middleware.HeaderRules{
+			Set: map[string]string{"Strict-Transport-Security": "max-age=31536000"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := m.ServeHTTP(context.Background(), req)
+
+	want := http.Header{
+		"Content-Type":              []string{"text/plain; charset=utf-8"},
+		"Connection":                []string{"close"},
+		"Content-Length":            []string{"0"},
+		"Strict-Transport-Security": []string{"max-age=31536000"},
+	}
+	assert.Equal(t, want, got.Header)
+}
+
+func TestHeaders_ServeHTTPSetsRequestID(t *testing.T) {
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Header: http.Header{},
+	}
+
+	var reqID string
+	m, err := middleware.NewHeaders(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		reqID = r.Header.Get("X-Request-Id")
+		return &http.Response{StatusCode: 200, StatusText: "OK", Header: http.Header{"Content-Length": []string{"0"}}}
+	}), middleware.HeadersOpts{
+		Response: middleware.HeaderRules{
+			Set: map[string]string{"X-Trace": "{{ .RequestID }}"},
+		},
+		RequestID: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := m.ServeHTTP(context.Background(), req)
+
+	assert.NotEmpty(t, reqID)
+	assert.Equal(t, reqID, got.Header.Get("X-Request-Id"))
+	assert.Equal(t, reqID, got.Header.Get("X-Trace"))
+}
+
+func TestHeaders_ServeHTTPOnlySetsRequestIDWhenEnabled(t *testing.T) {
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Header: http.Header{},
+	}
+
+	m, err := middleware.NewHeaders(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		assert.Empty(t, r.Header.Get("X-Request-Id"))
+		return &http.Response{StatusCode: 200, StatusText: "OK", Header: http.Header{"Content-Length": []string{"0"}}}
+	}), middleware.HeadersOpts{
+		Response: middleware.HeaderRules{
+			Set: map[string]string{"X-Frame-Options": "DENY"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := m.ServeHTTP(context.Background(), req)
+
+	assert.Empty(t, got.Header.Get("X-Request-Id"))
+}
@@ -0,0 +1,205 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/nrwiersma/proxy/http"
+)
+
+// ParseCIDRs parses CIDRs or bare IPv4 and IPv6 addresses.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ReadCIDRs reads CIDRs from the reader, one per line.
+func ReadCIDRs(r io.Reader) ([]*net.IPNet, error) {
+	var cidrs []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cidrs = append(cidrs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return ParseCIDRs(cidrs)
+}
+
+// IPFilterOpts configures an ip filter middleware.
+type IPFilterOpts struct {
+	// Allow contains the allowed CIDRs. If there are no
+	// allowed CIDRs, all clients not denied are allowed.
+	Allow []string
+
+	// AllowFile is a file of allowed CIDRs, one per line.
+	AllowFile string
+
+	// Deny contains the denied CIDRs. Denied CIDRs take
+	// precedence over allowed CIDRs.
+	Deny []string
+
+	// DenyFile is a file of denied CIDRs, one per line.
+	DenyFile string
+
+	// TrustedProxies are the networks of proxies whose
+	// X-Forwarded-For headers are used to find the client ip.
+	TrustedProxies []*net.IPNet
+}
+
+// IPFilter allows or denies requests by client ip.
+type IPFilter struct {
+	h    http.Handler
+	opts IPFilterOpts
+
+	mu    sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewIPFilter returns an ip filter middleware.
+func NewIPFilter(h http.Handler, opts IPFilterOpts) (*IPFilter, error) {
+	f := &IPFilter{
+		h:    h,
+		opts: opts,
+	}
+
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reloads the CIDR lists from their files. If loading
+// fails, the current lists are kept.
+func (f *IPFilter) Reload() error {
+	allow, err := loadCIDRs(f.opts.Allow, f.opts.AllowFile)
+	if err != nil {
+		return fmt.Errorf("middleware: invalid allow list: %v", err)
+	}
+	deny, err := loadCIDRs(f.opts.Deny, f.opts.DenyFile)
+	if err != nil {
+		return fmt.Errorf("middleware: invalid deny list: %v", err)
+	}
+
+	f.mu.Lock()
+	f.allow = allow
+	f.deny = deny
+	f.mu.Unlock()
+
+	return nil
+}
+
+// ServeHTTP serves an HTTP request.
+func (f *IPFilter) ServeHTTP(ctx context.Context, r *http.Request) *http.Response {
+	ip := clientIP(r, f.opts.TrustedProxies)
+	if ip == nil || !f.allowed(ip) {
+		return &http.Response{
+			StatusCode: 403,
+			StatusText: "Forbidden",
+			Header: http.Header{
+				"Content-Length": []string{"0"},
+			},
+		}
+	}
+
+	return f.h.ServeHTTP(ctx, r)
+}
+
+func (f *IPFilter) allowed(ip net.IP) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+func loadCIDRs(cidrs []string, file string) ([]*net.IPNet, error) {
+	nets, err := ParseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+
+	if file == "" {
+		return nets, nil
+	}
+
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	fnets, err := ReadCIDRs(fh)
+	if err != nil {
+		return nil, err
+	}
+	return append(nets, fnets...), nil
+}
+
+// clientIP returns the ip of the client. If the remote address is a
+// trusted proxy, the X-Forwarded-For header is walked from the right,
+// returning the first address that is not a trusted proxy.
+func clientIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	ip := remoteIP(r.RemoteAddr)
+	if ip == nil || !containsIP(trusted, ip) {
+		return ip
+	}
+
+	var addrs []string
+	for _, v := range r.Header["X-Forwarded-For"] {
+		addrs = append(addrs, strings.Split(v, ",")...)
+	}
+
+	for i := len(addrs) - 1; i >= 0; i-- {
+		fwdIP := net.ParseIP(strings.TrimSpace(addrs[i]))
+		if fwdIP == nil {
+			// An invalid address cannot be trusted to continue the chain.
+			return ip
+		}
+
+		ip = fwdIP
+		if !containsIP(trusted, ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
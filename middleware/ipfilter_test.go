@@ -0,0 +1,139 @@
+package middleware_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadCIDRs(t *testing.T) {
+	got, err := middleware.ReadCIDRs(strings.NewReader("# list\n10.0.0.0/8\n\n192.0.2.1\n2001:db8::/32\n"))
+
+	if assert.NoError(t, err) {
+		assert.Len(t, got, 3)
+		assert.Equal(t, "192.0.2.1/32", got[1].String())
+	}
+}
+
+func TestReadCIDRs_ErrorsOnInvalidCIDR(t *testing.T) {
+	_, err := middleware.ReadCIDRs(strings.NewReader("10.0.0.0/33"))
+
+	assert.Error(t, err)
+}
+
+func TestIPFilter_ServeHTTP(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    string
+		want   int
+	}{
+		{
+			name:   "Allowed",
+			remote: "192.0.2.10:1234",
+			want:   200,
+		},
+		{
+			name:   "Allowed IPv6",
+			remote: "[2001:db8::1]:1234",
+			want:   200,
+		},
+		{
+			name:   "Denied",
+			remote: "192.0.2.1:1234",
+			want:   403,
+		},
+		{
+			name:   "Not Allowed",
+			remote: "198.51.100.1:1234",
+			want:   403,
+		},
+		{
+			name:   "Trusted Forwarded",
+			remote: "10.0.0.1:1234",
+			xff:    "198.51.100.1, 192.0.2.10, 10.0.0.2",
+			want:   200,
+		},
+		{
+			name:   "Trusted Forwarded Denied",
+			remote: "10.0.0.1:1234",
+			xff:    "192.0.2.10, 192.0.2.1",
+			want:   403,
+		},
+		{
+			name:   "Untrusted Forwarded",
+			remote: "198.51.100.1:1234",
+			xff:    "192.0.2.10",
+			want:   403,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method:     "GET",
+				URL:        &url.URL{Path: "/test"},
+				Header:     http.Header{},
+				RemoteAddr: tt.remote,
+			}
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+
+			m, err := middleware.NewIPFilter(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+				return &http.Response{StatusCode: 200, StatusText: "OK"}
+			}), middleware.IPFilterOpts{
+				Allow:          []string{"192.0.2.0/24", "2001:db8::/32"},
+				Deny:           []string{"192.0.2.1"},
+				TrustedProxies: []*net.IPNet{trusted},
+			})
+			require.NoError(t, err)
+
+			got := m.ServeHTTP(context.Background(), req)
+
+			assert.Equal(t, tt.want, got.StatusCode)
+		})
+	}
+}
+
+func TestIPFilter_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "deny.txt")
+	require.NoError(t, ioutil.WriteFile(file, []byte("192.0.2.1\n"), 0644))
+
+	m, err := middleware.NewIPFilter(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		return &http.Response{StatusCode: 200, StatusText: "OK"}
+	}), middleware.IPFilterOpts{DenyFile: file})
+	require.NoError(t, err)
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: "/test"},
+		Header:     http.Header{},
+		RemoteAddr: "192.0.2.2:1234",
+	}
+	assert.Equal(t, 200, m.ServeHTTP(context.Background(), req).StatusCode)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("192.0.2.0/24\n"), 0644))
+	require.NoError(t, m.Reload())
+	assert.Equal(t, 403, m.ServeHTTP(context.Background(), req).StatusCode)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("invalid\n"), 0644))
+	assert.Error(t, m.Reload())
+	assert.Equal(t, 403, m.ServeHTTP(context.Background(), req).StatusCode)
+}
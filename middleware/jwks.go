@@ -0,0 +1,293 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	nethttp "net/http"
+	"sync"
+	"time"
+)
+
+// ErrUnknownKey is returned when a key id cannot be found in a key set.
+var ErrUnknownKey = errors.New("middleware: unknown key")
+
+// JWKSOpts configures a JSON Web Key Set.
+type JWKSOpts struct {
+	// CacheTTL is how long fetched keys are cached. Defaults to 1 hour.
+	CacheTTL time.Duration
+
+	// MinRefresh is the minimum time between fetches when an
+	// unknown key id is seen. Defaults to 1 minute.
+	MinRefresh time.Duration
+
+	// Timeout is the fetch timeout. Defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+// JWKS is a JSON Web Key Set fetched from a URL.
+//
+// Keys are cached and fetched again when they expire, or when
+// an unknown key id is requested to pick up key rotation.
+// Concurrent requests share a single fetch, which is not
+// bound to the context of any request.
+type JWKS struct {
+	url    string
+	opts   JWKSOpts
+	client *nethttp.Client
+
+	mu       sync.Mutex
+	keys     map[string]interface{}
+	fetched  time.Time
+	fetchErr error
+	fetching chan struct{}
+}
+
+// NewJWKS returns a key set fetched from the given url.
+func NewJWKS(url string, opts JWKSOpts) *JWKS {
+	if opts.CacheTTL <= 0 {
+		opts.CacheTTL = time.Hour
+	}
+	if opts.MinRefresh <= 0 {
+		opts.MinRefresh = time.Minute
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+
+	return &JWKS{
+		url:    url,
+		opts:   opts,
+		client: &nethttp.Client{Timeout: opts.Timeout},
+	}
+}
+
+// Key returns the public or secret key with the given key id. If the
+// kid is empty and the set contains a single key, that key is returned.
+func (s *JWKS) Key(ctx context.Context, kid string) (interface{}, error) {
+	s.mu.Lock()
+	since := time.Since(s.fetched)
+	// Failed fetches also count towards the refresh limit,
+	// so an unreachable key set is not hammered.
+	expired := s.fetched.IsZero() || since > s.opts.CacheTTL || (s.keys == nil && since >= s.opts.MinRefresh)
+	s.mu.Unlock()
+
+	if expired {
+		if err := s.refresh(ctx); err != nil && !s.hasKeys() {
+			return nil, err
+		}
+	}
+
+	key, ok := s.lookup(kid)
+	if ok {
+		return key, nil
+	}
+
+	s.mu.Lock()
+	recent := time.Since(s.fetched) < s.opts.MinRefresh
+	s.mu.Unlock()
+	if recent {
+		return nil, ErrUnknownKey
+	}
+	if err := s.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	key, ok = s.lookup(kid)
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+func (s *JWKS) hasKeys() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.keys != nil
+}
+
+func (s *JWKS) lookup(kid string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// refresh fetches the key set, waiting on a fetch in progress if there
+// is one. The context only bounds the wait, not the fetch itself.
+func (s *JWKS) refresh(ctx context.Context) error {
+	s.mu.Lock()
+	if done := s.fetching; done != nil {
+		s.mu.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.fetchErr
+	}
+	done := make(chan struct{})
+	s.fetching = done
+	s.mu.Unlock()
+
+	keys, err := s.fetch()
+
+	s.mu.Lock()
+	s.fetched = time.Now()
+	s.fetchErr = err
+	if err == nil {
+		s.keys = keys
+	}
+	s.fetching = nil
+	s.mu.Unlock()
+	close(done)
+
+	return err
+}
+
+func (s *JWKS) fetch() (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+	defer cancel()
+
+	req, err := nethttp.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("middleware: could not create jwks request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("middleware: could not fetch jwks: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("middleware: could not fetch jwks: unexpected status %d", resp.StatusCode)
+	}
+
+	return ParseJWKS(io.LimitReader(resp.Body, 1<<20))
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// ParseJWKS parses a JSON Web Key Set, returning a map of key ids
+// to keys. Keys not used for signatures are skipped.
+func ParseJWKS(r io.Reader) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(r).Decode(&set); err != nil {
+		return nil, fmt.Errorf("middleware: invalid jwks: %v", err)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.key()
+		if err != nil {
+			return nil, fmt.Errorf("middleware: invalid jwk '%s': %v", k.Kid, err)
+		}
+		if key == nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (k jwk) key() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var crv elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			crv = elliptic.P256()
+		case "P-384":
+			crv = elliptic.P384()
+		case "P-521":
+			crv = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !crv.IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: crv, X: x, Y: y}, nil
+
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+
+	default:
+		// Unknown key types are ignored.
+		return nil, nil
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
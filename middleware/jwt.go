@@ -0,0 +1,359 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/internal/slices"
+)
+
+var (
+	errInvalidToken     = errors.New("invalid token")
+	errInvalidAlgorithm = errors.New("invalid algorithm")
+	errInvalidSignature = errors.New("invalid signature")
+)
+
+// JWTOpts configures a JWT middleware.
+type JWTOpts struct {
+	// JWKS is the key set used to verify token signatures.
+	JWKS *JWKS
+
+	// Secret is the shared secret used to verify HMAC signatures.
+	Secret []byte
+
+	// Algorithms are the allowed signing algorithms. Defaults to
+	// the RS and ES algorithms if JWKS is set, and the HS algorithms
+	// if Secret is set.
+	Algorithms []string
+
+	// Issuer is the required token issuer.
+	Issuer string
+
+	// Audience contains the accepted audiences. A token must
+	// have at least one of them.
+	Audience []string
+
+	// RequiredClaims are claims that must be present in the token.
+	RequiredClaims []string
+
+	// ClaimHeaders maps claims to the headers they are forwarded in.
+	ClaimHeaders map[string]string
+
+	// Leeway is the allowed clock skew when checking times.
+	Leeway time.Duration
+
+	// OptionalExpiry accepts tokens without an exp claim. By default
+	// tokens must expire.
+	OptionalExpiry bool
+}
+
+// JWT validates bearer JSON Web Tokens.
+type JWT struct {
+	h    http.Handler
+	opts JWTOpts
+}
+
+// NewJWT returns a JWT middleware.
+func NewJWT(h http.Handler, opts JWTOpts) *JWT {
+	if len(opts.Algorithms) == 0 {
+		if opts.JWKS != nil {
+			opts.Algorithms = append(opts.Algorithms, "RS256", "RS384", "RS512", "ES256", "ES384", "ES512")
+		}
+		if len(opts.Secret) > 0 {
+			opts.Algorithms = append(opts.Algorithms, "HS256", "HS384", "HS512")
+		}
+	}
+
+	return &JWT{
+		h:    h,
+		opts: opts,
+	}
+}
+
+// ServeHTTP serves an HTTP request.
+func (m *JWT) ServeHTTP(ctx context.Context, r *http.Request) *http.Response {
+	// Never trust claim headers sent by the client.
+	for _, hdr := range m.opts.ClaimHeaders {
+		r.Header.Del(hdr)
+	}
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return jwtUnauthorized("")
+	}
+
+	claims, err := m.verify(ctx, strings.TrimSpace(auth[7:]))
+	if err != nil {
+		return jwtUnauthorized(err.Error())
+	}
+
+	for claim, hdr := range m.opts.ClaimHeaders {
+		v, ok := claims[claim]
+		if !ok {
+			continue
+		}
+		r.Header.Set(hdr, claimString(v))
+	}
+
+	ctx = context.WithValue(ctx, jwtClaimsKey{}, claims)
+	return m.h.ServeHTTP(ctx, r)
+}
+
+type jwtClaimsKey struct{}
+
+// jwtClaims returns the verified claims in the context.
+func jwtClaims(ctx context.Context) map[string]interface{} {
+	claims, _ := ctx.Value(jwtClaimsKey{}).(map[string]interface{})
+	return claims
+}
+
+func (m *JWT) verify(ctx context.Context, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return nil, errInvalidToken
+	}
+	if !slices.StringContains(hdr.Alg, m.opts.Algorithms) {
+		return nil, errInvalidAlgorithm
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	key, err := m.key(ctx, hdr.Alg, hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifySignature(hdr.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, errInvalidToken
+	}
+	if err = m.validate(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (m *JWT) key(ctx context.Context, alg, kid string) (interface{}, error) {
+	if strings.HasPrefix(alg, "HS") && len(m.opts.Secret) > 0 {
+		return m.opts.Secret, nil
+	}
+	if m.opts.JWKS == nil {
+		return nil, ErrUnknownKey
+	}
+
+	key, err := m.opts.JWKS.Key(ctx, kid)
+	if err != nil {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+func (m *JWT) validate(claims map[string]interface{}) error {
+	now := time.Now()
+
+	if exp, ok := claims["exp"]; ok {
+		t, ok := claimTime(exp)
+		if !ok || !now.Before(t.Add(m.opts.Leeway)) {
+			return errors.New("token is expired")
+		}
+	} else if !m.opts.OptionalExpiry {
+		return errors.New("missing claim exp")
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		t, ok := claimTime(nbf)
+		if !ok || now.Add(m.opts.Leeway).Before(t) {
+			return errors.New("token is not valid yet")
+		}
+	}
+
+	if m.opts.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != m.opts.Issuer {
+			return errors.New("invalid issuer")
+		}
+	}
+
+	if len(m.opts.Audience) > 0 {
+		var aud []string
+		switch v := claims["aud"].(type) {
+		case string:
+			aud = []string{v}
+		case []interface{}:
+			for _, a := range v {
+				if s, ok := a.(string); ok {
+					aud = append(aud, s)
+				}
+			}
+		}
+
+		var found bool
+		for _, a := range aud {
+			if slices.StringContains(a, m.opts.Audience) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("invalid audience")
+		}
+	}
+
+	for _, claim := range m.opts.RequiredClaims {
+		if _, ok := claims[claim]; !ok {
+			return fmt.Errorf("missing claim %s", claim)
+		}
+	}
+
+	return nil
+}
+
+func verifySignature(alg string, key interface{}, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return errInvalidAlgorithm
+	}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return errInvalidAlgorithm
+	}
+
+	switch alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return errInvalidAlgorithm
+		}
+		mac := hmac.New(hash.New, secret)
+		_, _ = mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errInvalidSignature
+		}
+		return nil
+
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errInvalidAlgorithm
+		}
+		h := hash.New()
+		_, _ = h.Write(signed)
+		if err := rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), sig); err != nil {
+			return errInvalidSignature
+		}
+		return nil
+
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errInvalidAlgorithm
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errInvalidSignature
+		}
+		h := hash.New()
+		_, _ = h.Write(signed)
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, h.Sum(nil), r, s) {
+			return errInvalidSignature
+		}
+		return nil
+
+	default:
+		return errInvalidAlgorithm
+	}
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func claimTime(v interface{}) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+func claimString(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case json.Number:
+		return val.String()
+	case bool:
+		return strconv.FormatBool(val)
+	case []interface{}:
+		s := make([]string, 0, len(val))
+		for _, item := range val {
+			s = append(s, claimString(item))
+		}
+		return strings.Join(s, ",")
+	default:
+		b, _ := json.Marshal(val)
+		return string(b)
+	}
+}
+
+func jwtUnauthorized(desc string) *http.Response {
+	auth := "Bearer"
+	if desc != "" {
+		auth = fmt.Sprintf(`Bearer error="invalid_token", error_description="%s"`, desc)
+	}
+
+	return &http.Response{
+		StatusCode: 401,
+		StatusText: "Unauthorized",
+		Header: http.Header{
+			"Www-Authenticate": []string{auth},
+			"Content-Length":   []string{"0"},
+		},
+	}
+}
@@ -0,0 +1,342 @@
+package middleware_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	nethttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJWKS(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	set := jwksJSON(map[string]interface{}{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey})
+	set = strings.Replace(set, `"keys":[`, `"keys":[{"kid":"enc","kty":"RSA","use":"enc"},{"kid":"okp","kty":"OKP"},`, 1)
+
+	got, err := middleware.ParseJWKS(strings.NewReader(set))
+
+	if assert.NoError(t, err) {
+		assert.Len(t, got, 2)
+		assert.Equal(t, &rsaKey.PublicKey, got["rsa"])
+		assert.Equal(t, ecKey.PublicKey.X, got["ec"].(*ecdsa.PublicKey).X)
+	}
+}
+
+func TestParseJWKS_ErrorsOnInvalidKey(t *testing.T) {
+	_, err := middleware.ParseJWKS(strings.NewReader(`{"keys":[{"kid":"1","kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`))
+
+	assert.Error(t, err)
+}
+
+func TestJWKS_KeyRefetchesUnknownKeys(t *testing.T) {
+	key1, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	key2, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	var calls int32
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		keys := map[string]interface{}{"1": &key1.PublicKey}
+		if atomic.AddInt32(&calls, 1) > 1 {
+			keys["2"] = &key2.PublicKey
+		}
+		_, _ = w.Write([]byte(jwksJSON(keys)))
+	}))
+	defer srv.Close()
+
+	jwks := middleware.NewJWKS(srv.URL, middleware.JWKSOpts{MinRefresh: time.Nanosecond})
+
+	_, err := jwks.Key(context.Background(), "1")
+	assert.NoError(t, err)
+	_, err = jwks.Key(context.Background(), "1")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	got, err := jwks.Key(context.Background(), "2")
+	assert.NoError(t, err)
+	assert.Equal(t, key2.PublicKey.X, got.(*ecdsa.PublicKey).X)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	_, err = jwks.Key(context.Background(), "3")
+	assert.Equal(t, middleware.ErrUnknownKey, err)
+}
+
+func TestJWKS_KeyLimitsFailedFetches(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(500)
+	}))
+	defer srv.Close()
+
+	jwks := middleware.NewJWKS(srv.URL, middleware.JWKSOpts{})
+
+	_, err := jwks.Key(context.Background(), "1")
+	assert.Error(t, err)
+	_, err = jwks.Key(context.Background(), "1")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestJWKS_KeyIgnoresRequestCancellation(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		_, _ = w.Write([]byte(jwksJSON(map[string]interface{}{"1": &key.PublicKey})))
+	}))
+	defer srv.Close()
+
+	jwks := middleware.NewJWKS(srv.URL, middleware.JWKSOpts{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := jwks.Key(ctx, "1")
+
+	assert.NoError(t, err)
+}
+
+func TestJWT_ServeHTTPOptionalExpiry(t *testing.T) {
+	secret := []byte("secret")
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Header: http.Header{"Authorization": []string{"Bearer " + signJWT(t, "HS256", "", secret, map[string]interface{}{"sub": "user-1"})}},
+	}
+
+	m := middleware.NewJWT(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		return &http.Response{StatusCode: 200, StatusText: "OK"}
+	}), middleware.JWTOpts{Secret: secret, OptionalExpiry: true})
+
+	got := m.ServeHTTP(context.Background(), req)
+
+	assert.Equal(t, 200, got.StatusCode)
+}
+
+func TestJWT_ServeHTTP(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	secret := []byte("secret")
+
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		_, _ = w.Write([]byte(jwksJSON(map[string]interface{}{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey})))
+	}))
+	defer srv.Close()
+
+	now := time.Now().Unix()
+	claims := map[string]interface{}{
+		"iss":   "https://issuer.test",
+		"aud":   []string{"other", "proxy"},
+		"sub":   "user-1",
+		"roles": []string{"admin", "dev"},
+		"exp":   now + 60,
+		"nbf":   now - 60,
+	}
+	with := func(k string, v interface{}) map[string]interface{} {
+		c := map[string]interface{}{}
+		for ck, cv := range claims {
+			c[ck] = cv
+		}
+		if v == nil {
+			delete(c, k)
+			return c
+		}
+		c[k] = v
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{
+			name:  "RS256",
+			token: signJWT(t, "RS256", "rsa", rsaKey, claims),
+			want:  200,
+		},
+		{
+			name:  "ES256",
+			token: signJWT(t, "ES256", "ec", ecKey, claims),
+			want:  200,
+		},
+		{
+			name:  "HS256",
+			token: signJWT(t, "HS256", "", secret, claims),
+			want:  200,
+		},
+		{
+			name:  "Invalid Signature",
+			token: signJWT(t, "HS256", "", []byte("other"), claims),
+			want:  401,
+		},
+		{
+			name:  "Unknown Key",
+			token: signJWT(t, "RS256", "unknown", rsaKey, claims),
+			want:  401,
+		},
+		{
+			name:  "Algorithm Mismatch",
+			token: signJWT(t, "ES256", "rsa", ecKey, claims),
+			want:  401,
+		},
+		{
+			name:  "None Algorithm",
+			token: signJWT(t, "none", "", nil, claims),
+			want:  401,
+		},
+		{
+			name:  "Expired",
+			token: signJWT(t, "RS256", "rsa", rsaKey, with("exp", now-60)),
+			want:  401,
+		},
+		{
+			name:  "Missing Expiry",
+			token: signJWT(t, "RS256", "rsa", rsaKey, with("exp", nil)),
+			want:  401,
+		},
+		{
+			name:  "Not Yet Valid",
+			token: signJWT(t, "RS256", "rsa", rsaKey, with("nbf", now+60)),
+			want:  401,
+		},
+		{
+			name:  "Invalid Issuer",
+			token: signJWT(t, "RS256", "rsa", rsaKey, with("iss", "https://other.test")),
+			want:  401,
+		},
+		{
+			name:  "Invalid Audience",
+			token: signJWT(t, "RS256", "rsa", rsaKey, with("aud", "other")),
+			want:  401,
+		},
+		{
+			name:  "Missing Required Claim",
+			token: signJWT(t, "RS256", "rsa", rsaKey, with("sub", nil)),
+			want:  401,
+		},
+		{
+			name:  "Malformed Token",
+			token: "not.a-token",
+			want:  401,
+		},
+		{
+			name: "No Token",
+			want: 401,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/test"},
+				Header: http.Header{"X-User": []string{"spoofed"}},
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			m := middleware.NewJWT(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+				assert.Equal(t, "user-1", r.Header.Get("X-User"))
+				assert.Equal(t, "admin,dev", r.Header.Get("X-Roles"))
+
+				return &http.Response{StatusCode: 200, StatusText: "OK"}
+			}), middleware.JWTOpts{
+				JWKS:           middleware.NewJWKS(srv.URL, middleware.JWKSOpts{}),
+				Secret:         secret,
+				Issuer:         "https://issuer.test",
+				Audience:       []string{"proxy"},
+				RequiredClaims: []string{"sub"},
+				ClaimHeaders:   map[string]string{"sub": "X-User", "roles": "X-Roles"},
+			})
+
+			got := m.ServeHTTP(context.Background(), req)
+
+			assert.Equal(t, tt.want, got.StatusCode)
+			if tt.want == 401 {
+				assert.True(t, strings.HasPrefix(got.Header.Get("WWW-Authenticate"), "Bearer"))
+			}
+		})
+	}
+}
+
+func signJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	hdr := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		hdr["kid"] = kid
+	}
+	h, _ := json.Marshal(hdr)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		_, _ = mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):32], rb)
+		copy(sig[64-len(sb):], sb)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func jwksJSON(keys map[string]interface{}) string {
+	enc := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.Bytes())
+	}
+
+	set := struct {
+		Keys []map[string]string `json:"keys"`
+	}{}
+	for kid, key := range keys {
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, map[string]string{
+				"kid": kid, "kty": "RSA", "n": enc(k.N), "e": enc(big.NewInt(int64(k.E))),
+			})
+
+		case *ecdsa.PublicKey:
+			set.Keys = append(set.Keys, map[string]string{
+				"kid": kid, "kty": "EC", "crv": "P-256", "x": enc(k.X), "y": enc(k.Y),
+			})
+		}
+	}
+
+	b, _ := json.Marshal(set)
+	return string(b)
+}
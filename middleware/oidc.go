@@ -0,0 +1,629 @@
+package middleware
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	nethttp "net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nrwiersma/proxy/http"
+)
+
+// OIDCOpts configures an OpenID Connect middleware.
+type OIDCOpts struct {
+	// Issuer is the OpenID provider issuer url. The provider
+	// configuration is discovered from the issuer.
+	Issuer string
+
+	// ClientID and ClientSecret are the client credentials.
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is the callback url, either absolute or a path
+	// on the request host. Defaults to "/oauth2/callback".
+	RedirectURL string
+
+	// Scopes are the requested scopes. "openid" is always requested.
+	Scopes []string
+
+	// CookieName is the name of the session cookie. Defaults to "_proxy_oidc".
+	CookieName string
+
+	// CookieSecret is the secret the session cookie is encrypted with.
+	CookieSecret string
+
+	// RefreshBefore is how long before expiry the tokens are
+	// refreshed. Defaults to 1 minute.
+	RefreshBefore time.Duration
+
+	// SessionMaxAge is how long a session is valid when the provider
+	// returns no token expiry. Defaults to 1 hour.
+	SessionMaxAge time.Duration
+
+	// ClaimHeaders maps claims to the headers they are forwarded in.
+	ClaimHeaders map[string]string
+}
+
+type oidcSession struct {
+	Claims       map[string]interface{} `json:"c"`
+	RefreshToken string                 `json:"r,omitempty"`
+	Expiry       int64                  `json:"e"`
+}
+
+type oidcState struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Redirect string `json:"r"`
+}
+
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	jwt *JWT
+}
+
+type oidcTokens struct {
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// oidcRefresh is an in-flight or recently completed session refresh.
+type oidcRefresh struct {
+	done chan struct{}
+	sess oidcSession
+	err  error
+}
+
+// refreshGrace is how long a completed refresh is shared with requests
+// still carrying the old refresh token.
+const refreshGrace = 10 * time.Second
+
+// OIDC authenticates browser requests with an OpenID Connect provider.
+//
+// Unauthenticated GET requests are redirected to the provider, other
+// requests are rejected. The session is kept in an encrypted cookie.
+type OIDC struct {
+	h    http.Handler
+	opts OIDCOpts
+
+	client   *nethttp.Client
+	aead     cipher.AEAD
+	callback string
+
+	mu         sync.Mutex
+	provider   *oidcProvider
+	refreshing map[string]*oidcRefresh
+}
+
+// NewOIDC returns an OpenID Connect middleware.
+func NewOIDC(h http.Handler, opts OIDCOpts) (*OIDC, error) {
+	if opts.Issuer == "" || opts.ClientID == "" {
+		return nil, errors.New("middleware: oidc requires an issuer and client id")
+	}
+	if opts.CookieSecret == "" {
+		return nil, errors.New("middleware: oidc requires a cookie secret")
+	}
+	if opts.RedirectURL == "" {
+		opts.RedirectURL = "/oauth2/callback"
+	}
+	if opts.CookieName == "" {
+		opts.CookieName = "_proxy_oidc"
+	}
+	if opts.RefreshBefore <= 0 {
+		opts.RefreshBefore = time.Minute
+	}
+	if opts.SessionMaxAge <= 0 {
+		opts.SessionMaxAge = time.Hour
+	}
+
+	u, err := url.Parse(opts.RedirectURL)
+	if err != nil {
+		return nil, fmt.Errorf("middleware: invalid oidc redirect url: %v", err)
+	}
+
+	key := sha256.Sum256([]byte(opts.CookieSecret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDC{
+		h:          h,
+		opts:       opts,
+		client:     &nethttp.Client{Timeout: 10 * time.Second},
+		aead:       aead,
+		callback:   u.Path,
+		refreshing: map[string]*oidcRefresh{},
+	}, nil
+}
+
+// ServeHTTP serves an HTTP request.
+func (m *OIDC) ServeHTTP(ctx context.Context, r *http.Request) *http.Response {
+	// Never trust claim headers sent by the client.
+	for _, hdr := range m.opts.ClaimHeaders {
+		r.Header.Del(hdr)
+	}
+
+	if r.URL.Path == m.callback {
+		return m.handleCallback(ctx, r)
+	}
+
+	var sess oidcSession
+	value, ok := readCookie(r.Header, m.opts.CookieName)
+	if !ok || m.decrypt(value, &sess) != nil {
+		return m.login(ctx, r)
+	}
+
+	var setCookie string
+	if time.Now().Add(m.opts.RefreshBefore).After(time.Unix(sess.Expiry, 0)) {
+		var err error
+		if sess.RefreshToken == "" {
+			return m.login(ctx, r)
+		}
+		if sess, err = m.refresh(ctx, sess); err != nil {
+			return m.login(ctx, r)
+		}
+
+		if setCookie, err = m.sessionCookie(r, sess); err != nil {
+			return &http.Response{StatusCode: 500, StatusText: "Internal Server Error", Error: err}
+		}
+	}
+
+	removeCookie(r.Header, m.opts.CookieName)
+	removeCookie(r.Header, m.opts.CookieName+"_state")
+	for claim, hdr := range m.opts.ClaimHeaders {
+		v, ok := sess.Claims[claim]
+		if !ok {
+			continue
+		}
+		r.Header.Set(hdr, claimString(v))
+	}
+
+	resp := m.h.ServeHTTP(ctx, r)
+	if setCookie != "" {
+		resp.EnsureHeader()
+		resp.Header.Add("Set-Cookie", setCookie)
+	}
+	return resp
+}
+
+func (m *OIDC) login(ctx context.Context, r *http.Request) *http.Response {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return &http.Response{
+			StatusCode: 401,
+			StatusText: "Unauthorized",
+			Header:     http.Header{"Content-Length": []string{"0"}},
+		}
+	}
+
+	p, err := m.discover(ctx)
+	if err != nil {
+		return &http.Response{StatusCode: 502, StatusText: "Bad Gateway", Error: err}
+	}
+
+	state := oidcState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Redirect: r.URL.RequestURI(),
+	}
+	value, err := m.encrypt(state)
+	if err != nil {
+		return &http.Response{StatusCode: 500, StatusText: "Internal Server Error", Error: err}
+	}
+
+	scopes := append([]string{"openid"}, m.opts.Scopes...)
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", m.opts.ClientID)
+	q.Set("redirect_uri", m.redirectURL(r))
+	q.Set("scope", strings.Join(uniqueStrings(scopes), " "))
+	q.Set("state", state.State)
+	q.Set("nonce", state.Nonce)
+
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	return &http.Response{
+		StatusCode: 302,
+		StatusText: "Found",
+		Header: http.Header{
+			"Location":       []string{p.AuthorizationEndpoint + sep + q.Encode()},
+			"Set-Cookie":     []string{m.cookie(r, m.opts.CookieName+"_state", value, 600)},
+			"Content-Length": []string{"0"},
+		},
+	}
+}
+
+func (m *OIDC) handleCallback(ctx context.Context, r *http.Request) *http.Response {
+	var state oidcState
+	value, ok := readCookie(r.Header, m.opts.CookieName+"_state")
+	if !ok || m.decrypt(value, &state) != nil {
+		return &http.Response{StatusCode: 400, StatusText: "Bad Request"}
+	}
+
+	q := r.URL.Query()
+	if q.Get("state") != state.State {
+		return &http.Response{StatusCode: 400, StatusText: "Bad Request"}
+	}
+	if q.Get("error") != "" || q.Get("code") == "" {
+		return &http.Response{StatusCode: 401, StatusText: "Unauthorized"}
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", q.Get("code"))
+	form.Set("redirect_uri", m.redirectURL(r))
+	tokens, err := m.token(ctx, form)
+	if err != nil {
+		return &http.Response{StatusCode: 502, StatusText: "Bad Gateway", Error: err}
+	}
+
+	claims, err := m.verify(ctx, tokens.IDToken)
+	if err != nil {
+		return &http.Response{StatusCode: 401, StatusText: "Unauthorized", Error: err}
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != state.Nonce {
+		return &http.Response{StatusCode: 401, StatusText: "Unauthorized"}
+	}
+
+	sess := oidcSession{RefreshToken: tokens.RefreshToken}
+	m.updateSession(&sess, claims, tokens)
+
+	cookie, err := m.sessionCookie(r, sess)
+	if err != nil {
+		return &http.Response{StatusCode: 500, StatusText: "Internal Server Error", Error: err}
+	}
+
+	redirect := state.Redirect
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+		redirect = "/"
+	}
+
+	return &http.Response{
+		StatusCode: 302,
+		StatusText: "Found",
+		Header: http.Header{
+			"Location": []string{redirect},
+			"Set-Cookie": []string{
+				cookie,
+				m.cookie(r, m.opts.CookieName+"_state", "", -1),
+			},
+			"Content-Length": []string{"0"},
+		},
+	}
+}
+
+// refresh returns the session refreshed with its refresh token.
+//
+// Concurrent refreshes of the same session share a single token request,
+// as providers may rotate the refresh token on use. The result is kept for
+// a short grace period for requests still carrying the old session. The
+// context only bounds the wait, the token request is not tied to the
+// request that started it.
+func (m *OIDC) refresh(ctx context.Context, sess oidcSession) (oidcSession, error) {
+	m.mu.Lock()
+	ref, ok := m.refreshing[sess.RefreshToken]
+	if !ok {
+		ref = &oidcRefresh{done: make(chan struct{})}
+		m.refreshing[sess.RefreshToken] = ref
+		go m.doRefresh(sess, ref)
+	}
+	m.mu.Unlock()
+
+	select {
+	case <-ref.done:
+		return ref.sess, ref.err
+	case <-ctx.Done():
+		return oidcSession{}, ctx.Err()
+	}
+}
+
+func (m *OIDC) doRefresh(sess oidcSession, ref *oidcRefresh) {
+	refreshToken := sess.RefreshToken
+	defer func() {
+		close(ref.done)
+		time.AfterFunc(refreshGrace, func() {
+			m.mu.Lock()
+			delete(m.refreshing, refreshToken)
+			m.mu.Unlock()
+		})
+	}()
+
+	ctx := context.Background()
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+	tokens, err := m.token(ctx, form)
+	if err != nil {
+		ref.err = err
+		return
+	}
+
+	claims := sess.Claims
+	if tokens.IDToken != "" {
+		if claims, err = m.verify(ctx, tokens.IDToken); err != nil {
+			ref.err = err
+			return
+		}
+	}
+
+	if tokens.RefreshToken != "" {
+		sess.RefreshToken = tokens.RefreshToken
+	}
+	m.updateSession(&sess, claims, tokens)
+	ref.sess = sess
+}
+
+// updateSession sets the claims and expiry on the session. The expiry is
+// taken from the token response, falling back to the id token expiry and
+// then the session max age.
+func (m *OIDC) updateSession(sess *oidcSession, claims map[string]interface{}, tokens oidcTokens) {
+	sess.Claims = map[string]interface{}{}
+	for claim := range m.opts.ClaimHeaders {
+		if v, ok := claims[claim]; ok {
+			sess.Claims[claim] = v
+		}
+	}
+
+	sess.Expiry = time.Now().Add(m.opts.SessionMaxAge).Unix()
+	switch {
+	case tokens.ExpiresIn > 0:
+		sess.Expiry = time.Now().Unix() + tokens.ExpiresIn
+	default:
+		if t, ok := claimTime(claims["exp"]); ok {
+			sess.Expiry = t.Unix()
+		}
+	}
+}
+
+func (m *OIDC) verify(ctx context.Context, idToken string) (map[string]interface{}, error) {
+	p, err := m.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if idToken == "" {
+		return nil, errors.New("missing id token")
+	}
+
+	return p.jwt.verify(ctx, idToken)
+}
+
+func (m *OIDC) token(ctx context.Context, form url.Values) (oidcTokens, error) {
+	p, err := m.discover(ctx)
+	if err != nil {
+		return oidcTokens{}, err
+	}
+
+	req, err := nethttp.NewRequest("POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oidcTokens{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(m.opts.ClientID), url.QueryEscape(m.opts.ClientSecret))
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return oidcTokens{}, fmt.Errorf("middleware: could not request token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return oidcTokens{}, fmt.Errorf("middleware: could not request token: unexpected status %d", resp.StatusCode)
+	}
+
+	var tokens oidcTokens
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return oidcTokens{}, fmt.Errorf("middleware: invalid token response: %v", err)
+	}
+	return tokens, nil
+}
+
+// discover fetches the provider configuration, caching it once found.
+// The lock is not held during the request, so a slow provider does not
+// block sessions that need no discovery.
+func (m *OIDC) discover(ctx context.Context) (*oidcProvider, error) {
+	m.mu.Lock()
+	p := m.provider
+	m.mu.Unlock()
+	if p != nil {
+		return p, nil
+	}
+
+	p, err := m.fetchProvider(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Keep the provider of a concurrent discovery that finished first.
+	if m.provider == nil {
+		m.provider = p
+	}
+	return m.provider, nil
+}
+
+func (m *OIDC) fetchProvider(ctx context.Context) (*oidcProvider, error) {
+	u := strings.TrimSuffix(m.opts.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := nethttp.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("middleware: could not discover oidc provider: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("middleware: could not discover oidc provider: unexpected status %d", resp.StatusCode)
+	}
+
+	var p oidcProvider
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&p); err != nil {
+		return nil, fmt.Errorf("middleware: invalid oidc provider configuration: %v", err)
+	}
+	if p.Issuer != m.opts.Issuer {
+		return nil, fmt.Errorf("middleware: oidc issuer mismatch '%s'", p.Issuer)
+	}
+
+	p.jwt = NewJWT(nil, JWTOpts{
+		JWKS:     NewJWKS(p.JWKSURI, JWKSOpts{}),
+		Issuer:   p.Issuer,
+		Audience: []string{m.opts.ClientID},
+	})
+
+	return &p, nil
+}
+
+func (m *OIDC) redirectURL(r *http.Request) string {
+	if strings.HasPrefix(m.opts.RedirectURL, "/") {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		return scheme + "://" + r.Host + m.opts.RedirectURL
+	}
+	return m.opts.RedirectURL
+}
+
+func (m *OIDC) sessionCookie(r *http.Request, sess oidcSession) (string, error) {
+	value, err := m.encrypt(sess)
+	if err != nil {
+		return "", err
+	}
+	return m.cookie(r, m.opts.CookieName, value, 0), nil
+}
+
+// cookie formats a Set-Cookie value. A zero maxAge creates a
+// session cookie, a negative maxAge deletes the cookie.
+func (m *OIDC) cookie(r *http.Request, name, value string, maxAge int) string {
+	var b strings.Builder
+	b.WriteString(name + "=" + value + "; Path=/; HttpOnly; SameSite=Lax")
+	switch {
+	case maxAge > 0:
+		fmt.Fprintf(&b, "; Max-Age=%d", maxAge)
+	case maxAge < 0:
+		b.WriteString("; Max-Age=0")
+	}
+	if r.TLS != nil {
+		b.WriteString("; Secure")
+	}
+	return b.String()
+}
+
+func (m *OIDC) encrypt(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(m.aead.Seal(nonce, nonce, b, nil)), nil
+}
+
+func (m *OIDC) decrypt(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(b) < m.aead.NonceSize() {
+		return errors.New("invalid cookie")
+	}
+
+	n := m.aead.NonceSize()
+	b, err = m.aead.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(strings.NewReader(string(b)))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// readCookie returns the value of the named request cookie.
+func readCookie(h http.Header, name string) (string, bool) {
+	for _, line := range h["Cookie"] {
+		for _, part := range strings.Split(line, ";") {
+			part = strings.TrimSpace(part)
+			if i := strings.Index(part, "="); i > 0 && part[:i] == name {
+				return part[i+1:], true
+			}
+		}
+	}
+	return "", false
+}
+
+// removeCookie removes the named cookie from the request cookies.
+func removeCookie(h http.Header, name string) {
+	var cookies []string
+	for _, line := range h["Cookie"] {
+		for _, part := range strings.Split(line, ";") {
+			part = strings.TrimSpace(part)
+			if part == "" || strings.HasPrefix(part, name+"=") {
+				continue
+			}
+			cookies = append(cookies, part)
+		}
+	}
+
+	if len(cookies) == 0 {
+		h.Del("Cookie")
+		return
+	}
+	h.Set("Cookie", strings.Join(cookies, "; "))
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func uniqueStrings(s []string) []string {
+	seen := make(map[string]bool, len(s))
+	res := s[:0]
+	for _, v := range s {
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		res = append(res, v)
+	}
+	return res
+}
@@ -0,0 +1,373 @@
+package middleware_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	nethttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockIdP struct {
+	*httptest.Server
+
+	key *rsa.PrivateKey
+
+	mu           sync.Mutex
+	nonce        string
+	expiresIn    int
+	noIDToken    bool
+	refreshToken string
+	rotate       bool
+	delay        time.Duration
+	refreshes    int
+}
+
+func (idp *mockIdP) setNonce(nonce string) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	idp.nonce = nonce
+}
+
+func (idp *mockIdP) refreshCount() int {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	return idp.refreshes
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	idp := &mockIdP{key: key, expiresIn: 3600, refreshToken: "refresh"}
+
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		_, _ = w.Write([]byte(jwksJSON(map[string]interface{}{"1": &key.PublicKey})))
+	})
+	mux.HandleFunc("/token", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "client" || pass != "secret" {
+			w.WriteHeader(401)
+			return
+		}
+
+		time.Sleep(idp.delay)
+
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+
+		res := map[string]interface{}{}
+		switch r.PostFormValue("grant_type") {
+		case "authorization_code":
+			if r.PostFormValue("code") != "code" {
+				w.WriteHeader(400)
+				return
+			}
+		case "refresh_token":
+			if r.PostFormValue("refresh_token") != idp.refreshToken {
+				w.WriteHeader(400)
+				return
+			}
+			idp.refreshes++
+			if idp.rotate {
+				idp.refreshToken = fmt.Sprintf("refresh-%d", idp.refreshes)
+			}
+		}
+
+		if !idp.noIDToken {
+			res["id_token"] = signJWT(t, "RS256", "1", key, map[string]interface{}{
+				"iss":   idp.URL,
+				"aud":   "client",
+				"sub":   "user-1",
+				"email": "user@example.com",
+				"nonce": idp.nonce,
+				"exp":   time.Now().Add(time.Hour).Unix(),
+			})
+		}
+		res["refresh_token"] = idp.refreshToken
+		if idp.expiresIn > 0 {
+			res["expires_in"] = idp.expiresIn
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	})
+	idp.Server = httptest.NewServer(mux)
+
+	return idp
+}
+
+func TestOIDC_ServeHTTP(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.Close()
+
+	m, err := middleware.NewOIDC(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		assert.Equal(t, "user-1", r.Header.Get("X-User"))
+		assert.Equal(t, "user@example.com", r.Header.Get("X-Email"))
+		assert.Equal(t, "other=1", r.Header.Get("Cookie"))
+
+		return &http.Response{StatusCode: 200, StatusText: "OK"}
+	}), middleware.OIDCOpts{
+		Issuer:       idp.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Scopes:       []string{"email"},
+		CookieSecret: "cookie-secret",
+		ClaimHeaders: map[string]string{"sub": "X-User", "email": "X-Email"},
+	})
+	require.NoError(t, err)
+
+	// Login redirect
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/dashboard", RawQuery: "tab=1"},
+		Host:   "example.com",
+		Header: http.Header{"X-User": []string{"spoofed"}},
+	}
+	resp := m.ServeHTTP(context.Background(), req)
+	require.Equal(t, 302, resp.StatusCode)
+
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, idp.URL+"/authorize", loc.Scheme+"://"+loc.Host+loc.Path)
+	assert.Equal(t, "client", loc.Query().Get("client_id"))
+	assert.Equal(t, "http://example.com/oauth2/callback", loc.Query().Get("redirect_uri"))
+	assert.Equal(t, "openid email", loc.Query().Get("scope"))
+	idp.setNonce(loc.Query().Get("nonce"))
+	stateCookie := cookieValue(resp.Header["Set-Cookie"][0])
+
+	// Callback
+	req = &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/oauth2/callback", RawQuery: "code=code&state=" + loc.Query().Get("state")},
+		Host:   "example.com",
+		Header: http.Header{"Cookie": []string{stateCookie}},
+	}
+	resp = m.ServeHTTP(context.Background(), req)
+	require.Equal(t, 302, resp.StatusCode)
+	assert.Equal(t, "/dashboard?tab=1", resp.Header.Get("Location"))
+	sessCookie := cookieValue(resp.Header["Set-Cookie"][0])
+
+	// Authenticated request
+	req = &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/dashboard"},
+		Host:   "example.com",
+		Header: http.Header{"Cookie": []string{sessCookie + "; other=1"}},
+	}
+	resp = m.ServeHTTP(context.Background(), req)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestOIDC_ServeHTTPRejectsInvalidState(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.Close()
+
+	m, err := middleware.NewOIDC(nil, middleware.OIDCOpts{
+		Issuer:       idp.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		CookieSecret: "cookie-secret",
+	})
+	require.NoError(t, err)
+
+	resp := m.ServeHTTP(context.Background(), &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/"},
+		Host:   "example.com",
+		Header: http.Header{},
+	})
+	stateCookie := cookieValue(resp.Header["Set-Cookie"][0])
+
+	resp = m.ServeHTTP(context.Background(), &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/oauth2/callback", RawQuery: "code=code&state=other"},
+		Host:   "example.com",
+		Header: http.Header{"Cookie": []string{stateCookie}},
+	})
+
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestOIDC_ServeHTTPRejectsNonGetRequests(t *testing.T) {
+	m, err := middleware.NewOIDC(nil, middleware.OIDCOpts{
+		Issuer:       "http://127.0.0.1:0",
+		ClientID:     "client",
+		CookieSecret: "cookie-secret",
+	})
+	require.NoError(t, err)
+
+	resp := m.ServeHTTP(context.Background(), &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/"},
+		Header: http.Header{"Cookie": []string{"_proxy_oidc=invalid"}},
+	})
+
+	assert.Equal(t, 401, resp.StatusCode)
+}
+
+func TestOIDC_ServeHTTPRefreshesTokens(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.Close()
+	idp.expiresIn = 30
+
+	m, err := middleware.NewOIDC(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		assert.Equal(t, "user-1", r.Header.Get("X-User"))
+
+		return &http.Response{StatusCode: 200, StatusText: "OK"}
+	}), middleware.OIDCOpts{
+		Issuer:       idp.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		CookieSecret: "cookie-secret",
+		ClaimHeaders: map[string]string{"sub": "X-User"},
+	})
+	require.NoError(t, err)
+
+	sessCookie := oidcLogin(t, idp, m)
+	idp.expiresIn = 3600
+
+	resp := m.ServeHTTP(context.Background(), &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/"},
+		Host:   "example.com",
+		Header: http.Header{"Cookie": []string{sessCookie}},
+	})
+
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, 1, idp.refreshCount())
+	assert.Len(t, resp.Header["Set-Cookie"], 1)
+}
+
+func TestOIDC_ServeHTTPUsesSessionMaxAgeWithoutExpiry(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.Close()
+	idp.expiresIn = 30
+
+	m, err := middleware.NewOIDC(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		assert.Equal(t, "user-1", r.Header.Get("X-User"))
+
+		return &http.Response{StatusCode: 200, StatusText: "OK"}
+	}), middleware.OIDCOpts{
+		Issuer:       idp.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		CookieSecret: "cookie-secret",
+		ClaimHeaders: map[string]string{"sub": "X-User"},
+	})
+	require.NoError(t, err)
+
+	sessCookie := oidcLogin(t, idp, m)
+	idp.mu.Lock()
+	idp.expiresIn = 0
+	idp.noIDToken = true
+	idp.mu.Unlock()
+
+	resp := m.ServeHTTP(context.Background(), &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/"},
+		Host:   "example.com",
+		Header: http.Header{"Cookie": []string{sessCookie}},
+	})
+	require.Equal(t, 200, resp.StatusCode)
+	require.Len(t, resp.Header["Set-Cookie"], 1)
+
+	resp = m.ServeHTTP(context.Background(), &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/"},
+		Host:   "example.com",
+		Header: http.Header{"Cookie": []string{cookieValue(resp.Header["Set-Cookie"][0])}},
+	})
+
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, 1, idp.refreshCount())
+	assert.Empty(t, resp.Header["Set-Cookie"])
+}
+
+func TestOIDC_ServeHTTPSharesConcurrentRefreshes(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.Close()
+	idp.expiresIn = 30
+
+	m, err := middleware.NewOIDC(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		return &http.Response{StatusCode: 200, StatusText: "OK"}
+	}), middleware.OIDCOpts{
+		Issuer:       idp.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		CookieSecret: "cookie-secret",
+	})
+	require.NoError(t, err)
+
+	sessCookie := oidcLogin(t, idp, m)
+	idp.mu.Lock()
+	idp.expiresIn = 3600
+	idp.rotate = true
+	idp.delay = 50 * time.Millisecond
+	idp.mu.Unlock()
+
+	var wg sync.WaitGroup
+	statuses := make([]int, 5)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			resp := m.ServeHTTP(context.Background(), &http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: "/"},
+				Host:   "example.com",
+				Header: http.Header{"Cookie": []string{sessCookie}},
+			})
+			statuses[i] = resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, []int{200, 200, 200, 200, 200}, statuses)
+	assert.Equal(t, 1, idp.refreshCount())
+}
+
+func oidcLogin(t *testing.T, idp *mockIdP, m *middleware.OIDC) string {
+	t.Helper()
+
+	resp := m.ServeHTTP(context.Background(), &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/"},
+		Host:   "example.com",
+		Header: http.Header{},
+	})
+	loc, _ := url.Parse(resp.Header.Get("Location"))
+	idp.setNonce(loc.Query().Get("nonce"))
+	resp = m.ServeHTTP(context.Background(), &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/oauth2/callback", RawQuery: "code=code&state=" + loc.Query().Get("state")},
+		Host:   "example.com",
+		Header: http.Header{"Cookie": []string{cookieValue(resp.Header["Set-Cookie"][0])}},
+	})
+	require.Equal(t, 302, resp.StatusCode)
+
+	return cookieValue(resp.Header["Set-Cookie"][0])
+}
+
+func cookieValue(setCookie string) string {
+	return strings.SplitN(setCookie, ";", 2)[0]
+}
@@ -0,0 +1,204 @@
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nrwiersma/proxy/http"
+)
+
+// KeyFunc returns the key a request is tracked by.
+type KeyFunc func(ctx context.Context, r *http.Request) string
+
+// IPKey keys requests by client ip.
+func IPKey(ctx context.Context, r *http.Request) string {
+	if ip := remoteIP(r.RemoteAddr); ip != nil {
+		return "ip:" + ip.String()
+	}
+	return "ip:" + r.RemoteAddr
+}
+
+// HeaderKey returns a key function that keys requests by header value.
+func HeaderKey(name string) KeyFunc {
+	return func(ctx context.Context, r *http.Request) string {
+		v := r.Header.Get(name)
+		if v == "" {
+			return ""
+		}
+		return "hdr:" + v
+	}
+}
+
+// ClaimKey returns a key function that keys requests by a claim
+// of the verified JWT. The claims are only available behind the
+// jwt middleware, without it the requests are keyed by client ip.
+func ClaimKey(claim string) KeyFunc {
+	return func(ctx context.Context, r *http.Request) string {
+		v, ok := jwtClaims(ctx)[claim]
+		if !ok {
+			return ""
+		}
+		return "claim:" + claimString(v)
+	}
+}
+
+// StaticKey returns a key function that keys all requests by the same key.
+func StaticKey(key string) KeyFunc {
+	return func(context.Context, *http.Request) string {
+		return key
+	}
+}
+
+// RateLimitOpts configures a rate limit middleware.
+type RateLimitOpts struct {
+	// Key is the function requests are keyed by. If the key
+	// is empty, the client ip is used. Defaults to IPKey.
+	Key KeyFunc
+
+	// Average is the number of requests allowed per Period.
+	Average int
+
+	// Period is the period of the average rate. Defaults to 1 second.
+	Period time.Duration
+
+	// Burst is the maximum number of requests allowed at once.
+	// Defaults to Average.
+	Burst int
+
+	// MaxKeys is the maximum number of tracked keys. The least
+	// recently seen keys are dropped first. Defaults to 10000.
+	MaxKeys int
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// RateLimit limits the request rate with a token bucket per key.
+type RateLimit struct {
+	h    http.Handler
+	opts RateLimitOpts
+
+	rate float64 // Tokens per second.
+
+	mu      sync.Mutex
+	lru     *list.List
+	buckets map[string]*list.Element
+}
+
+// NewRateLimit returns a rate limit middleware.
+func NewRateLimit(h http.Handler, opts RateLimitOpts) *RateLimit {
+	if opts.Key == nil {
+		opts.Key = IPKey
+	}
+	if opts.Period <= 0 {
+		opts.Period = time.Second
+	}
+	if opts.Burst <= 0 {
+		opts.Burst = opts.Average
+	}
+	if opts.MaxKeys <= 0 {
+		opts.MaxKeys = 10000
+	}
+
+	return &RateLimit{
+		h:       h,
+		opts:    opts,
+		rate:    float64(opts.Average) / opts.Period.Seconds(),
+		lru:     list.New(),
+		buckets: map[string]*list.Element{},
+	}
+}
+
+// ServeHTTP serves an HTTP request.
+func (m *RateLimit) ServeHTTP(ctx context.Context, r *http.Request) *http.Response {
+	key := m.opts.Key(ctx, r)
+	if key == "" {
+		key = IPKey(ctx, r)
+	}
+
+	ok, remaining, wait, reset := m.take(key, time.Now())
+
+	if !ok {
+		resp := &http.Response{
+			StatusCode: 429,
+			StatusText: "Too Many Requests",
+			Header: http.Header{
+				"Retry-After":    []string{strconv.Itoa(seconds(wait))},
+				"Content-Length": []string{"0"},
+			},
+		}
+		m.setHeaders(resp.Header, remaining, reset)
+		return resp
+	}
+
+	resp := m.h.ServeHTTP(ctx, r)
+	resp.EnsureHeader()
+	m.setHeaders(resp.Header, remaining, reset)
+	return resp
+}
+
+func (m *RateLimit) setHeaders(h http.Header, remaining int, reset time.Duration) {
+	h.Set("RateLimit-Limit", strconv.Itoa(m.opts.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(seconds(reset)))
+}
+
+// take takes a token from the bucket of the key. It returns if the
+// token was taken, the remaining tokens, how long until a token is
+// available and how long until the bucket is full.
+func (m *RateLimit) take(key string, now time.Time) (bool, int, time.Duration, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	burst := float64(m.opts.Burst)
+
+	var b *bucket
+	if e, ok := m.buckets[key]; ok {
+		m.lru.MoveToFront(e)
+		b = e.Value.(*bucket)
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*m.rate)
+		b.last = now
+	} else {
+		b = &bucket{key: key, tokens: burst, last: now}
+		m.buckets[key] = m.lru.PushFront(b)
+
+		for m.lru.Len() > m.opts.MaxKeys {
+			e := m.lru.Back()
+			m.lru.Remove(e)
+			delete(m.buckets, e.Value.(*bucket).key)
+		}
+	}
+
+	ok := b.tokens >= 1
+	if ok {
+		b.tokens--
+	}
+
+	var wait time.Duration
+	if !ok {
+		wait = m.duration(1 - b.tokens)
+	}
+	reset := m.duration(burst - b.tokens)
+
+	return ok, int(b.tokens), wait, reset
+}
+
+// duration returns how long it takes to refill the given tokens.
+func (m *RateLimit) duration(tokens float64) time.Duration {
+	if m.rate <= 0 {
+		return m.opts.Period
+	}
+	return time.Duration(tokens / m.rate * float64(time.Second))
+}
+
+// seconds returns the duration in whole seconds, rounded up.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,163 @@
+package middleware_test
+
+import (
+	"context"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimit_ServeHTTP(t *testing.T) {
+	m := middleware.NewRateLimit(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		return &http.Response{StatusCode: 200, StatusText: "OK"}
+	}), middleware.RateLimitOpts{
+		Average: 1,
+		Period:  time.Hour,
+		Burst:   2,
+	})
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: "/test"},
+		Header:     http.Header{},
+		RemoteAddr: "192.0.2.1:1234",
+	}
+
+	got := m.ServeHTTP(context.Background(), req)
+	assert.Equal(t, 200, got.StatusCode)
+	assert.Equal(t, "2", got.Header.Get("RateLimit-Limit"))
+	assert.Equal(t, "1", got.Header.Get("RateLimit-Remaining"))
+
+	got = m.ServeHTTP(context.Background(), req)
+	assert.Equal(t, 200, got.StatusCode)
+	assert.Equal(t, "0", got.Header.Get("RateLimit-Remaining"))
+	assert.Equal(t, "7200", got.Header.Get("RateLimit-Reset"))
+
+	got = m.ServeHTTP(context.Background(), req)
+	assert.Equal(t, 429, got.StatusCode)
+	retry, _ := strconv.Atoi(got.Header.Get("Retry-After"))
+	assert.InDelta(t, 3600, retry, 1)
+	assert.Equal(t, "0", got.Header.Get("RateLimit-Remaining"))
+
+	req.RemoteAddr = "192.0.2.2:1234"
+	got = m.ServeHTTP(context.Background(), req)
+	assert.Equal(t, 200, got.StatusCode)
+}
+
+func TestRateLimit_ServeHTTPRefillsTokens(t *testing.T) {
+	m := middleware.NewRateLimit(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		return &http.Response{StatusCode: 200, StatusText: "OK"}
+	}), middleware.RateLimitOpts{
+		Average: 100,
+		Burst:   1,
+	})
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: "/test"},
+		Header:     http.Header{},
+		RemoteAddr: "192.0.2.1:1234",
+	}
+
+	assert.Equal(t, 200, m.ServeHTTP(context.Background(), req).StatusCode)
+	assert.Equal(t, 429, m.ServeHTTP(context.Background(), req).StatusCode)
+
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Equal(t, 200, m.ServeHTTP(context.Background(), req).StatusCode)
+}
+
+func TestRateLimit_ServeHTTPBoundsKeys(t *testing.T) {
+	m := middleware.NewRateLimit(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		return &http.Response{StatusCode: 200, StatusText: "OK"}
+	}), middleware.RateLimitOpts{
+		Key:     middleware.HeaderKey("X-Key"),
+		Average: 1,
+		Period:  time.Hour,
+		MaxKeys: 1,
+	})
+
+	newReq := func(key string) *http.Request {
+		return &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Path: "/test"},
+			Header: http.Header{"X-Key": []string{key}},
+		}
+	}
+
+	assert.Equal(t, 200, m.ServeHTTP(context.Background(), newReq("a")).StatusCode)
+	assert.Equal(t, 429, m.ServeHTTP(context.Background(), newReq("a")).StatusCode)
+	assert.Equal(t, 200, m.ServeHTTP(context.Background(), newReq("b")).StatusCode)
+
+	// Key "a" was dropped when "b" was tracked.
+	assert.Equal(t, 200, m.ServeHTTP(context.Background(), newReq("a")).StatusCode)
+}
+
+func TestRateLimit_ServeHTTPFramesHeaderlessResponse(t *testing.T) {
+	m := middleware.NewRateLimit(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		return &http.Response{StatusCode: 502, StatusText: "Bad Gateway"}
+	}), middleware.RateLimitOpts{
+		Average: 1,
+	})
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: "/test"},
+		Header:     http.Header{},
+		RemoteAddr: "192.0.2.1:1234",
+	}
+
+	got := m.ServeHTTP(context.Background(), req)
+
+	assert.Equal(t, "0", got.Header.Get("Content-Length"))
+	assert.Equal(t, "close", got.Header.Get("Connection"))
+	assert.Equal(t, "1", got.Header.Get("RateLimit-Limit"))
+}
+
+func TestKeyFuncs(t *testing.T) {
+	req := &http.Request{
+		Header:     http.Header{"X-Key": []string{"foo"}},
+		RemoteAddr: "192.0.2.1:1234",
+	}
+
+	assert.Equal(t, "ip:192.0.2.1", middleware.IPKey(context.Background(), req))
+	assert.Equal(t, "hdr:foo", middleware.HeaderKey("X-Key")(context.Background(), req))
+	assert.Equal(t, "", middleware.HeaderKey("X-Other")(context.Background(), req))
+}
+
+func TestClaimKey(t *testing.T) {
+	var got string
+	m := middleware.NewJWT(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		got = middleware.ClaimKey("sub")(ctx, r)
+		return &http.Response{StatusCode: 200, StatusText: "OK"}
+	}), middleware.JWTOpts{Secret: []byte("secret")})
+
+	req := &http.Request{
+		Header: http.Header{"Authorization": []string{"Bearer " + signJWT(t, "HS256", "", []byte("secret"), map[string]interface{}{
+			"sub": "user-1",
+			"exp": time.Now().Add(time.Minute).Unix(),
+		})}},
+	}
+
+	resp := m.ServeHTTP(context.Background(), req)
+
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "claim:user-1", got)
+}
+
+func TestClaimKey_IgnoresUnverifiedTokens(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user-1"}`))
+	req := &http.Request{
+		Header: http.Header{"Authorization": []string{"Bearer e30." + payload + ".sig"}},
+	}
+
+	got := middleware.ClaimKey("sub")(context.Background(), req)
+
+	assert.Equal(t, "", got)
+}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/nrwiersma/proxy/http"
+)
+
+var redirectStatusText = map[int]string{
+	301: "Moved Permanently",
+	302: "Found",
+	303: "See Other",
+	307: "Temporary Redirect",
+	308: "Permanent Redirect",
+}
+
+// RedirectOpts configures a redirect middleware.
+type RedirectOpts struct {
+	// Regex is matched against the full request url, ie
+	// "http://example.com/foo?bar=baz". If Regex is nil,
+	// all requests are redirected.
+	Regex *regexp.Regexp
+
+	// Replacement is the redirect location. The replacement can
+	// reference capture groups like $1.
+	Replacement string
+
+	// StatusCode is the redirect status code. If StatusCode is
+	// zero, 302 is used.
+	StatusCode int
+}
+
+// Redirect redirects matching requests.
+type Redirect struct {
+	h    http.Handler
+	opts RedirectOpts
+}
+
+// NewRedirect returns a redirect middleware.
+func NewRedirect(h http.Handler, opts RedirectOpts) *Redirect {
+	if opts.StatusCode == 0 {
+		opts.StatusCode = 302
+	}
+
+	return &Redirect{
+		h:    h,
+		opts: opts,
+	}
+}
+
+// ServeHTTP serves an HTTP request.
+func (m *Redirect) ServeHTTP(ctx context.Context, r *http.Request) *http.Response {
+	u := requestURL(r)
+
+	loc := m.opts.Replacement
+	if m.opts.Regex != nil {
+		if !m.opts.Regex.MatchString(u) {
+			return m.h.ServeHTTP(ctx, r)
+		}
+		loc = m.opts.Regex.ReplaceAllString(u, m.opts.Replacement)
+	}
+
+	return &http.Response{
+		StatusCode: m.opts.StatusCode,
+		StatusText: redirectStatusText[m.opts.StatusCode],
+		Header: http.Header{
+			"Location":       []string{loc},
+			"Content-Length": []string{"0"},
+		},
+	}
+}
+
+// requestURL returns the full url of the request.
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
@@ -0,0 +1,82 @@
+package middleware_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirect_ServeHTTP(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       middleware.RedirectOpts
+		host       string
+		url        *url.URL
+		tls        bool
+		wantStatus int
+		wantLoc    string
+	}{
+		{
+			name: "Redirects All",
+			opts: middleware.RedirectOpts{
+				Replacement: "https://example.org/",
+			},
+			host:       "example.com",
+			url:        &url.URL{Path: "/foo"},
+			wantStatus: 302,
+			wantLoc:    "https://example.org/",
+		},
+		{
+			name: "Redirects Regex",
+			opts: middleware.RedirectOpts{
+				Regex:       regexp.MustCompile(`^http://example\.com/(.*)$`),
+				Replacement: "https://www.example.com/$1",
+				StatusCode:  308,
+			},
+			host:       "example.com",
+			url:        &url.URL{Path: "/foo/bar", RawQuery: "baz=bat"},
+			wantStatus: 308,
+			wantLoc:    "https://www.example.com/foo/bar?baz=bat",
+		},
+		{
+			name: "No Match Passes Through",
+			opts: middleware.RedirectOpts{
+				Regex:       regexp.MustCompile(`^http://example\.com/(.*)$`),
+				Replacement: "https://www.example.com/$1",
+			},
+			host:       "example.com",
+			url:        &url.URL{Path: "/foo"},
+			tls:        true,
+			wantStatus: 200,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method: "GET",
+				URL:    tt.url,
+				Host:   tt.host,
+				Header: http.Header{},
+			}
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+
+			m := middleware.NewRedirect(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+				return &http.Response{StatusCode: 200, StatusText: "OK"}
+			}), tt.opts)
+
+			got := m.ServeHTTP(context.Background(), req)
+
+			assert.Equal(t, tt.wantStatus, got.StatusCode)
+			assert.Equal(t, tt.wantLoc, got.Header.Get("Location"))
+		})
+	}
+}
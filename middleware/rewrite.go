@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/nrwiersma/proxy/http"
+)
+
+// RewriteOpts configures a rewrite middleware.
+//
+// The path is rewritten in the order strip prefix, regex, add prefix.
+type RewriteOpts struct {
+	// StripPrefix is removed from the start of the path when it
+	// matches whole path segments.
+	StripPrefix string
+
+	// Regex is matched against the path, replacing it with Replacement.
+	// The replacement can reference capture groups like $1.
+	Regex       *regexp.Regexp
+	Replacement string
+
+	// AddPrefix is added to the start of the path.
+	AddPrefix string
+
+	// QuerySet sets query parameters, replacing existing values.
+	QuerySet map[string]string
+
+	// QueryRemove removes query parameters.
+	QueryRemove []string
+
+	// Host replaces the request host.
+	Host string
+}
+
+// Rewrite rewrites the path, query and host of a request.
+type Rewrite struct {
+	h    http.Handler
+	opts RewriteOpts
+}
+
+// NewRewrite returns a rewrite middleware.
+func NewRewrite(h http.Handler, opts RewriteOpts) *Rewrite {
+	return &Rewrite{
+		h:    h,
+		opts: opts,
+	}
+}
+
+// ServeHTTP serves an HTTP request.
+func (m *Rewrite) ServeHTTP(ctx context.Context, r *http.Request) *http.Response {
+	path := m.rewritePath(r.URL.Path)
+	if path != r.URL.Path {
+		r.URL.Path = path
+		r.URL.RawPath = ""
+	}
+
+	if len(m.opts.QuerySet) > 0 || len(m.opts.QueryRemove) > 0 {
+		q := r.URL.Query()
+		for _, k := range m.opts.QueryRemove {
+			q.Del(k)
+		}
+		for k, v := range m.opts.QuerySet {
+			q.Set(k, v)
+		}
+		r.URL.RawQuery = q.Encode()
+	}
+
+	if m.opts.Host != "" {
+		r.Host = m.opts.Host
+		r.Header.Set("Host", m.opts.Host)
+	}
+
+	return m.h.ServeHTTP(ctx, r)
+}
+
+func (m *Rewrite) rewritePath(path string) string {
+	// The prefix is only stripped on a segment boundary, so "/api"
+	// does not match "/apix".
+	if prefix := strings.TrimSuffix(m.opts.StripPrefix, "/"); prefix != "" {
+		switch {
+		case path == prefix:
+			path = "/"
+		case strings.HasPrefix(path, prefix+"/"):
+			path = path[len(prefix):]
+		}
+	}
+
+	if m.opts.Regex != nil && m.opts.Regex.MatchString(path) {
+		path = m.opts.Regex.ReplaceAllString(path, m.opts.Replacement)
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	if m.opts.AddPrefix != "" {
+		path = strings.TrimSuffix(m.opts.AddPrefix, "/") + path
+	}
+
+	return path
+}
@@ -0,0 +1,139 @@
+package middleware_test
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/nrwiersma/proxy/http"
+	"github.com/nrwiersma/proxy/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewrite_ServeHTTP(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      middleware.RewriteOpts
+		path      string
+		query     string
+		wantPath  string
+		wantQuery string
+	}{
+		{
+			name:     "Strip Prefix",
+			opts:     middleware.RewriteOpts{StripPrefix: "/api/v1"},
+			path:     "/api/v1/users/5",
+			wantPath: "/users/5",
+		},
+		{
+			name:     "Strip Prefix Entire Path",
+			opts:     middleware.RewriteOpts{StripPrefix: "/api/v1"},
+			path:     "/api/v1",
+			wantPath: "/",
+		},
+		{
+			name:     "Strip Prefix No Match",
+			opts:     middleware.RewriteOpts{StripPrefix: "/api/v1"},
+			path:     "/other/users/5",
+			wantPath: "/other/users/5",
+		},
+		{
+			name:     "Strip Prefix Partial Segment",
+			opts:     middleware.RewriteOpts{StripPrefix: "/api/v1"},
+			path:     "/api/v1x/foo",
+			wantPath: "/api/v1x/foo",
+		},
+		{
+			name:     "Strip Prefix Trailing Slash",
+			opts:     middleware.RewriteOpts{StripPrefix: "/api/v1/"},
+			path:     "/api/v1/users/5",
+			wantPath: "/users/5",
+		},
+		{
+			name: "Regex Empty Result",
+			opts: middleware.RewriteOpts{
+				Regex:       regexp.MustCompile(`^/old.*$`),
+				Replacement: "",
+			},
+			path:     "/old/path",
+			wantPath: "/",
+		},
+		{
+			name:     "Add Prefix",
+			opts:     middleware.RewriteOpts{AddPrefix: "/v2/"},
+			path:     "/users/5",
+			wantPath: "/v2/users/5",
+		},
+		{
+			name: "Regex",
+			opts: middleware.RewriteOpts{
+				Regex:       regexp.MustCompile(`^/api/v(\d+)/users/(\d+)$`),
+				Replacement: "/users/$2/version/$1",
+			},
+			path:     "/api/v1/users/5",
+			wantPath: "/users/5/version/1",
+		},
+		{
+			name: "Combined",
+			opts: middleware.RewriteOpts{
+				StripPrefix: "/api",
+				Regex:       regexp.MustCompile(`^/v1/`),
+				Replacement: "/",
+				AddPrefix:   "/internal",
+			},
+			path:     "/api/v1/users/5",
+			wantPath: "/internal/users/5",
+		},
+		{
+			name: "Query",
+			opts: middleware.RewriteOpts{
+				QuerySet:    map[string]string{"foo": "baz", "new": "1"},
+				QueryRemove: []string{"utm_source"},
+			},
+			path:      "/users",
+			query:     "foo=bar&utm_source=test&keep=yes",
+			wantPath:  "/users",
+			wantQuery: "foo=baz&keep=yes&new=1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method: "GET",
+				URL:    &url.URL{Path: tt.path, RawPath: tt.path, RawQuery: tt.query},
+				Host:   "example.com",
+				Header: http.Header{},
+			}
+
+			m := middleware.NewRewrite(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+				assert.Equal(t, tt.wantPath, r.URL.Path)
+				assert.Equal(t, tt.wantPath, r.URL.EscapedPath())
+				assert.Equal(t, tt.wantQuery, r.URL.RawQuery)
+
+				return &http.Response{StatusCode: 200, StatusText: "OK"}
+			}), tt.opts)
+
+			_ = m.ServeHTTP(context.Background(), req)
+		})
+	}
+}
+
+func TestRewrite_ServeHTTPHost(t *testing.T) {
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/test"},
+		Host:   "example.com",
+		Header: http.Header{"Host": []string{"example.com"}},
+	}
+
+	m := middleware.NewRewrite(http.HandlerFunc(func(ctx context.Context, r *http.Request) *http.Response {
+		assert.Equal(t, "internal.svc", r.Host)
+		assert.Equal(t, "internal.svc", r.Header.Get("Host"))
+
+		return &http.Response{StatusCode: 200, StatusText: "OK"}
+	}), middleware.RewriteOpts{Host: "internal.svc"})
+
+	_ = m.ServeHTTP(context.Background(), req)
+}
@@ -2,14 +2,25 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/url"
+	"regexp"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/hamba/pkg/log"
+	"github.com/hamba/pkg/stats"
+	"github.com/hashicorp/go-multierror"
+	"github.com/nrwiersma/proxy/acme"
 	"github.com/nrwiersma/proxy/http"
 	"github.com/nrwiersma/proxy/http/proxy"
+	"github.com/nrwiersma/proxy/http/proxyproto"
 	"github.com/nrwiersma/proxy/http/router"
 	"github.com/nrwiersma/proxy/middleware"
 )
@@ -27,10 +38,21 @@ type Service struct {
 	mu     sync.Mutex
 	bkends map[string]http.Handler
 	rtr    *router.Router
-	srv    *http.Server
+	h      http.Handler
+	opts   http.Opts
+	eps    map[string]Entrypoint
+	srvs   []*http.Server
+	acme   *acme.Manager
+	rlds   []reloader
+	caches map[string][]*middleware.Cache
 	log    log.Logger
 }
 
+// reloader is implemented by middleware with reloadable state.
+type reloader interface {
+	Reload() error
+}
+
 // NewServiceFromConfig returns a reverse proxy service with the given configuration.
 func NewServiceFromConfig(labl log.Loggable, c *Config) (*Service, error) {
 	svc, err := NewService(labl, c.Server)
@@ -38,6 +60,13 @@ func NewServiceFromConfig(labl log.Loggable, c *Config) (*Service, error) {
 		return nil, err
 	}
 
+	// ACME
+	if c.ACME != nil {
+		if err := svc.EnableACME(*c.ACME); err != nil {
+			return nil, err
+		}
+	}
+
 	// Backends
 	for name, bkend := range c.Backends {
 		if err := svc.AddBackend(name, bkend); err != nil {
@@ -53,12 +82,24 @@ func NewServiceFromConfig(labl log.Loggable, c *Config) (*Service, error) {
 	}
 
 	// Entrypoint
-	for name, ep := range c.Entrypoints {
-		if err := svc.AddEndpoint(name, ep); err != nil {
+	names := make([]string, 0, len(c.Entrypoints))
+	for name := range c.Entrypoints {
+		names = append(names, name)
+	}
+	// Redirecting entrypoints reference other entrypoints, so they are added last.
+	sort.SliceStable(names, func(i, j int) bool {
+		return c.Entrypoints[names[i]].RedirectTo == "" && c.Entrypoints[names[j]].RedirectTo != ""
+	})
+	for _, name := range names {
+		if err := svc.AddEndpoint(name, c.Entrypoints[name]); err != nil {
 			return nil, err
 		}
 	}
 
+	if svc.acme != nil {
+		svc.acme.Start()
+	}
+
 	return svc, nil
 }
 
@@ -66,6 +107,8 @@ func NewServiceFromConfig(labl log.Loggable, c *Config) (*Service, error) {
 func NewService(labl log.Loggable, opts ServiceOpts) (*Service, error) {
 	svc := &Service{
 		bkends: map[string]http.Handler{},
+		eps:    map[string]Entrypoint{},
+		caches: map[string][]*middleware.Cache{},
 		rtr:    &router.Router{},
 		log:    labl.Logger(),
 	}
@@ -74,24 +117,106 @@ func NewService(labl log.Loggable, opts ServiceOpts) (*Service, error) {
 	if opts.AccessLog {
 		h = middleware.NewLogger(h, svc.log)
 	}
+	svc.h = h
 
-	srv, err := http.NewServer(h, http.Opts{
+	svc.opts = http.Opts{
 		ReadTimeout:  opts.ReadTimeout,
 		WriteTimeout: opts.WriteTimeout,
 		IdleTimeout:  opts.IdleTimeout,
+	}
+
+	return svc, nil
+}
+
+// ACME represents automatic certificate configuration.
+type ACME struct {
+	Directory   string        `yaml:"directory"`
+	Email       string        `yaml:"email"`
+	Storage     string        `yaml:"storage"`
+	Domains     []string      `yaml:"domains"`
+	RenewBefore time.Duration `yaml:"renewBefore"`
+	Insecure    bool          `yaml:"insecure"`
+}
+
+// EnableACME enables automatic certificates on the service.
+//
+// HTTP-01 challenges are answered on all plain entrypoints, TLS-ALPN-01
+// challenges on TLS entrypoints using ACME.
+func (s *Service) EnableACME(cfg ACME) error {
+	m, err := acme.New(acme.Opts{
+		DirectoryURL:       cfg.Directory,
+		Email:              cfg.Email,
+		Storage:            cfg.Storage,
+		Domains:            cfg.Domains,
+		RenewBefore:        cfg.RenewBefore,
+		InsecureSkipVerify: cfg.Insecure,
+		Log:                s.log,
 	})
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("proxy: invalid acme configuration: %v", err)
 	}
-	svc.srv = srv
 
-	return svc, nil
+	s.mu.Lock()
+	s.acme = m
+	s.mu.Unlock()
+
+	return nil
 }
 
 // Backend represents a service backend.
 type Backend struct {
-	Servers []string      `yaml:"servers"`
-	Timeout time.Duration `yaml:"timeout"`
+	Servers       []string      `yaml:"servers"`
+	Timeout       time.Duration `yaml:"timeout"`
+	TLS           *BackendTLS   `yaml:"tls"`
+	ProxyProtocol int           `yaml:"proxyProtocol"`
+	Concurrency   *Concurrency  `yaml:"concurrency"`
+}
+
+// Concurrency represents the concurrency limits of a backend.
+type Concurrency struct {
+	MaxInFlight int           `yaml:"maxInFlight"`
+	MaxQueue    int           `yaml:"maxQueue"`
+	MaxWait     time.Duration `yaml:"maxWait"`
+}
+
+// BackendTLS represents the TLS configuration of https backend servers.
+type BackendTLS struct {
+	CAFile     string `yaml:"ca"`
+	CertFile   string `yaml:"cert"`
+	KeyFile    string `yaml:"key"`
+	ServerName string `yaml:"serverName"`
+	MinVersion string `yaml:"minVersion"`
+	Insecure   bool   `yaml:"insecure"`
+}
+
+func (b *BackendTLS) opts() (proxy.TLSOpts, error) {
+	if b == nil {
+		return proxy.TLSOpts{}, nil
+	}
+
+	var minVersion uint16
+	switch b.MinVersion {
+	case "":
+	case "1.0":
+		minVersion = tls.VersionTLS10
+	case "1.1":
+		minVersion = tls.VersionTLS11
+	case "1.2":
+		minVersion = tls.VersionTLS12
+	case "1.3":
+		minVersion = tls.VersionTLS13
+	default:
+		return proxy.TLSOpts{}, fmt.Errorf("unknown tls version '%s'", b.MinVersion)
+	}
+
+	return proxy.TLSOpts{
+		CAFile:             b.CAFile,
+		CertFile:           b.CertFile,
+		KeyFile:            b.KeyFile,
+		ServerName:         b.ServerName,
+		MinVersion:         minVersion,
+		InsecureSkipVerify: b.Insecure,
+	}, nil
 }
 
 // AddBackend adds a backend to the service.
@@ -100,34 +225,58 @@ func (s *Service) AddBackend(name string, bkend Backend) error {
 		return fmt.Errorf("proxy: backend %s must have at least 1 backend", name)
 	}
 
+	tlsOpts, err := bkend.TLS.opts()
+	if err != nil {
+		return fmt.Errorf("proxy: invalid tls in backend %s: %v", name, err)
+	}
+	if v := bkend.ProxyProtocol; v != 0 && v != 1 && v != 2 {
+		return fmt.Errorf("proxy: unknown proxy protocol version %d in backend %s", v, name)
+	}
+
 	srvs := make([]http.Handler, len(bkend.Servers))
 	for i, srv := range bkend.Servers {
 		u, err := url.Parse(srv)
 		if err != nil {
-			return fmt.Errorf("proxy: invalid server '%s' in backend %s", srv, name)
+			return fmt.Errorf("proxy: invalid server '%s' in backend %s: %v", srv, name, err)
 		}
 
 		var h http.Handler
-		opts := proxy.Opts{Timeout: bkend.Timeout}
+		opts := proxy.Opts{
+			Timeout:       bkend.Timeout,
+			ProxyProtocol: bkend.ProxyProtocol,
+		}
 		switch u.Scheme {
 		case "http", "":
 			h, err = proxy.New(u.Host, opts)
 
 		case "https":
-			h, err = proxy.NewTLS(u.Host, "", "", opts)
+			h, err = proxy.NewTLS(u.Host, tlsOpts, opts)
 
 		default:
 			return fmt.Errorf("proxy: unknown scheme '%s' in backend %s", u.Scheme, name)
 		}
 		if err != nil {
-			return fmt.Errorf("proxy: invalid server '%s' in backend %s", srv, name)
+			return fmt.Errorf("proxy: invalid server '%s' in backend %s: %v", srv, name, err)
 		}
 
 		srvs[i] = h
 	}
 
+	var h http.Handler = proxy.NewRRLoadBalancer(srvs)
+	if c := bkend.Concurrency; c != nil {
+		if c.MaxInFlight <= 0 {
+			return fmt.Errorf("proxy: concurrency maxInFlight must be greater than 0 in backend %s", name)
+		}
+
+		h = middleware.NewConcurrencyLimit(h, middleware.ConcurrencyLimitOpts{
+			MaxInFlight: c.MaxInFlight,
+			MaxQueue:    c.MaxQueue,
+			MaxWait:     c.MaxWait,
+		})
+	}
+
 	s.mu.Lock()
-	s.bkends[name] = proxy.NewRRLoadBalancer(srvs)
+	s.bkends[name] = h
 	s.mu.Unlock()
 
 	return nil
@@ -147,7 +296,7 @@ func (s *Service) AddRoute(name string, route Route) error {
 		return fmt.Errorf("proxy: unknown backend %s in route %s", route.Backend, name)
 	}
 
-	h, err := createMiddleware(route.Middleware, backend)
+	h, err := s.createMiddleware(name, route.Middleware, backend)
 	if err != nil {
 		return err
 	}
@@ -159,29 +308,189 @@ func (s *Service) AddRoute(name string, route Route) error {
 
 // Entrypoint represents a service endpoint.
 type Entrypoint struct {
-	Address     string       `yaml:"address"`
-	Certificate *Certificate `yaml:"tls"`
+	Address          string            `yaml:"address"`
+	Certificate      *Certificate      `yaml:"tls"`
+	ProxyProtocol    *ProxyProtocol    `yaml:"proxyProtocol"`
+	ForwardedHeaders *ForwardedHeaders `yaml:"forwardedHeaders"`
+	RedirectTo       string            `yaml:"redirectTo"`
+}
+
+// ForwardedHeaders represents forwarded headers configuration.
+type ForwardedHeaders struct {
+	TrustedIPs []string `yaml:"trustedIPs"`
+	Insecure   bool     `yaml:"insecure"`
+	Pseudonym  string   `yaml:"pseudonym"`
+}
+
+func (f *ForwardedHeaders) opts() (middleware.ForwardedOpts, error) {
+	if f == nil {
+		return middleware.ForwardedOpts{}, nil
+	}
+
+	trusted, err := middleware.ParseCIDRs(f.TrustedIPs)
+	if err != nil {
+		return middleware.ForwardedOpts{}, err
+	}
+
+	return middleware.ForwardedOpts{
+		TrustedProxies: trusted,
+		TrustAll:       f.Insecure,
+		Pseudonym:      f.Pseudonym,
+	}, nil
+}
+
+// ProxyProtocol represents PROXY protocol configuration.
+type ProxyProtocol struct {
+	TrustedIPs []string `yaml:"trustedIPs"`
+	Insecure   bool     `yaml:"insecure"`
+}
+
+func (p *ProxyProtocol) trusted() ([]*net.IPNet, error) {
+	if p.Insecure {
+		return nil, nil
+	}
+
+	nets, err := middleware.ParseCIDRs(p.TrustedIPs)
+	if err != nil {
+		return nil, err
+	}
+	if len(nets) == 0 {
+		return nil, errors.New("trusted ips are required")
+	}
+	return nets, nil
 }
 
 func (e *Entrypoint) isTLS() bool {
 	return e.Certificate != nil &&
-		e.Certificate.CertFile != "" &&
-		e.Certificate.KeyFile != ""
+		(e.Certificate.CertFile != "" && e.Certificate.KeyFile != "" || e.Certificate.ACME)
 }
 
 // Certificate represents a service certificate.
 type Certificate struct {
-	CertFile string `yaml:"cert"`
-	KeyFile  string `yaml:"key"`
+	CertFile   string `yaml:"cert"`
+	KeyFile    string `yaml:"key"`
+	ACME       bool   `yaml:"acme"`
+	ClientCA   string `yaml:"clientCA"`
+	ClientAuth string `yaml:"clientAuth"`
+}
+
+func (c *Certificate) clientAuth() (tls.ClientAuthType, bool) {
+	switch c.ClientAuth {
+	case "":
+		if c.ClientCA != "" {
+			return tls.RequireAndVerifyClientCert, true
+		}
+		return tls.NoClientCert, true
+
+	case "request":
+		return tls.RequestClientCert, true
+
+	case "require":
+		return tls.RequireAnyClientCert, true
+
+	case "verifyIfGiven":
+		return tls.VerifyClientCertIfGiven, true
+
+	case "verify":
+		return tls.RequireAndVerifyClientCert, true
+
+	default:
+		return tls.NoClientCert, false
+	}
+}
+
+func (c *Certificate) clientCAs() (*x509.CertPool, error) {
+	if c.ClientCA == "" {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(c.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", c.ClientCA)
+	}
+	return pool, nil
 }
 
 // AddEndpoint adds an endpoint to the service.
 func (s *Service) AddEndpoint(name string, ep Entrypoint) error {
+	fwdOpts, err := ep.ForwardedHeaders.opts()
+	if err != nil {
+		return fmt.Errorf("proxy: invalid forwarded headers in entrypoint %s: %v", name, err)
+	}
+	if _, port, err := net.SplitHostPort(ep.Address); err == nil {
+		fwdOpts.Port = port
+	}
+
+	var h http.Handler = middleware.NewForwarded(s.h, fwdOpts)
+	if ep.RedirectTo != "" {
+		h, err = s.redirectHandler(name, ep.RedirectTo, h)
+		if err != nil {
+			return err
+		}
+	}
+	opts := s.opts
+
+	s.mu.Lock()
+	acmeMgr := s.acme
+	s.mu.Unlock()
+
+	if ep.isTLS() {
+		clientAuth, ok := ep.Certificate.clientAuth()
+		if !ok {
+			return fmt.Errorf("proxy: unknown client auth '%s' in entrypoint %s", ep.Certificate.ClientAuth, name)
+		}
+		clientCAs, err := ep.Certificate.clientCAs()
+		if err != nil {
+			return fmt.Errorf("proxy: invalid client ca in entrypoint %s: %v", name, err)
+		}
+
+		opts.TLSConfig = &tls.Config{
+			ClientAuth: clientAuth,
+			ClientCAs:  clientCAs,
+		}
+		if ep.Certificate.ACME {
+			if acmeMgr == nil {
+				return fmt.Errorf("proxy: entrypoint %s uses acme but acme is not configured", name)
+			}
+			acmeMgr.ConfigureTLS(opts.TLSConfig)
+		}
+	} else if acmeMgr != nil {
+		h = acmeMgr.HTTPHandler(h)
+	}
+
+	srv, err := http.NewServer(h, opts)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", ep.Address)
+	if err != nil {
+		return fmt.Errorf("proxy: could not listen on entrypoint %s: %v", name, err)
+	}
+	if ep.ProxyProtocol != nil {
+		trusted, err := ep.ProxyProtocol.trusted()
+		if err != nil {
+			_ = ln.Close()
+			return fmt.Errorf("proxy: invalid proxy protocol in entrypoint %s: %v", name, err)
+		}
+		ln = proxyproto.NewListener(ln, trusted)
+	}
+
+	s.mu.Lock()
+	s.eps[name] = ep
+	s.srvs = append(s.srvs, srv)
+	s.mu.Unlock()
+
 	if ep.isTLS() {
 		go func() {
 			s.log.Info(fmt.Sprintf("Starting tls server on address %s", ep.Address))
-			err := s.srv.ListenAndServeTLS(ep.Address, ep.Certificate.CertFile, ep.Certificate.KeyFile)
-			if err != nil {
+			err := srv.ServeTLS(ln, ep.Certificate.CertFile, ep.Certificate.KeyFile)
+			if err != nil && err != http.ErrServerClosed {
 				s.log.Error("service: server error", "error", err)
 			}
 		}()
@@ -190,8 +499,8 @@ func (s *Service) AddEndpoint(name string, ep Entrypoint) error {
 
 	go func() {
 		s.log.Info(fmt.Sprintf("Starting server on address %s", ep.Address))
-		err := s.srv.ListenAndServe(ep.Address)
-		if err != nil {
+		err := srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
 			s.log.Error("service: server error", "error", err)
 		}
 	}()
@@ -199,6 +508,82 @@ func (s *Service) AddEndpoint(name string, ep Entrypoint) error {
 	return nil
 }
 
+var redirectHostRegexp = regexp.MustCompile(`^http://(\[[^\]]+\]|[^/:]+)(?::\d+)?(.*)$`)
+
+// redirectHandler returns a handler redirecting all requests to the given TLS entrypoint.
+func (s *Service) redirectHandler(name, to string, h http.Handler) (http.Handler, error) {
+	s.mu.Lock()
+	target, ok := s.eps[to]
+	s.mu.Unlock()
+	if !ok || !target.isTLS() {
+		return nil, fmt.Errorf("proxy: entrypoint %s redirects to unknown tls entrypoint %s", name, to)
+	}
+
+	_, port, err := net.SplitHostPort(target.Address)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: invalid address in entrypoint %s: %v", to, err)
+	}
+
+	host := "$1"
+	if port != "443" {
+		host += ":" + port
+	}
+
+	return middleware.NewRedirect(h, middleware.RedirectOpts{
+		Regex:       redirectHostRegexp,
+		Replacement: "https://" + host + "$2",
+		StatusCode:  301,
+	}), nil
+}
+
+// Reload reloads the reloadable state of the service, like
+// lists loaded from files.
+func (s *Service) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for _, r := range s.rlds {
+		if rerr := r.Reload(); rerr != nil {
+			err = multierror.Append(err, rerr)
+		}
+	}
+	return err
+}
+
+// CacheStats returns the cache statistics of the routes with a cache.
+func (s *Service) CacheStats() map[string]middleware.CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make(map[string]middleware.CacheStats, len(s.caches))
+	for route, caches := range s.caches {
+		var sum middleware.CacheStats
+		for _, c := range caches {
+			cs := c.Stats()
+			sum.Entries += cs.Entries
+			sum.Bytes += cs.Bytes
+			sum.Hits += cs.Hits
+			sum.Misses += cs.Misses
+			sum.Evictions += cs.Evictions
+		}
+		res[route] = sum
+	}
+	return res
+}
+
+// ReportStats reports the cache statistics of the routes as gauges.
+func (s *Service) ReportStats(statter stats.Statter) {
+	for route, cs := range s.CacheStats() {
+		tags := []string{"route", route}
+		statter.Gauge("cache.entries", float64(cs.Entries), 1.0, tags...)
+		statter.Gauge("cache.bytes", float64(cs.Bytes), 1.0, tags...)
+		statter.Gauge("cache.hits", float64(cs.Hits), 1.0, tags...)
+		statter.Gauge("cache.misses", float64(cs.Misses), 1.0, tags...)
+		statter.Gauge("cache.evictions", float64(cs.Evictions), 1.0, tags...)
+	}
+}
+
 // Shutdown attempts to shut the service down in the given timeout.
 func (s *Service) Shutdown(d time.Duration) error {
 	ctx := context.Background()
@@ -207,10 +592,35 @@ func (s *Service) Shutdown(d time.Duration) error {
 		ctx, cancelFn = context.WithTimeout(context.Background(), d)
 		defer cancelFn()
 	}
-	return s.srv.Shutdown(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.acme != nil {
+		_ = s.acme.Close()
+	}
+	for _, srv := range s.srvs {
+		if serr := srv.Shutdown(ctx); serr != nil {
+			err = multierror.Append(err, serr)
+		}
+	}
+	return err
 }
 
 // Close will forcefully close the service.
 func (s *Service) Close() error {
-	return s.srv.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.acme != nil {
+		_ = s.acme.Close()
+	}
+	for _, srv := range s.srvs {
+		if cerr := srv.Close(); cerr != nil {
+			err = multierror.Append(err, cerr)
+		}
+	}
+	return err
 }